@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/csrf"
@@ -13,6 +14,7 @@ import (
 	"github.com/wagnojunior/lenslocked/controllers"
 	"github.com/wagnojunior/lenslocked/migrations"
 	"github.com/wagnojunior/lenslocked/models"
+	"github.com/wagnojunior/lenslocked/rand"
 	"github.com/wagnojunior/lenslocked/templates"
 	"github.com/wagnojunior/lenslocked/views"
 )
@@ -29,6 +31,17 @@ type config struct {
 	Server struct {
 		Address string
 	}
+	Trash struct {
+		Retention time.Duration
+	}
+	Images struct {
+		SigningKey string
+		CacheSize  int64
+	}
+	Map struct {
+		TileURL     string
+		Attribution string
+	}
 }
 
 // loadEnvConfig loads the environment variables and sets the config for this
@@ -73,6 +86,34 @@ func loadEnvConfig() (config, error) {
 	// SERVER configuration
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
 
+	// TRASH configuration. The retention period is a duration such as `720h`
+	// and defaults to the one of the GalleryService if not set
+	retention := os.Getenv("TRASH_RETENTION")
+	if retention != "" {
+		cfg.Trash.Retention, err = time.ParseDuration(retention)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	// IMAGES configuration. The signing key signs the URLs of transformed
+	// images, and the cache size is given in megabytes
+	cfg.Images.SigningKey = os.Getenv("IMAGES_SIGNING_KEY")
+	cacheSize := os.Getenv("IMAGES_CACHE_SIZE")
+	if cacheSize != "" {
+		cfg.Images.CacheSize, err = strconv.ParseInt(cacheSize, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Images.CacheSize <<= 20
+	}
+
+	// MAP configuration. The tile URL is a template such as
+	// `https://tile.example.com/{z}/{x}/{y}.png`. Maps are shown as lists of
+	// coordinates if it is not set
+	cfg.Map.TileURL = os.Getenv("MAP_TILE_URL")
+	cfg.Map.Attribution = os.Getenv("MAP_ATTRIBUTION")
+
 	return cfg, nil
 
 }
@@ -118,13 +159,80 @@ func run(cfg config) error {
 		DB: db,
 	}
 	galleryService := &models.GalleryService{
+		DB:             db,
+		ImagesDir:      "",                  // Use default value if not set
+		ImagesExt:      make([]string, 0),   // Use default value if not set
+		ImagesCont:     make([]string, 0),   // Use default value if not set
+		TrashRetention: cfg.Trash.Retention, // Use default value if not set
+	}
+	tagService := &models.TagService{
+		DB: db,
+	}
+	searchService := &models.SearchService{
+		DB: db,
+	}
+	collectionService := &models.CollectionService{
+		DB: db,
+	}
+	watermarkService := &models.WatermarkService{
+		DB:            db,
+		WatermarksDir: "", // Use default value if not set
+	}
+	favoriteService := &models.FavoriteService{
+		DB: db,
+	}
+	commentService := &models.CommentService{
 		DB:         db,
-		ImagesDir:  "",                // Use default value if not set
-		ImagesExt:  make([]string, 0), // Use default value if not set
-		ImagesCont: make([]string, 0), // Use default value if not set
+		RateLimit:  0, // Use default value if not set
+		RateWindow: 0, // Use default value if not set
+	}
+	followService := &models.FollowService{
+		DB: db,
+	}
+	proofingService := &models.ProofingService{
+		DB: db,
 	}
 	emailService := models.NewEmailService(cfg.SMTP)
 
+	// Without a configured key, the URLs of transformed images are signed
+	// with a random key and are only valid until the server restarts
+	signingKey := []byte(cfg.Images.SigningKey)
+	if len(signingKey) == 0 {
+		signingKey, err = rand.Bytes(32)
+		if err != nil {
+			return err
+		}
+	}
+	transformService := &models.TransformService{
+		GalleryService: galleryService,
+		SigningKey:     signingKey,
+		CacheDir:       "",                   // Use default value if not set
+		CacheSize:      cfg.Images.CacheSize, // Use default value if not set
+	}
+
+	// Records the images uploaded before images were tracked in the DB
+	err = galleryService.SyncImages()
+	if err != nil {
+		return err
+	}
+
+	// Computes the placeholders and the locations of the images that have
+	// none. This can take a while, so it does not delay the start of the
+	// server
+	go func() {
+		err := galleryService.SyncPlaceholders()
+		if err != nil {
+			fmt.Println(err)
+		}
+		err = galleryService.SyncLocations()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	// Purges the trash periodically
+	go purgeTrash(galleryService)
+
 	// Creates an instance of the UserMiddleware
 	umw := controllers.UserMiddleware{
 		SessionService: sessionService,
@@ -147,6 +255,10 @@ func run(cfg config) error {
 		SessionService:       sessionService,
 		PasswordResetService: pwResetService,
 		EmailService:         emailService,
+		GalleryService:       galleryService,
+		WatermarkService:     watermarkService,
+		CommentService:       commentService,
+		FollowService:        followService,
 	}
 
 	usersC.Templates.New = views.Must(views.ParseFS(
@@ -161,10 +273,33 @@ func run(cfg config) error {
 		templates.FS, "check-your-email.gohtml", "tailwind.gohtml"))
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(
 		templates.FS, "reset-pw.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Profile = views.Must(views.ParseFS(
+		templates.FS, "profile.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Feed = views.Must(views.ParseFS(
+		templates.FS, "feed.gohtml", "tailwind.gohtml"))
+
+	// Initializes the controller for the feeds `feedsC`
+	feedsC := controllers.Feeds{
+		GalleryService:   galleryService,
+		TransformService: transformService,
+		UserService:      userService,
+	}
 
 	// Initializes the controller for the galleries `galleriesC`
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:    galleryService,
+		TagService:        tagService,
+		SearchService:     searchService,
+		CollectionService: collectionService,
+		UserService:       userService,
+		TransformService:  transformService,
+		WatermarkService:  watermarkService,
+		FavoriteService:   favoriteService,
+		CommentService:    commentService,
+		EmailService:      emailService,
+		ProofingService:   proofingService,
+		MapTileURL:        cfg.Map.TileURL,
+		MapAttribution:    cfg.Map.Attribution,
 	}
 
 	galleriesC.Templates.New = views.Must(views.ParseFS(
@@ -174,7 +309,43 @@ func run(cfg config) error {
 	galleriesC.Templates.Index = views.Must(views.ParseFS(
 		templates.FS, "galleries/index.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(
-		templates.FS, "galleries/show.gohtml", "tailwind.gohtml"))
+		templates.FS, "galleries/show.gohtml", "galleries/thread.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Search = views.Must(views.ParseFS(
+		templates.FS, "galleries/search.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Trash = views.Must(views.ParseFS(
+		templates.FS, "galleries/trash.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.View = views.Must(views.ParseFS(
+		templates.FS, "galleries/view.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Map = views.Must(views.ParseFS(
+		templates.FS, "galleries/map.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Favorites = views.Must(views.ParseFS(
+		templates.FS, "galleries/favorites.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Comments = views.Must(views.ParseFS(
+		templates.FS, "galleries/comments.gohtml", "galleries/thread.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Proofing = views.Must(views.ParseFS(
+		templates.FS, "galleries/proofing.gohtml", "tailwind.gohtml"))
+
+	// Initializes the controller for the collections `collectionsC`
+	collectionsC := controllers.Collections{
+		CollectionService: collectionService,
+		GalleryService:    galleryService,
+	}
+
+	collectionsC.Templates.Index = views.Must(views.ParseFS(
+		templates.FS, "collections/index.gohtml", "tailwind.gohtml"))
+	collectionsC.Templates.Show = views.Must(views.ParseFS(
+		templates.FS, "collections/show.gohtml", "tailwind.gohtml"))
+	collectionsC.Templates.Edit = views.Must(views.ParseFS(
+		templates.FS, "collections/edit.gohtml", "tailwind.gohtml"))
+
+	// Initializes the controller for the tags `tagsC`
+	tagsC := controllers.Tags{
+		TagService:     tagService,
+		GalleryService: galleryService,
+	}
+
+	tagsC.Templates.Show = views.Must(views.ParseFS(
+		templates.FS, "tags/show.gohtml", "tailwind.gohtml"))
 
 	// Creates a new chi router and applies the different middlewares
 	r := chi.NewRouter()
@@ -199,30 +370,116 @@ func run(cfg config) error {
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Post("/", usersC.UpdateProfile)
+		r.Post("/avatar", usersC.UploadAvatar)
+		r.Post("/watermark", usersC.UpdateWatermark)
+		r.Get("/watermark/logo", usersC.WatermarkLogo)
+		r.Post("/blocked/{userID}/delete", usersC.UnblockCommenter)
+		r.Post("/following", usersC.Follow)
+	})
+	r.Get("/users/{id}/feed.atom", feedsC.UserAtomByID)
+	r.Get("/users/{id}/feed.rss", feedsC.UserRSSByID)
+	r.Get("/feed.atom", feedsC.Atom)
+	r.Get("/feed.rss", feedsC.RSS)
+	r.Route("/feed", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", usersC.Feed)
 	})
+	r.Route("/u/{username}", func(r chi.Router) {
+		r.Get("/", usersC.Profile)
+		r.Get("/avatar", usersC.Avatar)
+		r.Get("/feed.atom", feedsC.UserAtom)
+		r.Get("/feed.rss", feedsC.UserRSS)
+		r.Get("/{slug}", galleriesC.ShowBySlug)
+	})
+	r.Get("/img/{signature}/{options}/{id}/{filename}", galleriesC.Transform)
+	r.Get("/proofing/{token}", galleriesC.ProofingLink)
+	r.Get("/oembed", galleriesC.OEmbed)
 	r.Route("/galleries", func(r chi.Router) {
 		// r.Group groups all paths to the same middleware
 		r.Get("/{id}", galleriesC.Show)
 		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/images/{filename}/original", galleriesC.Original)
+		r.Get("/{id}/images/{filename}/view", galleriesC.View)
+		r.Get("/{id}/map", galleriesC.Map)
+		r.Get("/{id}/map.geojson", galleriesC.GeoJSON)
+		r.Get("/{id}/images/{filename}/comments", galleriesC.ImageComments)
+		// Visitors of the share link proof galleries without an account
+		r.Get("/{id}/proofing", galleriesC.Proofing)
+		r.Post("/{id}/proofing/images/{filename}", galleriesC.SelectProofImage)
+		r.Post("/{id}/proofing/submit", galleriesC.SubmitProof)
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
 			r.Get("/new", galleriesC.New)
+			r.Post("/preview", galleriesC.PreviewDescription)
 			r.Get("/", galleriesC.Index)
+			r.Get("/trash", galleriesC.Trash)
+			r.Get("/favorites", galleriesC.Favorites)
 			r.Post("/", galleriesC.Create)
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
+			r.Post("/{id}/duplicate", galleriesC.Duplicate)
 			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Post("/{id}/restore", galleriesC.Restore)
+			r.Post("/{id}/purge", galleriesC.Purge)
 			r.Post("/{id}/publish", galleriesC.Publish)
 			r.Post("/{id}/unpublish", galleriesC.Unpublish)
+			r.Post("/{id}/collection", galleriesC.SetCollection)
+			r.Post("/{id}/watermark", galleriesC.SetWatermark)
+			r.Post("/{id}/rights", galleriesC.SetRights)
+			r.Post("/{id}/location", galleriesC.SetPublicLocation)
+			r.Post("/{id}/favorite", galleriesC.FavoriteGallery)
+			r.Post("/{id}/images/{filename}/favorite", galleriesC.FavoriteImage)
+			r.Post("/{id}/moderation", galleriesC.SetCommentModeration)
+			r.Post("/{id}/comments", galleriesC.CreateComment)
+			r.Post("/{id}/images/{filename}/comments", galleriesC.CreateComment)
+			r.Post("/{id}/comments/{commentID}/approve", galleriesC.ApproveComment)
+			r.Post("/{id}/comments/{commentID}/delete", galleriesC.DeleteComment)
+			r.Post("/{id}/comments/{commentID}/block", galleriesC.BlockCommenter)
+			r.Post("/{id}/proofing", galleriesC.SetProofing)
+			r.Post("/{id}/proofing/link", galleriesC.ResetProofingLink)
+			r.Get("/{id}/proofing/{proofID}.csv", galleriesC.ExportProof)
+			r.Post("/{id}/images/transfer", galleriesC.TransferImages)
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			r.Post("/{id}/images/{filename}/restore", galleriesC.RestoreImage)
+			r.Post("/{id}/images/{filename}/purge", galleriesC.PurgeImage)
+			r.Post("/{id}/images/{filename}/edit", galleriesC.EditImage)
+			r.Get("/{id}/images/{filename}/versions/{number}", galleriesC.Version)
+			r.Post("/{id}/images/{filename}/versions/{number}/revert", galleriesC.RevertImage)
+			r.Post("/{id}/images/{filename}", galleriesC.UpdateImage)
 			r.Post("/{id}/images", galleriesC.UploadImage)
 		})
 
 	})
+	r.Route("/collections", func(r chi.Router) {
+		r.Get("/{id}", collectionsC.Show)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Get("/", collectionsC.Index)
+			r.Post("/", collectionsC.Create)
+			r.Get("/{id}/edit", collectionsC.Edit)
+			r.Post("/{id}", collectionsC.Update)
+			r.Post("/{id}/delete", collectionsC.Delete)
+		})
+	})
+	r.Get("/search", galleriesC.Search)
+	r.Route("/tags", func(r chi.Router) {
+		r.Get("/{tag}", tagsC.Show)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Get("/", tagsC.Autocomplete)
+		})
+	})
 	// Serve static files from the folder `assets`
 	assetsHandler := http.FileServer(http.Dir("assets"))
 	r.Get("/assets/*", http.StripPrefix("/assets", assetsHandler).ServeHTTP)
 
+	// Images are only served in their original format without an encoder for
+	// a modern format, e.g. when built without cgo
+	if len(models.ModernFormats()) == 0 {
+		fmt.Println("no modern image format is registered: images are served in their original format")
+	}
+
 	// Starts the server
 	fmt.Printf("Starting the server on %s...", cfg.Server.Address)
 	err = http.ListenAndServe(cfg.Server.Address, r)
@@ -232,3 +489,16 @@ func run(cfg config) error {
 
 	return nil
 }
+
+// purgeTrash permanently deletes the galleries and images that have been in the
+// trash for longer than the retention period. It runs once at startup and then
+// every hour
+func purgeTrash(galleryService *models.GalleryService) {
+	for {
+		err := galleryService.PurgeTrash()
+		if err != nil {
+			fmt.Println(err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
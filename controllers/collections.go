@@ -0,0 +1,390 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wagnojunior/lenslocked/context"
+	"github.com/wagnojunior/lenslocked/errors"
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// Collections holds the template struct that stores all the templates needed
+// to render the collection pages. Also, it holds the necessary services
+type Collections struct {
+	Templates struct {
+		Index Template
+		Show  Template
+		Edit  Template
+	}
+	CollectionService *models.CollectionService
+	GalleryService    *models.GalleryService
+}
+
+// selectOption defines an option of the selects that pick a collection or a
+// gallery
+type selectOption struct {
+	ID    int
+	Title string
+}
+
+// Index lists the root collections of the current user and renders the form
+// to create a new collection
+func (c Collections) Index(w http.ResponseWriter, r *http.Request) {
+	type Collection struct {
+		ID     int
+		Title  string
+		Status models.PublicationStatus
+	}
+	var data struct {
+		Collections []Collection
+		Parents     []selectOption
+	}
+
+	user := context.User(r.Context())
+	collections, err := c.CollectionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	for _, collection := range collections {
+		data.Parents = append(data.Parents, selectOption{
+			ID:    collection.ID,
+			Title: collection.Title,
+		})
+		if collection.ParentID != 0 {
+			continue
+		}
+		data.Collections = append(data.Collections, Collection{
+			ID:     collection.ID,
+			Title:  collection.Title,
+			Status: collection.Status,
+		})
+	}
+
+	c.Templates.Index.Execute(w, r, data)
+}
+
+// Create handles the creation of a new collection, optionally nested inside
+// the collection given in the form value `parent_id`
+func (c Collections) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+
+	collection, err := c.CollectionService.Create(r.FormValue("title"), user.ID, parentID)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCollection) {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	showPath := fmt.Sprintf("/collections/%d", collection.ID)
+	http.Redirect(w, r, showPath, http.StatusFound)
+}
+
+// Show renders a collection with the covers of the collections and galleries
+// it contains. Visitors only see published children
+func (c Collections) Show(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, collectionMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	type Crumb struct {
+		ID    int
+		Title string
+	}
+	type Child struct {
+		URL          string
+		Title        string
+		Status       models.PublicationStatus
+		CoverURL     string
+		IsCollection bool
+	}
+	var data struct {
+		ID          int
+		Title       string
+		IsOwner     bool
+		Breadcrumbs []Crumb
+		Children    []Child
+	}
+	data.ID = collection.ID
+	data.Title = collection.Title
+	user := context.User(r.Context())
+	data.IsOwner = user != nil && user.ID == collection.UserID
+	publishedOnly := !data.IsOwner
+
+	ancestors, err := c.CollectionService.Ancestors(collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, ancestor := range breadcrumbs(ancestors[:len(ancestors)-1], publishedOnly) {
+		data.Breadcrumbs = append(data.Breadcrumbs, Crumb{
+			ID:    ancestor.ID,
+			Title: ancestor.Title,
+		})
+	}
+
+	children, err := c.CollectionService.Children(collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, child := range children {
+		if publishedOnly && child.Status != models.Published {
+			continue
+		}
+
+		item := Child{
+			URL:          fmt.Sprintf("/collections/%d", child.ID),
+			Title:        child.Title,
+			Status:       child.Status,
+			IsCollection: true,
+		}
+		cover, err := c.CollectionService.Cover(child.ID, publishedOnly)
+		if err != nil && !errors.Is(err, models.ErrImageNotFound) {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if cover != nil {
+			item.CoverURL = thumbnailURL(c.GalleryService, cover.GalleryID, cover.Filename)
+		}
+		data.Children = append(data.Children, item)
+	}
+
+	galleries, err := c.CollectionService.Galleries(collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		if publishedOnly && gallery.Status != models.Published {
+			continue
+		}
+
+		item := Child{
+			URL:    fmt.Sprintf("/galleries/%d", gallery.ID),
+			Title:  gallery.Title,
+			Status: gallery.Status,
+		}
+		cover, err := c.GalleryService.Cover(gallery.ID)
+		if err != nil && !errors.Is(err, models.ErrImageNotFound) {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if cover != nil {
+			item.CoverURL = thumbnailURL(c.GalleryService, cover.GalleryID, cover.Filename)
+		}
+		data.Children = append(data.Children, item)
+	}
+
+	c.Templates.Show.Execute(w, r, data)
+}
+
+// Edit renders the form where the title, the parent and the visibility of a
+// collection are edited
+func (c Collections) Edit(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+
+	c.renderEdit(w, r, collection)
+}
+
+// Update handles the update of a collection. Moving a collection inside itself
+// or inside one of its sub-collections is rejected
+func (c Collections) Update(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+
+	collection.Title = r.FormValue("title")
+	collection.ParentID, _ = strconv.Atoi(r.FormValue("parent_id"))
+	switch visibility := models.Visibility(r.FormValue("visibility")); visibility {
+	case models.VisibilityInherit, models.VisibilityPublished, models.VisibilityUnpublished:
+		collection.Visibility = visibility
+	}
+
+	err = c.CollectionService.Update(collection)
+	if err != nil {
+		if errors.Is(err, models.ErrCollectionCycle) {
+			err = errors.Public(err, "A collection can not be moved inside itself or inside one of its sub-collections.")
+			c.renderEdit(w, r, collection, err)
+			return
+		}
+		if errors.Is(err, models.ErrInvalidCollection) {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "could not update the collection", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/collections/%d/edit", collection.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Delete deletes a collection. The collections and galleries it contains are
+// moved to the root
+func (c Collections) Delete(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+
+	err = c.CollectionService.Delete(collection)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/collections", http.StatusFound)
+}
+
+// /////////////////////////////////////////////////////////////////////////////
+// HELPER FUNCTIONS
+// /////////////////////////////////////////////////////////////////////////////
+
+// renderEdit renders the `Edit` template of the given collection with the
+// given errors, if any
+func (c Collections) renderEdit(w http.ResponseWriter, r *http.Request, collection *models.Collection, errs ...error) {
+	var data struct {
+		ID         int
+		Title      string
+		ParentID   int
+		Visibility models.Visibility
+		Status     models.PublicationStatus
+		Parents    []selectOption
+	}
+	data.ID = collection.ID
+	data.Title = collection.Title
+	data.ParentID = collection.ParentID
+	data.Visibility = collection.Visibility
+	data.Status = collection.Status
+
+	collections, err := c.CollectionService.ByUserID(collection.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, parent := range collections {
+		if parent.ID == collection.ID {
+			continue
+		}
+		data.Parents = append(data.Parents, selectOption{
+			ID:    parent.ID,
+			Title: parent.Title,
+		})
+	}
+
+	c.Templates.Edit.Execute(w, r, data, errs...)
+}
+
+// imageURL returns the URL of the given image
+func imageURL(galleryID int, filename string) string {
+	return fmt.Sprintf("/galleries/%d/images/%s", galleryID, url.PathEscape(filename))
+}
+
+// thumbnailURL returns the fingerprinted URL of the thumbnail of the given
+// image
+func thumbnailURL(gs *models.GalleryService, galleryID int, filename string) string {
+	return fmt.Sprintf("%s?size=thumb&v=%s", imageURL(galleryID, filename), imageVersion(gs, galleryID, filename))
+}
+
+// breadcrumbs returns the ancestors, ordered from the root, that are shown as
+// breadcrumbs. If publishedOnly is set, only the trailing published ancestors
+// are kept so that unpublished collections are not disclosed to visitors
+func breadcrumbs(ancestors []models.Collection, publishedOnly bool) []models.Collection {
+	start := 0
+	if publishedOnly {
+		for i, ancestor := range ancestors {
+			if ancestor.Status != models.Published {
+				start = i + 1
+			}
+		}
+	}
+
+	return ancestors[start:]
+}
+
+// /////////////////////////////////////////////////////////////////////////////
+// FUNCTIONAL OPTIONS
+// /////////////////////////////////////////////////////////////////////////////
+
+// collectionOpt defines a functional option. Functions that have this
+// signature are of type collectionOpt
+type collectionOpt func(http.ResponseWriter, *http.Request, *models.Collection) error
+
+// collectionByID is a helper method that gets a collection by ID and returns
+// it. It receives functional options, which are set by the caller
+func (c Collections) collectionByID(w http.ResponseWriter, r *http.Request, opts ...collectionOpt) (*models.Collection, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	collection, err := c.CollectionService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCollection) {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return nil, err
+		}
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		err = opt(w, r, collection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return collection, nil
+}
+
+// userMustOwnCollection is a functional option which determines that a user
+// must own a collection
+func userMustOwnCollection(w http.ResponseWriter, r *http.Request, collection *models.Collection) error {
+	user := context.User(r.Context())
+	if user == nil || collection.UserID != user.ID {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return fmt.Errorf("user does not have access to this collection")
+	}
+
+	return nil
+}
+
+// collectionMustBeVisible checks if a user has access to the given collection.
+// Collections that are not published are only visible to their owner
+func collectionMustBeVisible(w http.ResponseWriter, r *http.Request, collection *models.Collection) error {
+	user := context.User(r.Context())
+	var owner bool = (user != nil && collection.UserID == user.ID)
+	if !owner && collection.Status != models.Published {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return fmt.Errorf("collection is not published and user does not have access to it")
+	}
+
+	return nil
+}
@@ -0,0 +1,399 @@
+package controllers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wagnojunior/lenslocked/context"
+	"github.com/wagnojunior/lenslocked/errors"
+	"github.com/wagnojunior/lenslocked/markdown"
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// commentView defines a comment as it is rendered, with the replies to it
+type commentView struct {
+	ID        int
+	GalleryID int
+	Author    string
+	// AuthorURL is the profile of the author, if they have a public one
+	AuthorURL string
+	Body      template.HTML
+	CreatedAt time.Time
+	// Pending comments are only shown to the owner of the gallery and to
+	// their authors
+	Pending bool
+	// Action is where replies are posted
+	Action    string
+	CanReply  bool
+	CanDelete bool
+	// CanModerate defines whether the current user owns the gallery, and thus
+	// can approve the comment and block its author
+	CanModerate bool
+	Replies     []commentView
+}
+
+// commentThread defines the comments on a gallery or an image as they are
+// rendered by the template `comments`
+type commentThread struct {
+	// Action is where new comments are posted
+	Action   string
+	Comments []commentView
+	// Count is the number of comments shown, replies included
+	Count      int
+	CanComment bool
+	// Moderated defines whether new comments await approval
+	Moderated bool
+}
+
+// ImageComments renders the comments on an image, with the form to post a
+// new one
+func (g Galleries) ImageComments(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	image, err := g.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		GalleryID    int
+		GalleryTitle string
+		Caption      string
+		ImageURL     string
+		ViewURL      string
+		Comments     commentThread
+	}
+	data.GalleryID = gallery.ID
+	data.GalleryTitle = gallery.Title
+	data.Caption = image.Caption
+	data.ImageURL = fmt.Sprintf("%s?size=medium&v=%s", imageURL(gallery.ID, image.Filename),
+		imageVersion(g.GalleryService, gallery.ID, image.Filename))
+	data.ViewURL = imageURL(gallery.ID, image.Filename) + "/view"
+	data.Comments, err = g.commentThread(r, gallery, image.Filename)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	g.Templates.Comments.Execute(w, r, data)
+}
+
+// CreateComment handles the HTTP POST request to comment on a gallery, or on
+// one of its images if the URL gives a filename. The form value `body` holds
+// the comment and `parent_id`, if set, the comment it replies to. The owner of
+// the gallery is notified by email of the comments of other users
+func (g Galleries) CreateComment(w http.ResponseWriter, r *http.Request) {
+	var filename string
+	if chi.URLParam(r, "filename") != "" {
+		filename = g.filename(w, r)
+	}
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible, commentsMustBeOpen)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	comment, err := g.CommentService.Create(gallery, filename, user.ID, parentID, r.FormValue("body"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidComment):
+			http.Error(w, fmt.Sprintf("comments can not be empty or longer than %d characters",
+				models.MaxCommentLength), http.StatusBadRequest)
+		case errors.Is(err, models.ErrCommenterBlocked):
+			http.Error(w, "you can not comment on this gallery", http.StatusForbidden)
+		case errors.Is(err, models.ErrCommentRateLimited):
+			http.Error(w, "you are commenting too fast, please try again later", http.StatusTooManyRequests)
+		case errors.Is(err, models.ErrImageNotFound):
+			http.Error(w, "image not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrCommentNotFound):
+			http.Error(w, "comment not found", http.StatusNotFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	threadPath := commentsPath(gallery.ID, filename)
+	if user.ID != gallery.UserID {
+		g.notifyComment(gallery, user, comment, threadPath)
+	}
+
+	redirectToComment(w, r, threadPath, comment.ID)
+}
+
+// ApproveComment handles the HTTP POST request to show a pending comment to
+// other users
+func (g Galleries) ApproveComment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	comment, err := g.commentByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	err = g.CommentService.Approve(comment.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	redirectToComment(w, r, fmt.Sprintf("/galleries/%d", gallery.ID), comment.ID)
+}
+
+// DeleteComment handles the HTTP POST request to delete a comment and the
+// replies to it. Comments can be deleted by their authors and by the owner of
+// the gallery
+func (g Galleries) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	comment, err := g.commentByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if user.ID != gallery.UserID && user.ID != comment.Author.ID {
+		http.Error(w, "you are not authorized to delete this comment", http.StatusForbidden)
+		return
+	}
+
+	err = g.CommentService.Delete(comment.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	redirectBack(w, r, fmt.Sprintf("/galleries/%d", gallery.ID))
+}
+
+// BlockCommenter handles the HTTP POST request to delete a comment and to
+// block its author from commenting on the galleries of the current user
+func (g Galleries) BlockCommenter(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	comment, err := g.commentByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	if comment.Author.ID == gallery.UserID {
+		http.Error(w, "you can not block yourself", http.StatusBadRequest)
+		return
+	}
+
+	err = g.CommentService.Block(gallery.UserID, comment.Author.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = g.CommentService.Delete(comment.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	redirectBack(w, r, fmt.Sprintf("/galleries/%d", gallery.ID))
+}
+
+// SetCommentModeration handles whether the comments of other users on a
+// gallery await approval, given in the form value `moderation`
+func (g Galleries) SetCommentModeration(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.SetCommentModeration(gallery, r.FormValue("moderation") == "true")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// HELPER FUNCTIONS
+// /////////////////////////////////////////////////////////////////////////////
+
+// commentThread returns the comments on the given gallery, or on its image
+// with the given filename if it is not empty, that the current user can see,
+// with the replies nested inside the comments they reply to
+func (g Galleries) commentThread(r *http.Request, gallery *models.Gallery, filename string) (commentThread, error) {
+	thread := commentThread{
+		Action:    commentsPath(gallery.ID, filename),
+		Moderated: gallery.CommentModeration,
+	}
+
+	user := context.User(r.Context())
+	owner := user != nil && user.ID == gallery.UserID
+	thread.CanComment = user != nil && gallery.Status == models.Published
+
+	comments, err := g.CommentService.Thread(gallery.ID, filename)
+	if err != nil {
+		return commentThread{}, err
+	}
+
+	replies := make(map[int][]models.Comment)
+	for _, comment := range comments {
+		replies[comment.ParentID] = append(replies[comment.ParentID], comment)
+	}
+
+	// The replies to a hidden comment are hidden along with it
+	var nest func(parentID int) []commentView
+	nest = func(parentID int) []commentView {
+		var views []commentView
+		for _, comment := range replies[parentID] {
+			author := user != nil && user.ID == comment.Author.ID
+			pending := comment.Status == models.CommentPending
+			if pending && !owner && !author {
+				continue
+			}
+			view := commentView{
+				ID:          comment.ID,
+				GalleryID:   comment.GalleryID,
+				Author:      displayName(comment.Author),
+				Body:        markdown.RenderLite(comment.Body),
+				CreatedAt:   comment.CreatedAt,
+				Pending:     pending,
+				Action:      thread.Action,
+				CanReply:    thread.CanComment && !pending,
+				CanDelete:   owner || author,
+				CanModerate: owner && !author,
+				Replies:     nest(comment.ID),
+			}
+			if comment.Author.Username != "" {
+				view.AuthorURL = "/u/" + url.PathEscape(comment.Author.Username)
+			}
+			thread.Count++
+			views = append(views, view)
+		}
+		return views
+	}
+	thread.Comments = nest(0)
+
+	return thread, nil
+}
+
+// commentByID is a helper method that gets the comment given by the URL
+// parameter `commentID`. It responds with an error if there is no such
+// comment on the given gallery
+func (g Galleries) commentByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Comment, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "commentID"))
+	if err != nil {
+		http.Error(w, "invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	comment, err := g.CommentService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrCommentNotFound) {
+			http.Error(w, "comment not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	if comment.GalleryID != gallery.ID {
+		http.Error(w, "comment not found", http.StatusNotFound)
+		return nil, fmt.Errorf("comment %d is not on gallery %d", comment.ID, gallery.ID)
+	}
+
+	return comment, nil
+}
+
+// notifyComment sends the owner of the given gallery an email about the given
+// comment. The email is sent in the background, so that a slow mail server
+// does not delay the response, and failures are only logged
+func (g Galleries) notifyComment(gallery *models.Gallery, author *models.User, comment *models.Comment, threadPath string) {
+	owner, err := g.UserService.ByID(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	commentURL := fmt.Sprintf("%s%s#comment-%d", siteURL, threadPath, comment.ID)
+	pending := comment.Status == models.CommentPending
+	go func() {
+		err := g.EmailService.CommentNotification(owner.Email, displayName(*author),
+			gallery.Title, comment.Body, commentURL, pending)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
+
+// commentsPath returns the path of the page that shows the comments on the
+// given gallery, or on its image with the given filename if it is not empty
+func commentsPath(galleryID int, filename string) string {
+	if filename == "" {
+		return fmt.Sprintf("/galleries/%d", galleryID)
+	}
+
+	return imageURL(galleryID, filename) + "/comments"
+}
+
+// redirectToComment redirects the user to the given comment on the page they
+// came from, or on the page at the given path if the browser did not send it
+func redirectToComment(w http.ResponseWriter, r *http.Request, path string, commentID int) {
+	target := r.Header.Get("Referer")
+	if target == "" {
+		target = path
+	}
+	target, _, _ = strings.Cut(target, "#")
+	http.Redirect(w, r, fmt.Sprintf("%s#comment-%d", target, commentID), http.StatusFound)
+}
+
+// displayName returns the name under which the given user is shown to others:
+// their display name, their username or, without either, a generic name
+func displayName(user models.User) string {
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	if user.Username != "" {
+		return user.Username
+	}
+
+	return "Anonymous"
+}
+
+// commentsMustBeOpen is a functional option which determines that only
+// published galleries can be commented on
+func commentsMustBeOpen(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if gallery.Status != models.Published {
+		http.Error(w, "comments are closed on unpublished galleries", http.StatusForbidden)
+		return fmt.Errorf("gallery is not published")
+	}
+
+	return nil
+}
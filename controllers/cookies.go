@@ -7,6 +7,11 @@ import (
 
 const (
 	CookieSession = "session"
+	// CookieProofing and CookieProof are suffixed with the ID of the gallery.
+	// The first holds its share link and the second identifies the visitor
+	// who proofs it
+	CookieProofing = "proofing"
+	CookieProof    = "proof"
 )
 
 // newCookie returns a new cookie with with fixed path and http only.
@@ -0,0 +1,484 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wagnojunior/lenslocked/errors"
+	"github.com/wagnojunior/lenslocked/markdown"
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// feedLength is the number of galleries listed by a feed
+const feedLength = 20
+
+// feedFormat defines a new type that wraps the native string type. It
+// represents the format in which a feed is served
+type feedFormat string
+
+// Defines the two feed formats
+const (
+	feedAtom feedFormat = "atom"
+	feedRSS  feedFormat = "rss"
+)
+
+// Feeds serves the Atom and RSS feeds of the published galleries, the most
+// recently updated first
+type Feeds struct {
+	GalleryService   *models.GalleryService
+	TransformService *models.TransformService
+	UserService      *models.UserService
+}
+
+// UserAtom serves the Atom feed of the published galleries of the user whose
+// username is given in the URL
+func (f Feeds) UserAtom(w http.ResponseWriter, r *http.Request) {
+	f.user(w, r, feedAtom)
+}
+
+// UserRSS serves the RSS feed of the published galleries of the user whose
+// username is given in the URL
+func (f Feeds) UserRSS(w http.ResponseWriter, r *http.Request) {
+	f.user(w, r, feedRSS)
+}
+
+// UserAtomByID serves the Atom feed of the published galleries of the user
+// whose ID is given in the URL, which works whether or not they have a public
+// profile
+func (f Feeds) UserAtomByID(w http.ResponseWriter, r *http.Request) {
+	f.userByID(w, r, feedAtom)
+}
+
+// UserRSSByID serves the RSS feed of the published galleries of the user whose
+// ID is given in the URL
+func (f Feeds) UserRSSByID(w http.ResponseWriter, r *http.Request) {
+	f.userByID(w, r, feedRSS)
+}
+
+// Atom serves the Atom feed of the recently published galleries of all users
+func (f Feeds) Atom(w http.ResponseWriter, r *http.Request) {
+	f.global(w, r, feedAtom)
+}
+
+// RSS serves the RSS feed of the recently published galleries of all users
+func (f Feeds) RSS(w http.ResponseWriter, r *http.Request) {
+	f.global(w, r, feedRSS)
+}
+
+// user serves the feed of the user whose username is given in the URL in the
+// given format
+func (f Feeds) user(w http.ResponseWriter, r *http.Request, format feedFormat) {
+	owner, err := f.UserService.ByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidUser) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	profile := "/u/" + url.PathEscape(owner.Username)
+	f.serveUser(w, r, owner, siteURL+profile, siteURL+profile+"/feed."+string(format), format)
+}
+
+// userByID serves the feed of the user whose ID is given in the URL in the
+// given format. The feed follows the public profile of the user if they have
+// one, and the home page otherwise
+func (f Feeds) userByID(w http.ResponseWriter, r *http.Request, format feedFormat) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	owner, err := f.UserService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidUser) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	page := siteURL
+	if owner.Username != "" {
+		page = siteURL + "/u/" + url.PathEscape(owner.Username)
+	}
+	f.serveUser(w, r, owner, page, fmt.Sprintf("%s/users/%d/feed.%s", siteURL, owner.ID, format), format)
+}
+
+// serveUser serves the feed of the given user in the given format, which
+// follows the page at the given URL and is itself at selfURL
+func (f Feeds) serveUser(w http.ResponseWriter, r *http.Request, owner *models.User, pageURL, selfURL string, format feedFormat) {
+	galleries, _, err := f.GalleryService.PublishedByUserID(owner.ID, models.PageOptions{
+		Sort:  models.SortUpdated,
+		Limit: feedLength,
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	data := feed{
+		Title:       "Galleries of " + displayName(*owner),
+		Description: owner.Bio,
+		URL:         pageURL,
+		SelfURL:     selfURL,
+	}
+	for _, gallery := range galleries {
+		entry, err := f.entry(owner, gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.add(entry)
+	}
+
+	serveFeed(w, r, data, format)
+}
+
+// global serves the feed of the recently published galleries of all users in
+// the given format
+func (f Feeds) global(w http.ResponseWriter, r *http.Request, format feedFormat) {
+	galleries, _, err := f.GalleryService.Published(models.PageOptions{
+		Sort:  models.SortUpdated,
+		Limit: feedLength,
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	data := feed{
+		Title:       "Lenslocked",
+		Description: "Recently published galleries",
+		URL:         siteURL,
+		SelfURL:     siteURL + "/feed." + string(format),
+	}
+	owners := make(map[int]*models.User)
+	for _, gallery := range galleries {
+		owner, ok := owners[gallery.UserID]
+		if !ok {
+			owner, err = f.UserService.ByID(gallery.UserID)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "something went wrong", http.StatusInternalServerError)
+				return
+			}
+			owners[gallery.UserID] = owner
+		}
+
+		entry, err := f.entry(owner, gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.add(entry)
+	}
+
+	serveFeed(w, r, data, format)
+}
+
+// entry returns the feed entry of the given gallery, with its cover as
+// enclosure if it has images
+func (f Feeds) entry(owner *models.User, gallery models.Gallery) (feedEntry, error) {
+	path := fmt.Sprintf("/galleries/%d", gallery.ID)
+	entry := feedEntry{
+		// The ID must not change, unlike the URL under the profile
+		ID:      siteURL + path,
+		Title:   gallery.Title,
+		URL:     siteURL + path,
+		Author:  displayName(*owner),
+		Summary: markdown.PlainText(gallery.Description, MetaDescriptionLength),
+		Content: markdown.Render(gallery.Description),
+		Updated: gallery.UpdatedAt,
+	}
+	if owner.Username != "" {
+		entry.URL = siteURL + galleryURL(owner, &gallery)
+	}
+
+	cover, err := f.GalleryService.Cover(gallery.ID)
+	if errors.Is(err, models.ErrImageNotFound) {
+		return entry, nil
+	}
+	if err != nil {
+		return feedEntry{}, fmt.Errorf("feed entry: %w", err)
+	}
+
+	// The largest derived size is served to everyone, unlike the original
+	size := models.ImageSizes[len(models.ImageSizes)-1].Name
+	file, err := f.TransformService.SizePath(cover.GalleryID, cover.Filename, size, gallery.MaxResolution)
+	if err != nil {
+		return feedEntry{}, fmt.Errorf("feed entry: %w", err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return feedEntry{}, fmt.Errorf("feed entry: %w", err)
+	}
+	entry.Enclosure = &feedEnclosure{
+		URL: fmt.Sprintf("%s%s?size=%s&v=%s", siteURL, imageURL(cover.GalleryID, cover.Filename),
+			size, imageVersion(f.GalleryService, cover.GalleryID, cover.Filename)),
+		Type:   mime.TypeByExtension(filepath.Ext(cover.Filename)),
+		Length: info.Size(),
+	}
+	img := fmt.Sprintf(`<p><img src="%s" alt="%s"></p>`,
+		template.HTMLEscapeString(entry.Enclosure.URL), template.HTMLEscapeString(cover.Caption))
+	entry.Content = template.HTML(img) + entry.Content
+
+	return entry, nil
+}
+
+// HELPER FUNCTIONS
+// /////////////////////////////////////////////////////////////////////////////
+
+// feed defines a feed regardless of its format
+type feed struct {
+	Title       string
+	Description string
+	// URL is the page the feed follows, and SelfURL the feed itself
+	URL     string
+	SelfURL string
+	// Updated is the time of the most recent update of an entry, or zero if
+	// the feed has no entries
+	Updated time.Time
+	Entries []feedEntry
+}
+
+// feedEntry defines an entry of a feed, which is a gallery
+type feedEntry struct {
+	ID        string
+	Title     string
+	URL       string
+	Author    string
+	Summary   string
+	Content   template.HTML
+	Updated   time.Time
+	Enclosure *feedEnclosure
+}
+
+// feedEnclosure defines the cover image of an entry
+type feedEnclosure struct {
+	URL    string
+	Type   string
+	Length int64
+}
+
+// add appends the given entry to the feed, and keeps the update time of the
+// feed the most recent one
+func (f *feed) add(entry feedEntry) {
+	f.Entries = append(f.Entries, entry)
+	if entry.Updated.After(f.Updated) {
+		f.Updated = entry.Updated
+	}
+}
+
+// serveFeed writes the given feed in the given format. Conditional requests
+// are answered with the update time of the feed and an ETag from its contents
+func serveFeed(w http.ResponseWriter, r *http.Request, data feed, format feedFormat) {
+	var doc interface{}
+	contentType := "application/atom+xml; charset=utf-8"
+	if format == feedRSS {
+		doc = data.rss()
+		contentType = "application/rss+xml; charset=utf-8"
+	} else {
+		doc = data.atom()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err := enc.Encode(doc)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+base64.RawURLEncoding.EncodeToString(hash[:16])+`"`)
+	w.Header().Set("Cache-Control", "public, no-cache")
+
+	// http.ServeContent answers conditional requests. The update time is
+	// ignored if it is zero
+	http.ServeContent(w, r, "", data.Updated, bytes.NewReader(buf.Bytes()))
+}
+
+// atomFeed, atomEntry and their elements define an Atom document, as
+// specified by RFC 4287
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Summary string      `xml:"summary,omitempty"`
+	Content atomContent `xml:"content"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// atom returns the feed as an Atom document
+func (f feed) atom() atomFeed {
+	// Atom requires an update time, even for feeds without entries. It must
+	// not change between requests, so that the ETag matches
+	updated := f.Updated
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+	doc := atomFeed{
+		Title:    f.Title,
+		Subtitle: f.Description,
+		ID:       f.SelfURL,
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: f.SelfURL},
+			{Rel: "alternate", Type: "text/html", Href: f.URL},
+		},
+	}
+	for _, entry := range f.Entries {
+		item := atomEntry{
+			Title:   entry.Title,
+			ID:      entry.ID,
+			Updated: entry.Updated.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: entry.Author},
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: entry.URL},
+			},
+			Summary: entry.Summary,
+			Content: atomContent{Type: "html", Body: string(entry.Content)},
+		}
+		if entry.Enclosure != nil {
+			item.Links = append(item.Links, atomLink{
+				Rel:    "enclosure",
+				Type:   entry.Enclosure.Type,
+				Href:   entry.Enclosure.URL,
+				Length: entry.Enclosure.Length,
+			})
+		}
+		doc.Entries = append(doc.Entries, item)
+	}
+
+	return doc
+}
+
+// rssFeed, rssItem and their elements define an RSS 2.0 document
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// rss returns the feed as an RSS 2.0 document
+func (f feed) rss() rssFeed {
+	doc := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.URL,
+			Description: f.Description,
+			Self:        atomLink{Rel: "self", Type: "application/rss+xml", Href: f.SelfURL},
+		},
+	}
+	// RSS requires a description, even if the user wrote no bio
+	if doc.Channel.Description == "" {
+		doc.Channel.Description = f.Title
+	}
+	if !f.Updated.IsZero() {
+		doc.Channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, entry := range f.Entries {
+		item := rssItem{
+			Title:       entry.Title,
+			Link:        entry.URL,
+			Description: string(entry.Content),
+			GUID:        rssGUID{Value: entry.ID},
+			PubDate:     entry.Updated.UTC().Format(time.RFC1123Z),
+		}
+		if entry.Enclosure != nil {
+			item.Enclosure = &rssEnclosure{
+				URL:    entry.Enclosure.URL,
+				Length: entry.Enclosure.Length,
+				Type:   entry.Enclosure.Type,
+			}
+		}
+		doc.Channel.Items = append(doc.Channel.Items, item)
+	}
+
+	return doc
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeEmptyFeedETag(t *testing.T) {
+	data := feed{
+		Title:   "Galleries of someone",
+		URL:     siteURL,
+		SelfURL: siteURL + "/users/1/feed.atom",
+	}
+
+	for _, format := range []feedFormat{feedAtom, feedRSS} {
+		w := httptest.NewRecorder()
+		serveFeed(w, httptest.NewRequest(http.MethodGet, "/feed", nil), data, format)
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s feed has no ETag", format)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+		r.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+		serveFeed(w, r, data, format)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("%s feed status with matching If-None-Match = %d, want %d", format, w.Code, http.StatusNotModified)
+		}
+	}
+}
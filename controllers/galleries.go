@@ -1,28 +1,66 @@
 package controllers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"image"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/wagnojunior/lenslocked/context"
+	"github.com/wagnojunior/lenslocked/markdown"
 	"github.com/wagnojunior/lenslocked/models"
 )
 
+// siteURL is the address where the application is served. It is used to build
+// the absolute URLs of the links that leave it, such as the ones in emails
+const siteURL = "https://lenslocked.wagnojunior.xyz"
+
+// MetaDescriptionLength is the maximum length of the meta descriptions derived
+// from the gallery descriptions
+const MetaDescriptionLength = 160
+
 // Galleries holds the template struct that stores all the templates needed to
 // render different pages. Also, it holds the necessary services
 type Galleries struct {
 	Templates struct {
-		Show  Template
-		New   Template
-		Edit  Template
-		Index Template
+		Show      Template
+		New       Template
+		Edit      Template
+		Index     Template
+		Search    Template
+		Trash     Template
+		View      Template
+		Map       Template
+		Favorites Template
+		Comments  Template
+		Proofing  Template
 	}
-	GalleryService *models.GalleryService
+	GalleryService    *models.GalleryService
+	TagService        *models.TagService
+	SearchService     *models.SearchService
+	CollectionService *models.CollectionService
+	UserService       *models.UserService
+	TransformService  *models.TransformService
+	WatermarkService  *models.WatermarkService
+	FavoriteService   *models.FavoriteService
+	CommentService    *models.CommentService
+	EmailService      *models.EmailService
+	ProofingService   *models.ProofingService
+
+	// MapTileURL is the URL template of the tiles of the maps, such as
+	// `https://tile.example.com/{z}/{x}/{y}.png`, and MapAttribution credits
+	// their provider. Without tiles, maps are shown as lists of coordinates
+	MapTileURL     string
+	MapAttribution string
 }
 
 // New executes the template `New` that is stored in `g.Template`
@@ -67,21 +105,132 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	type Version struct {
+		Number    int
+		Kind      string
+		Size      string
+		CreatedAt time.Time
+		Current   bool
+	}
 	type Image struct {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Caption         string
+		Tags            string
+		Versions        []Version
+		// Version fingerprints the URLs of the image
+		Version string
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Status models.PublicationStatus
-		Images []Image
+		ID          int
+		Title       string
+		Description string
+		Status      models.PublicationStatus
+		Tags        string
+		Images      []Image
+		Page        *models.Page
+		// Collection settings
+		CollectionID      int
+		InheritVisibility bool
+		Collections       []selectOption
+		// Watermark defines whether the images are watermarked
+		Watermark bool
+		// Download settings and license
+		AllowDownload bool
+		MaxResolution int
+		License       string
+		Licenses      []models.License
+		// PublicLocation defines whether the map is shown to other users
+		PublicLocation bool
+		// CommentModeration defines whether comments await approval
+		CommentModeration bool
+		// Proofing settings, the share link and the submitted proofs
+		Proofing      bool
+		ProofingLimit int
+		ProofingURL   string
+		Submissions   []proofSubmission
+		// Galleries to which images can be moved or copied
+		Targets []selectOption
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
+	data.Description = gallery.Description
 	data.Status = gallery.Status
-	images, err := g.GalleryService.Images(gallery.ID)
+	data.CollectionID = gallery.CollectionID
+	data.InheritVisibility = gallery.InheritVisibility
+	data.Watermark = gallery.Watermark
+	data.AllowDownload = gallery.AllowDownload
+	data.MaxResolution = gallery.MaxResolution
+	data.License = gallery.License
+	data.Licenses = models.Licenses
+	data.PublicLocation = gallery.PublicLocation
+	data.CommentModeration = gallery.CommentModeration
+	data.Proofing = gallery.Proofing
+	data.ProofingLimit = gallery.ProofingLimit
+	if gallery.ProofingToken != "" {
+		data.ProofingURL = proofingURL(gallery)
+	}
+
+	data.Submissions, err = g.proofSubmissions(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	collections, err := g.CollectionService.ByUserID(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, collection := range collections {
+		data.Collections = append(data.Collections, selectOption{
+			ID:    collection.ID,
+			Title: collection.Title,
+		})
+	}
+
+	targets, err := g.GalleryService.Editable(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, target := range targets {
+		if target.ID == gallery.ID {
+			continue
+		}
+		data.Targets = append(data.Targets, selectOption{
+			ID:    target.ID,
+			Title: target.Title,
+		})
+	}
+
+	images, page, err := g.GalleryService.Images(gallery.ID, pageOptions(r))
+	if err != nil {
+		listingError(w, err)
+		return
+	}
+	data.Page = page
+
+	tags, err := g.TagService.ByGalleryID(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Tags = joinTags(tags)
+
+	imageTags, err := g.TagService.ByGalleryImages(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	imageVersions, err := g.GalleryService.VersionsByGallery(gallery.ID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
@@ -89,10 +238,25 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, image := range images {
+		// The versions are ordered newest first, so the first is current
+		var versions []Version
+		for i, version := range imageVersions[image.Filename] {
+			versions = append(versions, Version{
+				Number:    version.Number,
+				Kind:      version.Kind,
+				Size:      byteSize(version.Size),
+				CreatedAt: version.CreatedAt,
+				Current:   i == 0,
+			})
+		}
 		data.Images = append(data.Images, Image{
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			Caption:         image.Caption,
+			Tags:            joinTags(imageTags[image.Filename]),
+			Versions:        versions,
+			Version:         imageVersion(g.GalleryService, image.GalleryID, image.Filename),
 		})
 	}
 
@@ -107,26 +271,99 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retreives the new gallery name from the form
+	// Retreives the new gallery name and description from the form
 	gallery.Title = r.FormValue("title")
+	gallery.Description = r.FormValue("description")
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "could not update the gallery", http.StatusInternalServerError)
 		return
 	}
 
+	// Retrieves the comma-separated tags from the form
+	err = g.TagService.SetForGallery(gallery.ID, models.ParseTags(r.FormValue("tags")))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "could not update the gallery tags", http.StatusInternalServerError)
+		return
+	}
+
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 
 }
 
-// Show shows the images in a gallery
+// PreviewDescription renders the Markdown given in the form value
+// `description` as an HTML fragment. It is used by the live preview of the edit
+// page
+func (g Galleries) PreviewDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, markdown.Render(r.FormValue("description")))
+}
+
+// Show shows the images in a gallery. Galleries of users who have a public
+// profile are redirected to their address under the profile
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
 	if err != nil {
 		return
 	}
 
+	owner, err := g.UserService.ByID(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if owner.Username != "" {
+		// The redirect is temporary because the username and the slug can
+		// change, while the ID of the gallery can not
+		target := url.URL{
+			Path:     galleryURL(owner, gallery),
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusFound)
+		return
+	}
+
+	g.show(w, r, gallery)
+}
+
+// ShowBySlug shows the images in the gallery given by the username of its
+// owner and its slug
+func (g Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	owner, err := g.UserService.ByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidUser) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	gallery, err := g.GalleryService.BySlug(owner.ID, chi.URLParam(r, "slug"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidGallery) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	err = galleryMustBeVisible(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	g.show(w, r, gallery)
+}
+
+// show renders the `Show` template of the given gallery
+func (g Galleries) show(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
 	// Creates a custom type Image to help construct the URL. This information
 	// will be sent to the front-end, so it is a good idea to send only the
 	// strictly necessary information. That is why the Image object is
@@ -135,178 +372,1380 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Caption         string
+		// SrcSet lists transformed versions of the image in several widths,
+		// so that browsers download the smallest one that fits
+		SrcSet string
+		// Version fingerprints the URLs of the image
+		Version string
+		// Dimensions and placeholder that reserve the space of the image
+		// while it loads, so that the layout does not shift
+		Width       int
+		Height      int
+		Placeholder template.CSS
+		Favorites   models.Favorites
+		// CommentCount is the number of approved comments on the image
+		CommentCount int
+		CommentsURL  string
+	}
+	type Crumb struct {
+		ID    int
+		Title string
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID          int
+		Title       string
+		Description template.HTML
+		// Meta describes the gallery to search engines and link previews
+		Meta        pageMeta
+		Breadcrumbs []Crumb
+		Tags        []string
+		Images      []Image
+		Page        *models.Page
+		// License of the gallery, if any, and its copyright holder
+		License models.License
+		Holder  string
+		// CanDownload defines whether the current user can download the
+		// originals
+		CanDownload bool
+		// SlideshowURL starts the slideshow from the first image
+		SlideshowURL string
+		// ShowMap defines whether the current user can see the map
+		ShowMap bool
+		// Favorites of the gallery. The counts of the images are shown
+		// next to them
+		Favorites models.Favorites
+		// Comments on the gallery itself. The comments on the images are
+		// shown on pages of their own
+		Comments commentThread
+		// ProofingURL is the proofing page, if the gallery is in proofing
+		// mode
+		ProofingURL string
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
-	images, err := g.GalleryService.Images(gallery.ID)
+	data.Description = markdown.Render(gallery.Description)
+
+	galleryOwner, err := g.UserService.ByID(gallery.UserID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
-
-	for _, image := range images {
-		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
-		})
+	data.Meta, err = g.galleryMeta(gallery, galleryOwner)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
 	}
 
-	g.Templates.Show.Execute(w, r, data)
+	user := context.User(r.Context())
+	owner := user != nil && user.ID == gallery.UserID
+	data.CanDownload = owner || gallery.AllowDownload
+	data.ShowMap = owner || gallery.PublicLocation
+	if gallery.Proofing {
+		data.ProofingURL = proofingPath(gallery.ID)
+	}
+	license, ok := models.LicenseByID(gallery.License)
+	if ok {
+		holder, err := g.holder(gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.License = license
+		data.Holder = holder
+	}
 
-}
+	// The collections that contain the gallery are shown as breadcrumbs
+	if gallery.CollectionID != 0 {
+		ancestors, err := g.CollectionService.Ancestors(gallery.CollectionID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		for _, ancestor := range breadcrumbs(ancestors, !owner) {
+			data.Breadcrumbs = append(data.Breadcrumbs, Crumb{
+				ID:    ancestor.ID,
+				Title: ancestor.Title,
+			})
+		}
+	}
 
-// Publish handles the change of status of a gallery from unpublished to
-// published
-func (g Galleries) Publish(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	images, page, err := g.GalleryService.Images(gallery.ID, pageOptions(r))
 	if err != nil {
+		listingError(w, err)
 		return
 	}
+	data.Page = page
 
-	err = g.GalleryService.Publish(gallery)
-	if err != nil {
-		http.Error(w, "could not publish the gallery", http.StatusInternalServerError)
+	cover, err := g.GalleryService.Cover(gallery.ID)
+	if err != nil && !errors.Is(err, models.ErrImageNotFound) {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
+	if cover != nil {
+		data.SlideshowURL = imageURL(cover.GalleryID, cover.Filename) + "/view?play=1"
+	}
 
-	// Redirect the user to the page them came from (refresh page)
-	editPath := r.Header.Get("Referer")
-	http.Redirect(w, r, editPath, http.StatusFound)
-}
-
-// Unpublish handles the change of status of a gallery from published to
-// unpublished
-func (g Galleries) Unpublish(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	// Visitors are counted as the user with ID zero, who favorited nothing
+	var userID int
+	if user != nil {
+		userID = user.ID
+	}
+	data.Favorites, err = g.FavoriteService.Gallery(gallery.ID, userID)
 	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
-
-	err = g.GalleryService.Unpublish(gallery)
+	favorites, err := g.FavoriteService.Images(gallery.ID, userID)
 	if err != nil {
-		http.Error(w, "could not unpublish the gallery", http.StatusInternalServerError)
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	// Redirect the user to the page them came from (refresh page)
-	editPath := r.Header.Get("Referer")
-	http.Redirect(w, r, editPath, http.StatusFound)
-}
-
-// Delete deletes a gallery
-func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	data.Comments, err = g.commentThread(r, gallery, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	commentCounts, err := g.CommentService.ImageCounts(gallery.ID)
 	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	err = g.GalleryService.Delete(gallery.ID)
+	tags, err := g.TagService.ByGalleryID(gallery.ID)
 	if err != nil {
+		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
+	for _, tag := range tags {
+		data.Tags = append(data.Tags, tag.Name)
+	}
 
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			GalleryID:       image.GalleryID,
+			Filename:        image.Filename,
+			FilenameEscaped: url.PathEscape(image.Filename),
+			Caption:         image.Caption,
+			SrcSet:          g.srcSet(image),
+			Version:         imageVersion(g.GalleryService, image.GalleryID, image.Filename),
+			Width:           image.Width,
+			Height:          image.Height,
+			Placeholder:     placeholderStyle(image),
+			Favorites:       favorites[image.Filename],
+			CommentCount:    commentCounts[image.Filename],
+			CommentsURL:     commentsPath(image.GalleryID, image.Filename),
+		})
+	}
+
+	g.Templates.Show.Execute(w, r, data)
 
 }
 
-// Index looks up all of a user's galleries and sends this information to be
-// rendered in a template
-func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
-	type Gallery struct {
-		ID     int
-		Title  string
-		Status models.PublicationStatus
+// slideshowIntervals are the intervals between the images of a slideshow that
+// can be chosen, in seconds
+var slideshowIntervals = []int{2, 3, 5, 10, 20, 30, 60}
+
+// stdSlideshowInterval is the interval of a slideshow if none is chosen
+const stdSlideshowInterval = 5
+
+// View renders a single image of a gallery in the lightbox, with links to the
+// previous and next images so that every image has a permalink that can be
+// shared. The page also holds the ordered images of the gallery, so that the
+// lightbox and the slideshow move between them without reloading. The query
+// parameter `play` starts the slideshow, and `interval` sets its interval in
+// seconds
+func (g Galleries) View(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
 	}
 
-	var data struct {
-		Galleries []Gallery
+	images, err := g.GalleryService.OrderedImages(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	current := -1
+	for i, image := range images {
+		if image.Filename == filename {
+			current = i
+		}
+	}
+	if current < 0 {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
 	}
 
+	// Slide holds what the lightbox needs to show an image. The fields are
+	// lower case in JSON, since they are read by the script of the page
+	type Slide struct {
+		URL         string       `json:"url"`
+		Src         string       `json:"src"`
+		SrcSet      string       `json:"srcset"`
+		Caption     string       `json:"caption"`
+		Width       int          `json:"width"`
+		Height      int          `json:"height"`
+		Placeholder template.CSS `json:"placeholder"`
+		Original    string       `json:"original"`
+		// CommentsURL is the page of the comments on the image
+		CommentsURL  string `json:"commentsUrl"`
+		CommentCount int    `json:"commentCount"`
+	}
+	var data struct {
+		GalleryID    int
+		GalleryTitle string
+		Slide        Slide
+		// Position of the image, from one, and number of images
+		Index int
+		Total int
+		// PreviousURL and NextURL are empty for the first and last images
+		PreviousURL string
+		NextURL     string
+		Slides      []Slide
+		Current     int
+		Play        bool
+		Interval    int
+		Intervals   []int
+		CanDownload bool
+	}
+	data.GalleryID = gallery.ID
+	data.GalleryTitle = gallery.Title
+	data.Index = current + 1
+	data.Total = len(images)
+	data.Current = current
+	data.Play = r.FormValue("play") != ""
+	data.Interval = stdSlideshowInterval
+	data.Intervals = slideshowIntervals
+	interval, _ := strconv.Atoi(r.FormValue("interval"))
+	for _, seconds := range slideshowIntervals {
+		if seconds == interval {
+			data.Interval = interval
+		}
+	}
 	user := context.User(r.Context())
-	galleries, err := g.GalleryService.ByUserID(user.ID)
+	data.CanDownload = gallery.AllowDownload || (user != nil && user.ID == gallery.UserID)
+
+	commentCounts, err := g.CommentService.ImageCounts(gallery.ID)
 	if err != nil {
+		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	// Needs to translate the gallery which is stored in the DB to the
-	// Gallery type created in this handler
-	for _, gallery := range galleries {
-		data.Galleries = append(data.Galleries, Gallery{
-			ID:     gallery.ID,
-			Title:  gallery.Title,
-			Status: gallery.Status,
-		})
+	for _, image := range images {
+		version := imageVersion(g.GalleryService, image.GalleryID, image.Filename)
+		slide := Slide{
+			URL:          imageURL(image.GalleryID, image.Filename) + "/view",
+			Src:          fmt.Sprintf("%s?size=medium&v=%s", imageURL(image.GalleryID, image.Filename), version),
+			SrcSet:       g.srcSet(image),
+			Caption:      image.Caption,
+			Width:        image.Width,
+			Height:       image.Height,
+			Placeholder:  placeholderStyle(image),
+			CommentsURL:  commentsPath(image.GalleryID, image.Filename),
+			CommentCount: commentCounts[image.Filename],
+		}
+		if data.CanDownload {
+			slide.Original = imageURL(image.GalleryID, image.Filename) + "/original"
+		}
+		data.Slides = append(data.Slides, slide)
+	}
+	data.Slide = data.Slides[current]
+	if current > 0 {
+		data.PreviousURL = data.Slides[current-1].URL
+	}
+	if current < len(images)-1 {
+		data.NextURL = data.Slides[current+1].URL
 	}
 
-	g.Templates.Index.Execute(w, r, data)
-
+	g.Templates.View.Execute(w, r, data)
 }
 
-// Image handles HTTP requests to show an image.
-func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
-	filename := g.filename(w, r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+// Map renders the map of the geotagged images of a gallery. The images are
+// listed with their coordinates as well, which is all that is shown if no tiles
+// are configured. Other users than the owner can only see the map if the
+// gallery makes the locations public
+func (g Galleries) Map(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible, locationMustBeVisible)
 	if err != nil {
-		http.Error(w, "invalid gallery ID", http.StatusNotFound)
 		return
 	}
 
-	image, err := g.GalleryService.Image(galleryID, filename)
+	locations, err := g.GalleryService.Locations(gallery.ID)
 	if err != nil {
-		if errors.Is(err, models.ErrImageNotFound) {
-			http.Error(w, "image not found", http.StatusNotFound)
-			return
-		}
 		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	http.ServeFile(w, r, image.Path)
+	type Point struct {
+		Caption      string
+		Latitude     float64
+		Longitude    float64
+		ViewURL      string
+		ThumbnailURL string
+	}
+	var data struct {
+		ID          int
+		Title       string
+		TileURL     string
+		Attribution string
+		Points      []Point
+	}
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.TileURL = g.MapTileURL
+	data.Attribution = g.MapAttribution
+	for _, location := range locations {
+		data.Points = append(data.Points, Point{
+			Caption:      location.Caption,
+			Latitude:     location.Latitude,
+			Longitude:    location.Longitude,
+			ViewURL:      imageURL(location.GalleryID, location.Filename) + "/view",
+			ThumbnailURL: thumbnailURL(g.GalleryService, location.GalleryID, location.Filename),
+		})
+	}
+
+	g.Templates.Map.Execute(w, r, data)
 }
 
-// DeleteImage handles the HTTP request to delete an image
-func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
-	// Verifies that the user actually owns the gallery
-	filename := g.filename(w, r)
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+// GeoJSON responds with the geotagged images of a gallery as a GeoJSON feature
+// collection of points. The same visibility rules as Map apply
+func (g Galleries) GeoJSON(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible, locationMustBeVisible)
 	if err != nil {
 		return
 	}
 
-	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	locations, err := g.GalleryService.Locations(gallery.ID)
 	if err != nil {
+		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	// Redirects the user to the edit page
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
-	http.Redirect(w, r, editPath, http.StatusFound)
+	type Geometry struct {
+		Type string `json:"type"`
+		// Coordinates are the longitude and the latitude, in this order
+		Coordinates [2]float64 `json:"coordinates"`
+	}
+	type Properties struct {
+		Filename  string `json:"filename"`
+		Caption   string `json:"caption"`
+		URL       string `json:"url"`
+		Thumbnail string `json:"thumbnail"`
+	}
+	type Feature struct {
+		Type       string     `json:"type"`
+		Geometry   Geometry   `json:"geometry"`
+		Properties Properties `json:"properties"`
+	}
+	collection := struct {
+		Type     string    `json:"type"`
+		Features []Feature `json:"features"`
+	}{
+		Type:     "FeatureCollection",
+		Features: []Feature{},
+	}
+	for _, location := range locations {
+		collection.Features = append(collection.Features, Feature{
+			Type: "Feature",
+			Geometry: Geometry{
+				Type:        "Point",
+				Coordinates: [2]float64{location.Longitude, location.Latitude},
+			},
+			Properties: Properties{
+				Filename:  location.Filename,
+				Caption:   location.Caption,
+				URL:       imageURL(location.GalleryID, location.Filename) + "/view",
+				Thumbnail: thumbnailURL(g.GalleryService, location.GalleryID, location.Filename),
+			},
+		})
+	}
 
+	w.Header().Set("Content-Type", "application/geo+json")
+	err = json.NewEncoder(w).Encode(collection)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
-// UploadImage handlers the HTTP POST request to upload an image
-func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
-	// Verifies that the user actually owns the gallery
+// SetPublicLocation handles whether other users can see where the images of a
+// gallery were taken, given in the form value `public_location`
+func (g Galleries) SetPublicLocation(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
 		return
 	}
 
-	// Parses the request body as multipart/form-data. The argument is the
-	// maximum memory allocated for this action. The parts of the request body
-	// that do not fit in the allocated memory are stored in disk as temporary
-	// files
+	public := r.FormValue("public_location") == "true"
+	err = g.GalleryService.SetPublicLocation(gallery, public)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "could not update the gallery location", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// FavoriteGallery handles the HTTP POST request to favorite a gallery, or to
+// unfavorite it if the form value `favorite` is `false`. The state is set
+// rather than toggled, so that submitting the form twice does no harm
+func (g Galleries) FavoriteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	favorite := r.FormValue("favorite") != "false"
+	err = g.FavoriteService.SetGallery(user.ID, gallery.ID, favorite)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	redirectBack(w, r, fmt.Sprintf("/galleries/%d", gallery.ID))
+}
+
+// FavoriteImage handles the HTTP POST request to favorite an image, or to
+// unfavorite it, in the same way as FavoriteGallery
+func (g Galleries) FavoriteImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	favorite := r.FormValue("favorite") != "false"
+	err = g.FavoriteService.SetImage(user.ID, gallery.ID, filename, favorite)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	redirectBack(w, r, fmt.Sprintf("/galleries/%d", gallery.ID))
+}
+
+// Favorites lists the galleries and images favorited by the current user
+func (g Galleries) Favorites(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID       int
+		Title    string
+		CoverURL string
+	}
+	type Image struct {
+		GalleryID       int
+		Filename        string
+		FilenameEscaped string
+		Caption         string
+		ViewURL         string
+		ThumbnailURL    string
+	}
+	var data struct {
+		Galleries []Gallery
+		Images    []Image
+	}
+
+	user := context.User(r.Context())
+	galleries, err := g.FavoriteService.FavoriteGalleries(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		cover, err := g.GalleryService.Cover(gallery.ID)
+		if err != nil && !errors.Is(err, models.ErrImageNotFound) {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		var coverURL string
+		if cover != nil {
+			coverURL = thumbnailURL(g.GalleryService, cover.GalleryID, cover.Filename)
+		}
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:       gallery.ID,
+			Title:    gallery.Title,
+			CoverURL: coverURL,
+		})
+	}
+
+	images, err := g.FavoriteService.FavoriteImages(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			GalleryID:       image.GalleryID,
+			Filename:        image.Filename,
+			FilenameEscaped: url.PathEscape(image.Filename),
+			Caption:         image.Caption,
+			ViewURL:         imageURL(image.GalleryID, image.Filename) + "/view",
+			ThumbnailURL:    thumbnailURL(g.GalleryService, image.GalleryID, image.Filename),
+		})
+	}
+
+	g.Templates.Favorites.Execute(w, r, data)
+}
+
+// Publish handles the change of status of a gallery from unpublished to
+// published
+func (g Galleries) Publish(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.Publish(gallery)
+	if err != nil {
+		http.Error(w, "could not publish the gallery", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirect the user to the page them came from (refresh page)
+	editPath := r.Header.Get("Referer")
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Unpublish handles the change of status of a gallery from published to
+// unpublished
+func (g Galleries) Unpublish(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.Unpublish(gallery)
+	if err != nil {
+		http.Error(w, "could not unpublish the gallery", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirect the user to the page them came from (refresh page)
+	editPath := r.Header.Get("Referer")
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// SetCollection handles the placement of a gallery inside the collection given
+// in the form value `collection_id`, and whether the gallery inherits the
+// visibility of the collection
+func (g Galleries) SetCollection(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	collectionID, _ := strconv.Atoi(r.FormValue("collection_id"))
+	inherit := r.FormValue("inherit_visibility") == "true"
+	err = g.CollectionService.SetGalleryCollection(gallery, collectionID, inherit)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCollection) {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "could not update the gallery collection", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// SetWatermark handles whether the watermark of the owner is applied to the
+// images of a gallery shown to other users, given in the form value
+// `watermark`. The watermark itself is set in the account settings
+func (g Galleries) SetWatermark(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	enabled := r.FormValue("watermark") == "true"
+	err = g.GalleryService.SetWatermark(gallery, enabled)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "could not update the gallery watermark", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// SetRights handles whether other users can download the originals of a
+// gallery, given in the form value `allow_download`, the maximum resolution of
+// the images served to them, and the license of the gallery
+func (g Galleries) SetRights(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	gallery.AllowDownload = r.FormValue("allow_download") == "true"
+	gallery.MaxResolution, _ = strconv.Atoi(r.FormValue("max_resolution"))
+	gallery.License = r.FormValue("license")
+	err = g.GalleryService.UpdateRights(gallery)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidResolution) {
+			msg := fmt.Sprintf("the maximum resolution must be between %d and %d pixels",
+				models.MinResolution, models.MaxTransformSide)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, models.ErrInvalidLicense) {
+			http.Error(w, "unsupported license", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "could not update the gallery rights", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Duplicate creates a copy of a gallery owned by the current user. The copy is
+// unpublished and includes the images only if the form value `images` is set.
+// Galleries of other users can be duplicated as long as they are visible
+func (g Galleries) Duplicate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	withImages := r.FormValue("images") == "true"
+	duplicate, err := g.GalleryService.Duplicate(gallery, user.ID, withImages)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "could not duplicate the gallery", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", duplicate.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Delete moves a gallery to the trash
+func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.Delete(gallery.ID)
+	if err != nil {
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+
+}
+
+// Trash lists the galleries and images of the current user that are in the
+// trash, with the date on which they are purged
+func (g Galleries) Trash(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID        int
+		Title     string
+		DeletedAt time.Time
+		PurgeAt   time.Time
+	}
+	type Image struct {
+		GalleryID       int
+		Filename        string
+		FilenameEscaped string
+		DeletedAt       time.Time
+		PurgeAt         time.Time
+	}
+	var data struct {
+		Galleries []Gallery
+		Images    []Image
+	}
+
+	user := context.User(r.Context())
+	retention := g.GalleryService.Retention()
+	galleries, err := g.GalleryService.TrashedGalleries(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:        gallery.ID,
+			Title:     gallery.Title,
+			DeletedAt: gallery.DeletedAt,
+			PurgeAt:   gallery.DeletedAt.Add(retention),
+		})
+	}
+
+	images, err := g.GalleryService.TrashedImages(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			GalleryID:       image.GalleryID,
+			Filename:        image.Filename,
+			FilenameEscaped: url.PathEscape(image.Filename),
+			DeletedAt:       image.DeletedAt,
+			PurgeAt:         image.DeletedAt.Add(retention),
+		})
+	}
+
+	g.Templates.Trash.Execute(w, r, data)
+}
+
+// Restore moves a gallery out of the trash
+func (g Galleries) Restore(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.trashedGalleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.Restore(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries/trash", http.StatusFound)
+}
+
+// Purge permanently deletes a gallery in the trash and its images
+func (g Galleries) Purge(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.trashedGalleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.Purge(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries/trash", http.StatusFound)
+}
+
+// Index looks up all of a user's galleries and sends this information to be
+// rendered in a template
+func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID         int
+		Title      string
+		Status     models.PublicationStatus
+		ImageCount int
+	}
+
+	var data struct {
+		Tag       string
+		Tags      []string
+		Sort      string
+		Galleries []Gallery
+		Page      *models.Page
+	}
+
+	// Galleries are optionally filtered by the tag given in the query
+	// parameter `tag`
+	user := context.User(r.Context())
+	opts := pageOptions(r)
+	data.Tag = r.FormValue("tag")
+	data.Sort = string(opts.Sort)
+	if data.Sort == "" {
+		data.Sort = string(models.SortCreated)
+	}
+	var galleries []models.Gallery
+	var page *models.Page
+	var err error
+	if data.Tag == "" {
+		galleries, page, err = g.GalleryService.ByUserID(user.ID, opts)
+	} else {
+		galleries, page, err = g.GalleryService.ByUserIDAndTag(user.ID, data.Tag, opts)
+	}
+	if err != nil {
+		listingError(w, err)
+		return
+	}
+	data.Page = page
+
+	tags, err := g.TagService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, tag := range tags {
+		data.Tags = append(data.Tags, tag.Name)
+	}
+
+	// Needs to translate the gallery which is stored in the DB to the
+	// Gallery type created in this handler
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Status:     gallery.Status,
+			ImageCount: gallery.ImageCount,
+		})
+	}
+
+	g.Templates.Index.Execute(w, r, data)
+
+}
+
+// Search runs a full-text search over galleries, image captions and tags, and
+// renders the ranked results with the matched words highlighted. Signed-in
+// users can restrict the search to their own galleries with the query
+// parameter `scope`
+func (g Galleries) Search(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID          int
+		Title       template.HTML
+		Description template.HTML
+	}
+	type Image struct {
+		GalleryID       int
+		GalleryTitle    string
+		Filename        string
+		FilenameEscaped string
+		Caption         template.HTML
+		Version         string
+	}
+	var data struct {
+		Query     string
+		Scope     models.SearchScope
+		Galleries []Gallery
+		Images    []Image
+	}
+	data.Query = r.FormValue("q")
+	data.Scope = models.SearchScope(r.FormValue("scope"))
+
+	// Users who are not signed in can only search published galleries
+	user := context.User(r.Context())
+	var userID int
+	if user == nil || data.Scope != models.ScopeMine {
+		data.Scope = models.ScopePublic
+	} else {
+		userID = user.ID
+	}
+
+	results, err := g.SearchService.Search(data.Query, data.Scope, userID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	for _, result := range results.Galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:          result.ID,
+			Title:       highlight(result.TitleHighlight),
+			Description: highlight(result.DescriptionHighlight),
+		})
+	}
+	for _, result := range results.Images {
+		data.Images = append(data.Images, Image{
+			GalleryID:       result.GalleryID,
+			GalleryTitle:    result.GalleryTitle,
+			Filename:        result.Filename,
+			FilenameEscaped: url.PathEscape(result.Filename),
+			Caption:         highlight(result.CaptionHighlight),
+			Version:         imageVersion(g.GalleryService, result.GalleryID, result.Filename),
+		})
+	}
+
+	g.Templates.Search.Execute(w, r, data)
+}
+
+// Image handles HTTP requests to show an image. Images of unpublished
+// galleries are only shown to their owners. Browsers that accept a modern
+// format, such as WebP, are served the image converted to it.
+func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	// The query parameter `size` selects one of the derived sizes, such as
+	// `thumb`. The current version is served otherwise
+	var path string
+	size := r.FormValue("size")
+	format := negotiateFormat(r.Header.Get("Accept"))
+
+	// Other users get the largest derived size instead of the full image if
+	// the gallery does not allow downloading the originals
+	user := context.User(r.Context())
+	if size == "" && !gallery.AllowDownload && (user == nil || user.ID != gallery.UserID) {
+		size = models.ImageSizes[len(models.ImageSizes)-1].Name
+	}
+	switch {
+	case format != "":
+		path, err = g.GalleryService.VariantPath(gallery.ID, filename, size, format)
+		if errors.Is(err, models.ErrSizeMissing) {
+			// The variants of a size are converted from it, so the size is
+			// scaled down from the image until it is generated
+			path, err = g.TransformService.SizePath(gallery.ID, filename, size, gallery.MaxResolution)
+		}
+	case size != "":
+		path, err = g.TransformService.SizePath(gallery.ID, filename, size, gallery.MaxResolution)
+	default:
+		var image models.Image
+		image, err = g.GalleryService.Image(gallery.ID, filename)
+		path = image.Path
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, models.ErrInvalidSize) {
+			http.Error(w, "invalid image size", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// Caches must keep a response per Accept header, since it selects the
+	// format
+	w.Header().Add("Vary", "Accept")
+	g.serveImage(w, r, gallery, filename, path)
+}
+
+// Transform handles the HTTP request to transform an image on demand. The URL
+// holds the transformation options, such as `w_800,f_png`, and their signature,
+// so that only the transformations issued by this application are performed.
+// The same visibility rules as Image apply
+func (g Galleries) Transform(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	options := chi.URLParam(r, "options")
+	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid gallery ID", http.StatusNotFound)
+		return
+	}
+	if !g.TransformService.Verify(chi.URLParam(r, "signature"), options, galleryID, filename) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	opts, err := models.ParseTransformOptions(options)
+	if err != nil {
+		http.Error(w, "invalid transformation", http.StatusBadRequest)
+		return
+	}
+
+	path, err := g.TransformService.Transform(gallery.ID, filename, opts)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	g.serveImage(w, r, gallery, filename, path)
+}
+
+// Original handles the HTTP request to download the original of an image, as
+// it was uploaded. Other users than the owner can only download it if the
+// gallery allows it, and get it protected by the other settings of the gallery
+func (g Galleries) Original(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible, downloadMustBeAllowed)
+	if err != nil {
+		return
+	}
+
+	path, err := g.GalleryService.OriginalPath(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	path, _, err = g.protect(r, gallery, path, true)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The original keeps its EXIF metadata, which might hold where it was
+	// taken
+	user := context.User(r.Context())
+	if !gallery.PublicLocation && (user == nil || user.ID != gallery.UserID) {
+		path, err = g.TransformService.StripExif(path)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeFile(w, r, path)
+}
+
+// Version handles the HTTP request to view a version of an image
+func (g Galleries) Version(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	number, err := strconv.Atoi(chi.URLParam(r, "number"))
+	if err != nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+
+	path, err := g.GalleryService.VersionPath(gallery.ID, filename, number)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, models.ErrVersionNotFound) {
+			http.Error(w, "version not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeFile(w, r, path)
+}
+
+// RevertImage handles the HTTP POST request to make a version of an image its
+// current version
+func (g Galleries) RevertImage(w http.ResponseWriter, r *http.Request) {
+	// Verifies that the user actually owns the gallery
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	number, err := strconv.Atoi(chi.URLParam(r, "number"))
+	if err != nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+
+	err = g.GalleryService.RevertImage(gallery.ID, filename, number)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, models.ErrVersionNotFound) {
+			http.Error(w, "version not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "could not revert the image", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirects the user to the edit page
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// EditImage handles the HTTP POST request to edit an image. The form value
+// `op` selects the edit:
+//   - `rotate` rotates the image clockwise by the form value `angle`: 90, 180
+//     or 270 degrees
+//   - `flip` flips the image in the form value `direction`: `horizontal` or
+//     `vertical`
+//   - `crop` keeps the rectangle given by the form values `x`, `y`, `width`
+//     and `height`, in pixels
+func (g Galleries) EditImage(w http.ResponseWriter, r *http.Request) {
+	// Verifies that the user actually owns the gallery
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	var edit models.ImageEdit
+	switch r.FormValue("op") {
+	case "rotate":
+		edit.Rotate, err = strconv.Atoi(r.FormValue("angle"))
+	case "flip":
+		switch r.FormValue("direction") {
+		case "horizontal":
+			edit.FlipHorizontal = true
+		case "vertical":
+			edit.FlipVertical = true
+		default:
+			err = models.ErrInvalidEdit
+		}
+	case "crop":
+		edit.Crop, err = cropRect(r)
+	default:
+		err = models.ErrInvalidEdit
+	}
+	if err != nil {
+		http.Error(w, "invalid image edit", http.StatusBadRequest)
+		return
+	}
+
+	err = g.GalleryService.EditImage(gallery.ID, filename, edit)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, models.ErrInvalidEdit) {
+			http.Error(w, "invalid image edit", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "could not edit the image", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirects the user to the edit page
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// RestoreImage handles the HTTP request to move an image out of the trash
+func (g Galleries) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.RestoreImage(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries/trash", http.StatusFound)
+}
+
+// PurgeImage handles the HTTP request to permanently delete an image in the
+// trash
+func (g Galleries) PurgeImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.PurgeImage(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries/trash", http.StatusFound)
+}
+
+// DeleteImage handles the HTTP request to move an image to the trash
+func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	// Verifies that the user actually owns the gallery
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	if err != nil {
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirects the user to the edit page
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+
+}
+
+// UpdateImage handles the HTTP POST request to update the caption and the tags
+// of an image
+func (g Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	// Verifies that the user actually owns the gallery
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	image, err := g.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	image.Caption = r.FormValue("caption")
+	err = g.GalleryService.UpdateImage(&image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "could not update the image", http.StatusInternalServerError)
+		return
+	}
+
+	err = g.TagService.SetForImage(gallery.ID, filename, models.ParseTags(r.FormValue("tags")))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "could not update the image tags", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirects the user to the edit page
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// TransferImages handles the HTTP POST request to move or copy the images
+// selected in the form value `filenames` to the gallery given in the form value
+// `target_id`. The form value `action` is either `move` or `copy`
+func (g Galleries) TransferImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	filenames := r.PostForm["filenames"]
+	if len(filenames) == 0 {
+		http.Error(w, "no images were selected", http.StatusBadRequest)
+		return
+	}
+
+	// The user must be able to edit the target gallery too
+	targetID, err := strconv.Atoi(r.FormValue("target_id"))
+	if err != nil {
+		http.Error(w, "gallery not found", http.StatusNotFound)
+		return
+	}
+	target, err := g.GalleryService.ByID(targetID)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidGallery) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = userMustOwnGallery(w, r, target)
+	if err != nil {
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "move":
+		_, err = g.GalleryService.MoveImages(gallery.ID, target.ID, filenames)
+	case "copy":
+		_, err = g.GalleryService.CopyImages(gallery.ID, target.ID, filenames)
+	default:
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrImageNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "could not transfer the images", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// UploadImage handlers the HTTP POST request to upload an image
+func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	// Verifies that the user actually owns the gallery
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	// Parses the request body as multipart/form-data. The argument is the
+	// maximum memory allocated for this action. The parts of the request body
+	// that do not fit in the allocated memory are stored in disk as temporary
+	// files
 	err = r.ParseMultipartForm(5 << 20) // 5MB
 	if err != nil {
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
@@ -355,6 +1794,325 @@ func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
 	return filename
 }
 
+// cropRect returns the crop rectangle given by the form values `x`, `y`,
+// `width` and `height`
+func cropRect(r *http.Request) (image.Rectangle, error) {
+	var values [4]int
+	for i, key := range []string{"x", "y", "width", "height"} {
+		value, err := strconv.Atoi(r.FormValue(key))
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		values[i] = value
+	}
+	if values[2] <= 0 || values[3] <= 0 {
+		return image.Rectangle{}, models.ErrInvalidEdit
+	}
+
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// serveImage serves the file at the given path, which is a rendition of the
+// given image, with a strong ETag from its contents. Responses to URLs
+// fingerprinted with the current version of the image, in the query parameter
+// `v`, are cached for a year, since the URL changes whenever the image does.
+// Other responses are revalidated with the ETag. Images of unpublished
+// galleries are only cached by browsers, not by shared caches.
+//
+// Users other than the owner are served the image protected by the settings
+// of the gallery, as done by protect. Since the response then depends on the
+// user, images of such galleries are never kept by shared caches, and
+// protected responses are always revalidated, since the settings might change
+func (g Galleries) serveImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, filename, path string) {
+	scope := "private"
+	if gallery.Status == models.Published && !restricted(gallery) {
+		scope = "public"
+	}
+	policy := "no-cache"
+	version := r.URL.Query().Get("v")
+	if version != "" && version == galleryImageVersion(g.GalleryService, gallery, filename) {
+		policy = "max-age=31536000, immutable"
+	}
+
+	path, protected, err := g.protect(r, gallery, path, false)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if protected {
+		policy = "no-cache"
+	}
+	w.Header().Set("Cache-Control", scope+", "+policy)
+
+	license, ok := models.LicenseByID(gallery.License)
+	if ok && license.URL != "" {
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="license"`, license.URL))
+	}
+
+	// http.ServeFile answers conditional requests with the ETag
+	hash, err := models.Fingerprint(path)
+	if err == nil {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+
+	http.ServeFile(w, r, path)
+}
+
+// protect returns the path of the rendition of the image at the given path
+// that is served to the current user, and whether it differs from the image.
+// Users other than the owner get the image scaled down to the maximum
+// resolution of the gallery, unless full is set, with the watermark of the
+// owner if enabled, and with the license of the gallery in its metadata. The
+// license alone does not make the rendition differ
+func (g Galleries) protect(r *http.Request, gallery *models.Gallery, path string, full bool) (string, bool, error) {
+	user := context.User(r.Context())
+	if user != nil && user.ID == gallery.UserID {
+		return path, false, nil
+	}
+
+	src := path
+	var err error
+	if gallery.MaxResolution > 0 && !full {
+		path, err = g.TransformService.Limit(path, gallery.MaxResolution)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	if gallery.Watermark {
+		wm, err := g.WatermarkService.ByUserID(gallery.UserID)
+		if err != nil {
+			return "", false, err
+		}
+		if !wm.Empty() {
+			path, err = g.TransformService.Watermark(path, wm)
+			if err != nil {
+				return "", false, err
+			}
+		}
+	}
+
+	// The license is embedded for every other user alike, so it does not make
+	// the rendition protected
+	protected := path != src
+	license, ok := models.LicenseByID(gallery.License)
+	if ok {
+		holder, err := g.holder(gallery)
+		if err != nil {
+			return "", false, err
+		}
+		path, err = g.TransformService.EmbedLicense(path, license, holder)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	return path, protected, nil
+}
+
+// restricted returns true if the images of the given gallery are served
+// differently to its owner and to other users. The embedded license does not
+// count, since it is the same for every other user and is part of the image
+// version
+func restricted(gallery *models.Gallery) bool {
+	return gallery.Watermark || !gallery.AllowDownload || gallery.MaxResolution > 0
+}
+
+// holder returns the name of the copyright holder of the given gallery, which
+// is its owner
+func (g Galleries) holder(gallery *models.Gallery) (string, error) {
+	owner, err := g.UserService.ByID(gallery.UserID)
+	if err != nil {
+		return "", err
+	}
+	if owner.DisplayName != "" {
+		return owner.DisplayName, nil
+	}
+
+	return owner.Username, nil
+}
+
+// versionLength is the length of the image versions in fingerprinted URLs
+const versionLength = 16
+
+// imageVersion returns the version of the given image that fingerprints its
+// URLs, or an empty string if it can not be computed, in which case the URLs
+// are not cached for long
+func imageVersion(gs *models.GalleryService, galleryID int, filename string) string {
+	hash, err := gs.ImageVersion(galleryID, filename)
+	if err != nil {
+		return ""
+	}
+
+	return hash[:versionLength]
+}
+
+// galleryImageVersion returns the imageVersion of the given image of the
+// given gallery, whose license is already known
+func galleryImageVersion(gs *models.GalleryService, gallery *models.Gallery, filename string) string {
+	hash, err := gs.GalleryImageVersion(gallery, filename)
+	if err != nil {
+		return ""
+	}
+
+	return hash[:versionLength]
+}
+
+// srcSetWidths are the widths offered to browsers in the srcset of images
+var srcSetWidths = []int{400, 800, 1600}
+
+// srcSet returns the srcset attribute of the given image, which lists signed
+// and fingerprinted URLs of the image transformed to each of the srcSetWidths
+func (g Galleries) srcSet(image models.Image) string {
+	version := imageVersion(g.GalleryService, image.GalleryID, image.Filename)
+	var candidates []string
+	for _, width := range srcSetWidths {
+		url := g.TransformService.URL(image.GalleryID, image.Filename, models.TransformOptions{Width: width})
+		candidates = append(candidates, fmt.Sprintf("%s?v=%s %dw", url, version, width))
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+// negotiateFormat returns the most preferred modern image format that the given
+// Accept header lists explicitly, or an empty string if there is none.
+// Wildcards such as `image/*` are ignored, since browsers send them regardless
+// of the formats they support
+func negotiateFormat(accept string) string {
+	accepted := make(map[string]bool)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		accepted[mediaType] = true
+
+		// A quality of zero means that the type is not acceptable
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil && q == 0 {
+				accepted[mediaType] = false
+			}
+		}
+	}
+
+	for _, format := range models.ModernFormats() {
+		if accepted[format.MediaType] {
+			return format.Name
+		}
+	}
+
+	return ""
+}
+
+// hexColor matches the colors that can be safely written to inline styles
+var hexColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// placeholderStyle returns the inline style that shows the placeholder of the
+// given image, its dominant color and blurhash, while it loads
+func placeholderStyle(image models.Image) template.CSS {
+	var declarations []string
+	if hexColor.MatchString(image.Color) {
+		declarations = append(declarations, "background-color: "+image.Color)
+	}
+
+	uri, err := models.Placeholder(image)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if uri != "" {
+		declarations = append(declarations,
+			fmt.Sprintf(`background-image: url("%s")`, uri),
+			"background-size: cover")
+	}
+
+	return template.CSS(strings.Join(declarations, "; "))
+}
+
+// byteSize formats the given number of bytes for humans, such as 1.5 MB
+func byteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size) / unit
+	prefixes := "KMGT"
+	i := 0
+	for value >= unit && i < len(prefixes)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %cB", value, prefixes[i])
+}
+
+// galleryURL returns the URL of the given gallery under the public profile of
+// its owner, who must have a username
+func galleryURL(owner *models.User, gallery *models.Gallery) string {
+	return fmt.Sprintf("/u/%s/%s", url.PathEscape(owner.Username), url.PathEscape(gallery.Slug))
+}
+
+// redirectBack redirects the user to the page they came from, or to the given
+// path if the browser did not send it
+func redirectBack(w http.ResponseWriter, r *http.Request, fallback string) {
+	target := r.Header.Get("Referer")
+	if target == "" {
+		target = fallback
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// pageOptions returns the pagination options given in the query parameters
+// `sort`, `cursor` and `limit`
+func pageOptions(r *http.Request) models.PageOptions {
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+
+	return models.PageOptions{
+		Sort:   models.SortOrder(r.FormValue("sort")),
+		Cursor: r.FormValue("cursor"),
+		Limit:  limit,
+	}
+}
+
+// listingError responds to a failed listing. Invalid pagination options are
+// reported as bad requests
+func listingError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrInvalidCursor) || errors.Is(err, models.ErrInvalidSort) {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, "something went wrong", http.StatusInternalServerError)
+}
+
+// highlight escapes the given search result field and wraps the words matched
+// by the search, delimited by models.HighlightStart and models.HighlightStop,
+// in <mark> elements. The result is safe to be rendered as HTML
+func highlight(field string) template.HTML {
+	escaped := template.HTMLEscapeString(field)
+	replacer := strings.NewReplacer(
+		models.HighlightStart, "<mark>",
+		models.HighlightStop, "</mark>",
+	)
+
+	return template.HTML(replacer.Replace(escaped))
+}
+
+// joinTags returns the names of the given tags as a comma-separated list, as
+// expected by the tag inputs of the HTML forms
+func joinTags(tags []models.Tag) string {
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
 // /////////////////////////////////////////////////////////////////////////////
 // FUNCTIONAL OPTIONS
 // /////////////////////////////////////////////////////////////////////////////
@@ -366,6 +2124,17 @@ type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
 // galleryByID is a helper method that gets a gallery by ID and returns it. It
 // receives a functional options, which are set the the caller of galleryByID
 func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	return g.findGallery(w, r, g.GalleryService.ByID, opts...)
+}
+
+// trashedGalleryByID works like galleryByID, but for galleries in the trash
+func (g Galleries) trashedGalleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	return g.findGallery(w, r, g.GalleryService.TrashedByID, opts...)
+}
+
+// findGallery gets the gallery whose ID is given in the URL with the given
+// lookup function, and applies the given functional options
+func (g Galleries) findGallery(w http.ResponseWriter, r *http.Request, lookup func(int) (*models.Gallery, error), opts ...galleryOpt) (*models.Gallery, error) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "invalid ID", http.StatusNotFound)
@@ -373,7 +2142,7 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	}
 
 	// Gets the gallery by the provided ID
-	gallery, err := g.GalleryService.ByID(id)
+	gallery, err := lookup(id)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidGallery) {
 			http.Error(w, "gallery not found", http.StatusNotFound)
@@ -395,6 +2164,32 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	return gallery, nil
 }
 
+// downloadMustBeAllowed is a functional option which determines that the
+// originals of a gallery can only be downloaded by its owner, unless the
+// gallery allows it
+func downloadMustBeAllowed(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	user := context.User(r.Context())
+	if !gallery.AllowDownload && (user == nil || user.ID != gallery.UserID) {
+		http.Error(w, "download not allowed", http.StatusForbidden)
+		return fmt.Errorf("downloading the originals of this gallery is not allowed")
+	}
+
+	return nil
+}
+
+// locationMustBeVisible is a functional option which determines that only the
+// owner of a gallery can see where its images were taken, unless the gallery
+// makes the locations public
+func locationMustBeVisible(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	user := context.User(r.Context())
+	if !gallery.PublicLocation && (user == nil || user.ID != gallery.UserID) {
+		http.Error(w, "map not found", http.StatusNotFound)
+		return fmt.Errorf("the locations of this gallery are not public")
+	}
+
+	return nil
+}
+
 // userMustOwnGallery is a functional option which determines that a user must
 // own a gallery
 func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
@@ -411,7 +2206,8 @@ func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.
 
 // galleryMustBeVisible checks if a user has acccess to the given gallery. If a
 // user does not own a gallery and it is set to UNPUBLISHED, then access to the
-// gallery is denied. Otherwise, access is granted
+// gallery is denied, unless the request holds its share link while it is in
+// proofing mode. Otherwise, access is granted
 func galleryMustBeVisible(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
 	user := context.User(r.Context())
 	if user == nil {
@@ -422,7 +2218,7 @@ func galleryMustBeVisible(w http.ResponseWriter, r *http.Request, gallery *model
 
 	var thirdPartyGallery bool = (gallery.UserID != user.ID)
 	var unpublished bool = (gallery.Status == models.Unpublished)
-	if thirdPartyGallery && unpublished {
+	if thirdPartyGallery && unpublished && !hasProofingAccess(r, gallery) {
 		http.Error(w, "gallery not found", http.StatusNotFound)
 		return fmt.Errorf("gallery is not published and user does not have access to it")
 	}
@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wagnojunior/lenslocked/context"
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// newImageGalleries returns a Galleries controller whose images are stored in
+// a temporary directory, with a PNG image of the given size named `a.png` in
+// the gallery with ID 1
+func newImageGalleries(t *testing.T, width, height int) (Galleries, string) {
+	t.Helper()
+	dir := t.TempDir()
+	gs := &models.GalleryService{ImagesDir: filepath.Join(dir, "images")}
+	g := Galleries{
+		GalleryService: gs,
+		TransformService: &models.TransformService{
+			GalleryService: gs,
+			CacheDir:       filepath.Join(dir, "cache"),
+		},
+	}
+
+	path := filepath.Join(dir, "images", "gallery-1", "a.png")
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return g, path
+}
+
+// serve requests the image `a.png` of the given gallery with the given query
+// and headers, as the given user if not nil
+func serve(g Galleries, gallery *models.Gallery, path, query string, user *models.User, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/galleries/1/images/a.png"+query, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	if user != nil {
+		r = r.WithContext(context.WithUser(r.Context(), user))
+	}
+	w := httptest.NewRecorder()
+	g.serveImage(w, r, gallery, "a.png", path)
+
+	return w
+}
+
+func TestServeImageETag(t *testing.T) {
+	g, path := newImageGalleries(t, 8, 8)
+	gallery := &models.Gallery{ID: 1, UserID: 1, Status: models.Published, AllowDownload: true}
+
+	w := serve(g, gallery, path, "", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	hash, err := models.Fingerprint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := w.Header().Get("ETag")
+	if etag != `"`+hash+`"` {
+		t.Errorf("ETag = %s, want %q", etag, hash)
+	}
+
+	w = serve(g, gallery, path, "", nil, http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("status with matching If-None-Match = %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	w = serve(g, gallery, path, "", nil, http.Header{"If-None-Match": {`"other"`}})
+	if w.Code != http.StatusOK {
+		t.Errorf("status with other If-None-Match = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServeImageCacheControl(t *testing.T) {
+	g, path := newImageGalleries(t, 8, 8)
+	owner := &models.User{ID: 1}
+
+	// The query parameter `v` is either missing, the current version of the
+	// image in the gallery, or a stale one
+	const (
+		noVersion      = ""
+		currentVersion = "current"
+		staleVersion   = "stale"
+	)
+	tests := []struct {
+		name    string
+		gallery models.Gallery
+		version string
+		user    *models.User
+		want    string
+	}{
+		{
+			name:    "published without version",
+			gallery: models.Gallery{Status: models.Published, AllowDownload: true},
+			want:    "public, no-cache",
+		},
+		{
+			name:    "published with current version",
+			gallery: models.Gallery{Status: models.Published, AllowDownload: true},
+			version: currentVersion,
+			want:    "public, max-age=31536000, immutable",
+		},
+		{
+			name:    "published with stale version",
+			gallery: models.Gallery{Status: models.Published, AllowDownload: true},
+			version: staleVersion,
+			want:    "public, no-cache",
+		},
+		{
+			name:    "licensed with current version",
+			gallery: models.Gallery{Status: models.Published, AllowDownload: true, License: "cc-by"},
+			version: currentVersion,
+			user:    owner,
+			want:    "public, max-age=31536000, immutable",
+		},
+		{
+			name:    "unpublished with current version",
+			gallery: models.Gallery{Status: models.Unpublished, AllowDownload: true},
+			version: currentVersion,
+			user:    owner,
+			want:    "private, max-age=31536000, immutable",
+		},
+		{
+			name:    "restricted served to the owner",
+			gallery: models.Gallery{Status: models.Published, MaxResolution: 4},
+			version: currentVersion,
+			user:    owner,
+			want:    "private, max-age=31536000, immutable",
+		},
+		{
+			name:    "restricted and protected",
+			gallery: models.Gallery{Status: models.Published, MaxResolution: 4},
+			version: currentVersion,
+			want:    "private, no-cache",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gallery := tt.gallery
+			gallery.ID = 1
+			gallery.UserID = owner.ID
+			var query string
+			switch tt.version {
+			case currentVersion:
+				query = "?v=" + galleryImageVersion(g.GalleryService, &gallery, "a.png")
+			case staleVersion:
+				query = "?v=0123456789abcdef"
+			}
+
+			w := serve(g, &gallery, path, query, tt.user, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			got := w.Header().Get("Cache-Control")
+			if got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(got, "immutable") && tt.version != currentVersion {
+				t.Errorf("Cache-Control = %q is immutable without the current version", got)
+			}
+		})
+	}
+}
+
+func TestImageVersionLicense(t *testing.T) {
+	g, _ := newImageGalleries(t, 8, 8)
+	gallery := &models.Gallery{ID: 1, UserID: 1, Status: models.Published}
+
+	unlicensed := galleryImageVersion(g.GalleryService, gallery, "a.png")
+	gallery.License = "cc-by"
+	licensed := galleryImageVersion(g.GalleryService, gallery, "a.png")
+	if unlicensed == "" || licensed == "" {
+		t.Fatal("image has no version")
+	}
+	if licensed == unlicensed {
+		t.Errorf("version %s did not change with the license", licensed)
+	}
+}
+
+func TestServeImageProtectedETag(t *testing.T) {
+	g, path := newImageGalleries(t, 8, 8)
+	gallery := &models.Gallery{ID: 1, UserID: 1, Status: models.Published, MaxResolution: 4}
+
+	// The ETag is the one of the rendition that is served, not of the image
+	w := serve(g, gallery, path, "", nil, nil)
+	hash, err := models.Fingerprint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || etag == `"`+hash+`"` {
+		t.Errorf("ETag = %s, want the one of the scaled down rendition", etag)
+	}
+
+	w = serve(g, gallery, path, "", nil, http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("status with matching If-None-Match = %d, want %d", w.Code, http.StatusNotModified)
+	}
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/wagnojunior/lenslocked/errors"
+	"github.com/wagnojunior/lenslocked/markdown"
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// Dimensions of the embeds returned by the oEmbed endpoint. The embeds are
+// stdEmbedWidth wide unless the consumer asks for less, and the caption below
+// the cover takes embedCaptionHeight
+const (
+	stdEmbedWidth      = 600
+	embedCaptionHeight = 48
+)
+
+// pageMeta defines the metadata of a page that is rendered by the template
+// `page_meta`, such as its Open Graph and Twitter card tags. The URLs are
+// absolute, since they are read by other sites
+type pageMeta struct {
+	Title       string
+	Description string
+	// URL is the canonical URL of the page
+	URL         string
+	ImageURL    string
+	ImageWidth  int
+	ImageHeight int
+	// OEmbedURL is where consumers discover the embed of the page, if any
+	OEmbedURL string
+}
+
+// embedTemplate renders the HTML of the embed of a gallery
+var embedTemplate = template.Must(template.New("embed").Parse(
+	`<blockquote class="lenslocked-embed" style="margin:0;max-width:{{.Width}}px">` +
+		`{{if .ImageURL}}<a href="{{.URL}}"><img src="{{.ImageURL}}" alt="{{.Title}}" ` +
+		`width="{{.ImageWidth}}" height="{{.ImageHeight}}" style="max-width:100%;height:auto"></a>{{end}}` +
+		`<p><a href="{{.URL}}">{{.Title}}</a>{{if .AuthorURL}} by <a href="{{.AuthorURL}}">{{.Author}}</a>{{end}}` +
+		` on <a href="{{.SiteURL}}">Lenslocked</a></p></blockquote>`))
+
+// OEmbed handles the oEmbed requests for the URLs of published galleries,
+// given in the query parameter `url`, and responds with a rich embed of the
+// gallery with its cover. The query parameters `maxwidth` and `maxheight`
+// bound the size of the embed. Only the JSON format is supported
+func (g Galleries) OEmbed(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format != "" && format != "json" {
+		http.Error(w, "unsupported format", http.StatusNotImplemented)
+		return
+	}
+
+	gallery, owner, err := g.galleryByURL(r.FormValue("url"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidGallery) || errors.Is(err, models.ErrInvalidUser) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if gallery.Status != models.Published {
+		http.Error(w, "gallery not found", http.StatusNotFound)
+		return
+	}
+
+	meta, err := g.galleryMeta(gallery, owner)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The embed is as wide as allowed, but never wider than its cover
+	maxWidth, _ := strconv.Atoi(r.FormValue("maxwidth"))
+	maxHeight, _ := strconv.Atoi(r.FormValue("maxheight"))
+	width := stdEmbedWidth
+	if maxWidth > 0 && maxWidth < width {
+		width = maxWidth
+	}
+	var imageWidth, imageHeight int
+	if meta.ImageWidth > 0 && meta.ImageHeight > 0 {
+		imageWidth, imageHeight = fitSize(meta.ImageWidth, meta.ImageHeight, width, meta.ImageHeight)
+		if maxHeight > embedCaptionHeight {
+			imageWidth, imageHeight = fitSize(imageWidth, imageHeight, width, maxHeight-embedCaptionHeight)
+		}
+		width = imageWidth
+	}
+
+	var author, authorURL string
+	if owner.Username != "" {
+		author = displayName(*owner)
+		authorURL = siteURL + "/u/" + url.PathEscape(owner.Username)
+	}
+
+	var html bytes.Buffer
+	err = embedTemplate.Execute(&html, map[string]interface{}{
+		"Title":       gallery.Title,
+		"URL":         meta.URL,
+		"ImageURL":    meta.ImageURL,
+		"ImageWidth":  imageWidth,
+		"ImageHeight": imageHeight,
+		"Width":       width,
+		"Author":      author,
+		"AuthorURL":   authorURL,
+		"SiteURL":     siteURL,
+	})
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	embed := struct {
+		Type            string `json:"type"`
+		Version         string `json:"version"`
+		Title           string `json:"title"`
+		AuthorName      string `json:"author_name,omitempty"`
+		AuthorURL       string `json:"author_url,omitempty"`
+		ProviderName    string `json:"provider_name"`
+		ProviderURL     string `json:"provider_url"`
+		HTML            string `json:"html"`
+		Width           int    `json:"width"`
+		Height          int    `json:"height"`
+		ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+		ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+		ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+	}{
+		Type:         "rich",
+		Version:      "1.0",
+		Title:        gallery.Title,
+		AuthorName:   author,
+		AuthorURL:    authorURL,
+		ProviderName: "Lenslocked",
+		ProviderURL:  siteURL,
+		HTML:         html.String(),
+		Width:        width,
+		Height:       imageHeight + embedCaptionHeight,
+	}
+
+	cover, err := g.GalleryService.Cover(gallery.ID)
+	if err != nil && !errors.Is(err, models.ErrImageNotFound) {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if cover != nil && cover.Width > 0 && cover.Height > 0 {
+		thumb := models.ImageSizes[0].MaxSide
+		embed.ThumbnailURL = siteURL + thumbnailURL(g.GalleryService, cover.GalleryID, cover.Filename)
+		embed.ThumbnailWidth, embed.ThumbnailHeight = fitSize(cover.Width, cover.Height, thumb, thumb)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	err = json.NewEncoder(w).Encode(embed)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// HELPER FUNCTIONS
+// /////////////////////////////////////////////////////////////////////////////
+
+// galleryMeta returns the metadata of the page of the given gallery, owned by
+// the given user. The cover is the largest derived size of the first image,
+// which is served to everyone
+func (g Galleries) galleryMeta(gallery *models.Gallery, owner *models.User) (pageMeta, error) {
+	meta := pageMeta{
+		Title:       gallery.Title,
+		Description: markdown.PlainText(gallery.Description, MetaDescriptionLength),
+		URL:         fmt.Sprintf("%s/galleries/%d", siteURL, gallery.ID),
+	}
+	if owner.Username != "" {
+		meta.URL = siteURL + galleryURL(owner, gallery)
+	}
+	if gallery.Status == models.Published {
+		meta.OEmbedURL = siteURL + "/oembed?format=json&url=" + url.QueryEscape(meta.URL)
+	}
+
+	cover, err := g.GalleryService.Cover(gallery.ID)
+	if errors.Is(err, models.ErrImageNotFound) {
+		return meta, nil
+	}
+	if err != nil {
+		return pageMeta{}, fmt.Errorf("gallery meta: %w", err)
+	}
+
+	size := models.ImageSizes[len(models.ImageSizes)-1]
+	meta.ImageURL = fmt.Sprintf("%s%s?size=%s&v=%s", siteURL, imageURL(cover.GalleryID, cover.Filename),
+		size.Name, imageVersion(g.GalleryService, cover.GalleryID, cover.Filename))
+	maxSide := size.MaxSide
+	if gallery.MaxResolution > 0 && gallery.MaxResolution < maxSide {
+		maxSide = gallery.MaxResolution
+	}
+	meta.ImageWidth, meta.ImageHeight = fitSize(cover.Width, cover.Height, maxSide, maxSide)
+
+	return meta, nil
+}
+
+// galleryByURL returns the gallery whose page is at the given URL of this
+// site, either under the public profile of its owner or under its ID, and its
+// owner. ErrInvalidGallery is returned for any other URL
+func (g Galleries) galleryByURL(rawURL string) (*models.Gallery, *models.User, error) {
+	site, _ := url.Parse(siteURL)
+	target, err := url.Parse(rawURL)
+	if err != nil || target.Host != site.Host {
+		return nil, nil, models.ErrInvalidGallery
+	}
+
+	var gallery *models.Gallery
+	segments := strings.Split(strings.Trim(target.Path, "/"), "/")
+	switch {
+	case len(segments) == 2 && segments[0] == "galleries":
+		id, err := strconv.Atoi(segments[1])
+		if err != nil {
+			return nil, nil, models.ErrInvalidGallery
+		}
+		gallery, err = g.GalleryService.ByID(id)
+		if err != nil {
+			return nil, nil, err
+		}
+	case len(segments) == 3 && segments[0] == "u":
+		owner, err := g.UserService.ByUsername(segments[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		gallery, err = g.GalleryService.BySlug(owner.ID, segments[2])
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, models.ErrInvalidGallery
+	}
+
+	owner, err := g.UserService.ByID(gallery.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return gallery, owner, nil
+}
+
+// fitSize returns the given dimensions scaled down to fit within the given
+// maximum width and height, keeping the aspect ratio. Dimensions that already
+// fit are returned as they are
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return width, height
+	}
+	if width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+
+	return width, height
+}
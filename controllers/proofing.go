@@ -0,0 +1,435 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wagnojunior/lenslocked/context"
+	"github.com/wagnojunior/lenslocked/errors"
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// proofSubmission defines a submitted proof as it is listed on the edit page
+type proofSubmission struct {
+	ID          int
+	Name        string
+	SubmittedAt time.Time
+	Selections  []models.Selection
+	ExportURL   string
+}
+
+// ProofingLink handles the share link of a gallery in proofing mode. It gives
+// the visitor access to the gallery, even if it is unpublished, and redirects
+// them to its proofing page
+func (g Galleries) ProofingLink(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	id, err := g.ProofingService.GalleryID(token)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidGallery) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	setCookie(w, proofingCookie(id), token)
+	http.Redirect(w, r, proofingPath(id), http.StatusFound)
+}
+
+// Proofing renders the images of a gallery in proofing mode, where the viewer
+// selects images, adds notes to them and submits their selection
+func (g Galleries) Proofing(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible, proofingMustBeOn)
+	if err != nil {
+		return
+	}
+
+	type Image struct {
+		Filename        string
+		FilenameEscaped string
+		Caption         string
+		ThumbnailURL    string
+		Selected        bool
+		Note            string
+	}
+	var data struct {
+		ID    int
+		Title string
+		// Limit is the maximum number of selected images, or zero for no
+		// limit
+		Limit       int
+		Selected    int
+		Submitted   bool
+		SubmittedAt time.Time
+		Name        string
+		Images      []Image
+		Page        *models.Page
+	}
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.Limit = gallery.ProofingLimit
+
+	proof, err := g.currentProof(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	notes := make(map[string]string)
+	if proof != nil {
+		data.Selected = len(proof.Selections)
+		data.Submitted = proof.Submitted()
+		data.SubmittedAt = proof.SubmittedAt
+		data.Name = proof.Name
+		for _, selection := range proof.Selections {
+			notes[selection.Filename] = selection.Note
+		}
+	}
+
+	images, page, err := g.GalleryService.Images(gallery.ID, pageOptions(r))
+	if err != nil {
+		listingError(w, err)
+		return
+	}
+	data.Page = page
+
+	for _, image := range images {
+		note, selected := notes[image.Filename]
+		data.Images = append(data.Images, Image{
+			Filename:        image.Filename,
+			FilenameEscaped: url.PathEscape(image.Filename),
+			Caption:         image.Caption,
+			ThumbnailURL:    thumbnailURL(g.GalleryService, image.GalleryID, image.Filename),
+			Selected:        selected,
+			Note:            note,
+		})
+	}
+
+	g.Templates.Proofing.Execute(w, r, data)
+}
+
+// SelectProofImage selects the image whose filename is given in the URL, with
+// the note given in the form value `note`, or unselects it if the form value
+// `selected` is not `true`. The proof of a visitor is created with their first
+// selection
+func (g Galleries) SelectProofImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible, proofingMustBeOn)
+	if err != nil {
+		return
+	}
+
+	proof, err := g.currentProof(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if proof == nil {
+		var userID int
+		user := context.User(r.Context())
+		if user != nil {
+			userID = user.ID
+		}
+		proof, err = g.ProofingService.Create(gallery.ID, userID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if proof.Token != "" {
+			setCookie(w, proofCookie(gallery.ID), proof.Token)
+		}
+	}
+
+	err = g.ProofingService.Select(proof, gallery.ProofingLimit, filename,
+		r.FormValue("selected") == "true", r.FormValue("note"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrImageNotFound):
+			http.Error(w, "image not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrProofSubmitted):
+			http.Error(w, "your selection is already submitted", http.StatusConflict)
+		case errors.Is(err, models.ErrProofingLimit):
+			msg := fmt.Sprintf("you can select at most %d images", gallery.ProofingLimit)
+			http.Error(w, msg, http.StatusConflict)
+		case errors.Is(err, models.ErrInvalidProofNote):
+			msg := fmt.Sprintf("notes can have at most %d characters", models.MaxProofNoteLength)
+			http.Error(w, msg, http.StatusBadRequest)
+		default:
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	redirectBack(w, r, proofingPath(gallery.ID))
+}
+
+// SubmitProof submits the selection of the viewer under the name given in the
+// form value `name`. Submitted selections can no longer change
+func (g Galleries) SubmitProof(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible, proofingMustBeOn)
+	if err != nil {
+		return
+	}
+
+	proof, err := g.currentProof(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if proof == nil {
+		http.Error(w, "select at least one image", http.StatusBadRequest)
+		return
+	}
+
+	err = g.ProofingService.Submit(proof, gallery.ProofingLimit, r.FormValue("name"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrProofEmpty):
+			http.Error(w, "select at least one image", http.StatusBadRequest)
+		case errors.Is(err, models.ErrProofSubmitted):
+			http.Error(w, "your selection is already submitted", http.StatusConflict)
+		case errors.Is(err, models.ErrProofingLimit):
+			msg := fmt.Sprintf("you can select at most %d images", gallery.ProofingLimit)
+			http.Error(w, msg, http.StatusConflict)
+		default:
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Redirect(w, r, proofingPath(gallery.ID), http.StatusFound)
+}
+
+// SetProofing handles whether a gallery is in proofing mode, given in the form
+// value `proofing`, and the maximum number of images a viewer can select,
+// given in the form value `limit`
+func (g Galleries) SetProofing(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	// An empty limit means no limit
+	var limit int
+	if value := strings.TrimSpace(r.FormValue("limit")); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid selection limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = g.ProofingService.SetProofing(gallery, r.FormValue("proofing") == "true", limit)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidProofLimit) {
+			http.Error(w, "invalid selection limit", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// ResetProofingLink replaces the share link of a gallery, so that the visitors
+// who were given the previous one lose access to it
+func (g Galleries) ResetProofingLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = g.ProofingService.ResetLink(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// ExportProof writes the filenames selected by a submitted proof, with their
+// notes, as a CSV file
+func (g Galleries) ExportProof(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	proofID, err := strconv.Atoi(chi.URLParam(r, "proofID"))
+	if err != nil {
+		http.Error(w, "invalid proof ID", http.StatusNotFound)
+		return
+	}
+	proof, err := g.ProofingService.ByID(gallery.ID, proofID)
+	if err != nil {
+		if errors.Is(err, models.ErrProofNotFound) {
+			http.Error(w, "proof not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if !proof.Submitted() {
+		http.Error(w, "proof not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("gallery-%d-proof-%d.csv", gallery.ID, proof.ID)))
+	err = writeProofCSV(w, proof)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// HELPER FUNCTIONS
+// /////////////////////////////////////////////////////////////////////////////
+
+// writeProofCSV writes the filenames selected by the given proof, with their
+// notes, as CSV. The cells are escaped with csvCell, since the notes are
+// written by visitors
+func writeProofCSV(w io.Writer, proof *models.Proof) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"filename", "note"})
+	for _, selection := range proof.Selections {
+		writer.Write([]string{csvCell(selection.Filename), csvCell(selection.Note)})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// csvCell returns the given value as a CSV cell that spreadsheets do not run
+// as a formula: values that start like one are prefixed with a quote
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// proofSubmissions returns the submitted proofs of the given gallery as they
+// are listed on the edit page
+func (g Galleries) proofSubmissions(gallery *models.Gallery) ([]proofSubmission, error) {
+	proofs, err := g.ProofingService.Submissions(gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var submissions []proofSubmission
+	for _, proof := range proofs {
+		name := proof.Name
+		if name == "" && proof.User.ID != 0 {
+			name = displayName(proof.User)
+		}
+		if name == "" {
+			name = "Visitor"
+		}
+		submissions = append(submissions, proofSubmission{
+			ID:          proof.ID,
+			Name:        name,
+			SubmittedAt: proof.SubmittedAt,
+			Selections:  proof.Selections,
+			ExportURL:   fmt.Sprintf("/galleries/%d/proofing/%d.csv", gallery.ID, proof.ID),
+		})
+	}
+
+	return submissions, nil
+}
+
+// currentProof returns the proof of the given gallery made by the current
+// user, or by the visitor identified by their cookie. It returns nil if they
+// have not selected any image yet
+func (g Galleries) currentProof(r *http.Request, gallery *models.Gallery) (*models.Proof, error) {
+	var proof *models.Proof
+	var err error
+	user := context.User(r.Context())
+	if user != nil {
+		proof, err = g.ProofingService.ByUser(gallery.ID, user.ID)
+	} else {
+		token, cookieErr := readCookie(r, proofCookie(gallery.ID))
+		if cookieErr != nil {
+			return nil, nil
+		}
+		proof, err = g.ProofingService.ByToken(gallery.ID, token)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrProofNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+// proofingPath returns the path of the proofing page of the given gallery
+func proofingPath(galleryID int) string {
+	return fmt.Sprintf("/galleries/%d/proofing", galleryID)
+}
+
+// proofingURL returns the share link of the given gallery
+func proofingURL(gallery *models.Gallery) string {
+	return siteURL + "/proofing/" + url.PathEscape(gallery.ProofingToken)
+}
+
+// proofingCookie returns the name of the cookie that holds the share link of
+// the given gallery
+func proofingCookie(galleryID int) string {
+	return fmt.Sprintf("%s_%d", CookieProofing, galleryID)
+}
+
+// proofCookie returns the name of the cookie that identifies the visitor who
+// made a proof of the given gallery
+func proofCookie(galleryID int) string {
+	return fmt.Sprintf("%s_%d", CookieProof, galleryID)
+}
+
+// hasProofingAccess returns true if the request holds the share link of the
+// given gallery, and the gallery is in proofing mode
+func hasProofingAccess(r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.Proofing || gallery.ProofingToken == "" {
+		return false
+	}
+	token, err := readCookie(r, proofingCookie(gallery.ID))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(gallery.ProofingToken)) == 1
+}
+
+// proofingMustBeOn is a functional option which determines that only
+// galleries in proofing mode can be proofed
+func proofingMustBeOn(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !gallery.Proofing {
+		http.Error(w, "proofing is not enabled for this gallery", http.StatusNotFound)
+		return fmt.Errorf("the gallery is not in proofing mode")
+	}
+
+	return nil
+}
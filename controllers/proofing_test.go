@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+func TestWriteProofCSV(t *testing.T) {
+	proof := &models.Proof{
+		Selections: []models.Selection{
+			{Filename: "a.jpg", Note: "keep this one"},
+			{Filename: "b.jpg", Note: `=HYPERLINK("https://example.com","click")`},
+			{Filename: "c.jpg", Note: "+cmd|' /C calc'!A0"},
+			{Filename: "d.jpg", Note: "-2+3"},
+			{Filename: "e.jpg", Note: "@SUM(A1:A2)"},
+			{Filename: "f.jpg", Note: "\tindented"},
+			{Filename: "g.jpg", Note: "\rreturn"},
+			{Filename: "=h.jpg", Note: ""},
+		},
+	}
+	want := [][]string{
+		{"filename", "note"},
+		{"a.jpg", "keep this one"},
+		{"b.jpg", `'=HYPERLINK("https://example.com","click")`},
+		{"c.jpg", "'+cmd|' /C calc'!A0"},
+		{"d.jpg", "'-2+3"},
+		{"e.jpg", "'@SUM(A1:A2)"},
+		{"f.jpg", "'\tindented"},
+		{"g.jpg", "'\rreturn"},
+		{"'=h.jpg", ""},
+	}
+
+	var buf bytes.Buffer
+	err := writeProofCSV(&buf, proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i][0] != want[i][0] || got[i][1] != want[i][1] {
+			t.Errorf("row %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// Tags holds the template struct that stores all the templates needed to
+// render the tag pages. Also, it holds the necessary services
+type Tags struct {
+	Templates struct {
+		Show Template
+	}
+	TagService     *models.TagService
+	GalleryService *models.GalleryService
+}
+
+// Show lists all published galleries and images tagged with the tag given in
+// the URL
+func (t Tags) Show(w http.ResponseWriter, r *http.Request) {
+	tag := chi.URLParam(r, "tag")
+
+	type Gallery struct {
+		ID    int
+		Title string
+	}
+	type Image struct {
+		GalleryID       int
+		Filename        string
+		FilenameEscaped string
+		Version         string
+	}
+	var data struct {
+		Tag           string
+		Galleries     []Gallery
+		GalleriesPage *models.Page
+		Images        []Image
+		ImagesPage    *models.Page
+	}
+	data.Tag = tag
+
+	// Both listings are paginated independently, each with its own cursor
+	galleries, page, err := t.TagService.PublishedGalleries(tag, models.PageOptions{
+		Cursor: r.FormValue("cursor"),
+	})
+	if err != nil {
+		listingError(w, err)
+		return
+	}
+	data.GalleriesPage = page
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:    gallery.ID,
+			Title: gallery.Title,
+		})
+	}
+
+	images, page, err := t.TagService.PublishedImages(tag, models.PageOptions{
+		Cursor: r.FormValue("images_cursor"),
+	})
+	if err != nil {
+		listingError(w, err)
+		return
+	}
+	data.ImagesPage = page
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			GalleryID:       image.GalleryID,
+			Filename:        image.Filename,
+			FilenameEscaped: url.PathEscape(image.Filename),
+			Version:         imageVersion(t.GalleryService, image.GalleryID, image.Filename),
+		})
+	}
+
+	t.Templates.Show.Execute(w, r, data)
+}
+
+// Autocomplete responds with a JSON array of tag names that start with the
+// prefix given in the query parameter `q`
+func (t Tags) Autocomplete(w http.ResponseWriter, r *http.Request) {
+	tags, err := t.TagService.Autocomplete(r.FormValue("q"), models.DefaultAutocompleteLimit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(names)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -2,9 +2,13 @@ package controllers
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/wagnojunior/lenslocked/context"
 	"github.com/wagnojunior/lenslocked/errors"
 	"github.com/wagnojunior/lenslocked/models"
@@ -20,11 +24,17 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		Profile        Template
+		Feed           Template
 	}
 	UserService          *models.UserService
 	SessionService       *models.SessionService
 	PasswordResetService *models.PasswordResetService
 	EmailService         *models.EmailService
+	GalleryService       *models.GalleryService
+	WatermarkService     *models.WatermarkService
+	CommentService       *models.CommentService
+	FollowService        *models.FollowService
 }
 
 // New executes the template `New` that is stored in `u.Templates`
@@ -124,17 +134,11 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "User authenticated: %+v", user)
 }
 
-// CurrentUser retrieves the user from the context
+// CurrentUser retrieves the user from the context and renders their account
+// page, where the public profile is edited
 func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-
-	// Sets data to be passed to the template
-	var data struct {
-		Email string
-	}
-	data.Email = user.Email
-
-	u.Templates.SignOut.Execute(w, r, data)
+	u.renderCurrentUser(w, r, user)
 }
 
 // ProcessSignOut signs out a user, deletes the session from the DB, and
@@ -195,7 +199,7 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	vals := url.Values{
 		"token": {pwReset.Token},
 	}
-	resetURL := "https://lenslocked.wagnojunior.xyz/reset-pw?" + vals.Encode()
+	resetURL := siteURL + "/reset-pw?" + vals.Encode()
 	err = u.EmailService.ForgotPassword(data.Email, resetURL)
 	if err != nil {
 		fmt.Println(err)
@@ -257,6 +261,455 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
+// /////////////////////////////////////////////////////////////////////////////
+// PROFILE
+// /////////////////////////////////////////////////////////////////////////////
+
+// UpdateProfile processes the form of the account page that updates the
+// username, the display name and the bio of the current user
+func (u Users) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	user.Username = r.FormValue("username")
+	user.DisplayName = r.FormValue("display_name")
+	user.Bio = r.FormValue("bio")
+
+	err := u.UserService.UpdateProfile(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrUsernameTaken):
+			err = errors.Public(err, "This username is already taken. Please, choose another one.")
+		case errors.Is(err, models.ErrUsernameReserved):
+			err = errors.Public(err, "This username is reserved. Please, choose another one.")
+		case errors.Is(err, models.ErrInvalidUsername):
+			err = errors.Public(err, "Usernames have 3 to 30 characters: lower case letters, digits, hyphens and underscores.")
+		default:
+			fmt.Println(err)
+		}
+
+		u.renderCurrentUser(w, r, user, err)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// UploadAvatar handles the HTTP POST request to upload the avatar of the
+// current user
+func (u Users) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	err := r.ParseMultipartForm(5 << 20) // 5MB
+	if err != nil {
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	file, fileHeader, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, "no avatar was uploaded", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	err = u.UserService.SetAvatar(user, fileHeader.Filename, file)
+	if err != nil {
+		var fileErr models.FileError
+		if errors.As(err, &fileErr) {
+			msg := fmt.Sprintf("%v has an invalid content type or extension.", fileHeader.Filename)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// UpdateWatermark processes the form of the account page that updates the
+// watermark of the current user: its text, position, opacity and scale in
+// percents, and optionally a logo, which replaces the text. The form value
+// `remove_logo` removes the logo
+func (u Users) UpdateWatermark(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	err := r.ParseMultipartForm(5 << 20) // 5MB
+	if err != nil {
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	wm, err := u.WatermarkService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	opacity, err1 := strconv.Atoi(r.FormValue("opacity"))
+	scale, err2 := strconv.Atoi(r.FormValue("scale"))
+	wm.Text = r.FormValue("text")
+	wm.Position = r.FormValue("position")
+	wm.Opacity = float64(opacity) / 100
+	wm.Scale = float64(scale) / 100
+	if err1 != nil || err2 != nil {
+		err = models.ErrInvalidWatermark
+	} else {
+		err = u.WatermarkService.Update(wm)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidWatermark) {
+			err = errors.Public(err, "The opacity ranges from 0 to 100% and the size from 1 to 100% of the image width.")
+		} else {
+			fmt.Println(err)
+		}
+		u.renderCurrentUser(w, r, user, err)
+		return
+	}
+
+	if r.FormValue("remove_logo") == "true" {
+		err = u.WatermarkService.RemoveLogo(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	file, fileHeader, err := r.FormFile("logo")
+	if err == nil {
+		defer file.Close()
+
+		err = u.WatermarkService.SetLogo(user.ID, fileHeader.Filename, file)
+		if err != nil {
+			var fileErr models.FileError
+			if errors.As(err, &fileErr) {
+				msg := fmt.Sprintf("%v has an invalid content type or extension.", fileHeader.Filename)
+				u.renderCurrentUser(w, r, user, errors.Public(err, msg))
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// WatermarkLogo serves the watermark logo of the current user
+func (u Users) WatermarkLogo(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	wm, err := u.WatermarkService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if wm.Logo == "" {
+		http.Error(w, "logo not found", http.StatusNotFound)
+		return
+	}
+
+	http.ServeFile(w, r, wm.LogoPath)
+}
+
+// Follow makes the current user follow the user given in the form value
+// `username`, or unfollow them if the form value `follow` is `false`. The state
+// is set rather than toggled, so that submitting the form twice does no harm
+func (u Users) Follow(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	followee, err := u.UserService.ByUsername(r.FormValue("username"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidUser) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("follow") == "false" {
+		err = u.FollowService.Unfollow(user.ID, followee.ID)
+	} else {
+		err = u.FollowService.Follow(user.ID, followee.ID)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidUser) {
+			http.Error(w, "you can not follow yourself", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	redirectBack(w, r, "/u/"+url.PathEscape(followee.Username))
+}
+
+// Feed renders the newly published galleries and uploaded images of the users
+// followed by the current user, the most recent first
+func (u Users) Feed(w http.ResponseWriter, r *http.Request) {
+	type Event struct {
+		Author    string
+		AuthorURL string
+		// Image events have a thumbnail, and gallery events a cover if the
+		// gallery has images
+		IsImage      bool
+		GalleryTitle string
+		GalleryURL   string
+		Caption      string
+		URL          string
+		ThumbnailURL string
+		CreatedAt    time.Time
+	}
+	var data struct {
+		Events []Event
+		Page   *models.Page
+	}
+
+	user := context.User(r.Context())
+	events, page, err := u.FollowService.Feed(user.ID, pageOptions(r))
+	if err != nil {
+		listingError(w, err)
+		return
+	}
+	data.Page = page
+
+	for _, event := range events {
+		gallery := models.Gallery{
+			ID:   event.GalleryID,
+			Slug: event.GallerySlug,
+		}
+		item := Event{
+			Author:       displayName(event.User),
+			AuthorURL:    "/u/" + url.PathEscape(event.User.Username),
+			GalleryTitle: event.GalleryTitle,
+			GalleryURL:   galleryURL(&event.User, &gallery),
+			CreatedAt:    event.CreatedAt,
+		}
+		// Only users with a username have a public profile
+		if event.User.Username == "" {
+			item.AuthorURL = ""
+			item.GalleryURL = fmt.Sprintf("/galleries/%d", event.GalleryID)
+		}
+
+		switch event.Kind {
+		case models.EventImageUploaded:
+			item.IsImage = true
+			item.Caption = event.Caption
+			item.URL = imageURL(event.GalleryID, event.Filename) + "/view"
+			item.ThumbnailURL = thumbnailURL(u.GalleryService, event.GalleryID, event.Filename)
+		default:
+			item.URL = item.GalleryURL
+			cover, err := u.GalleryService.Cover(event.GalleryID)
+			if err != nil && !errors.Is(err, models.ErrImageNotFound) {
+				fmt.Println(err)
+				http.Error(w, "something went wrong", http.StatusInternalServerError)
+				return
+			}
+			if cover != nil {
+				item.ThumbnailURL = thumbnailURL(u.GalleryService, cover.GalleryID, cover.Filename)
+			}
+		}
+		data.Events = append(data.Events, item)
+	}
+
+	u.Templates.Feed.Execute(w, r, data)
+}
+
+// UnblockCommenter allows the user given in the URL to comment on the galleries
+// of the current user again
+func (u Users) UnblockCommenter(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	blockedID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.CommentService.Unblock(user.ID, blockedID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// Profile renders the public profile of the user given in the URL, with their
+// published galleries
+func (u Users) Profile(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByUsername(w, r)
+	if err != nil {
+		return
+	}
+
+	type Gallery struct {
+		Title      string
+		URL        string
+		CoverURL   string
+		ImageCount int
+	}
+	var data struct {
+		Username    string
+		DisplayName string
+		Bio         string
+		HasAvatar   bool
+		Galleries   []Gallery
+		Page        *models.Page
+		Follows     models.Follows
+		// IsSelf defines whether the profile is the one of the current user,
+		// who can not follow themselves
+		IsSelf bool
+	}
+	data.Username = user.Username
+	data.DisplayName = user.DisplayName
+	if data.DisplayName == "" {
+		data.DisplayName = user.Username
+	}
+	data.Bio = user.Bio
+	data.HasAvatar = user.Avatar != ""
+
+	// Visitors are counted as the user with ID zero, who follows nobody
+	var viewerID int
+	viewer := context.User(r.Context())
+	if viewer != nil {
+		viewerID = viewer.ID
+	}
+	data.IsSelf = viewerID == user.ID
+	data.Follows, err = u.FollowService.Counts(user.ID, viewerID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	galleries, page, err := u.GalleryService.PublishedByUserID(user.ID, pageOptions(r))
+	if err != nil {
+		listingError(w, err)
+		return
+	}
+	data.Page = page
+
+	for _, gallery := range galleries {
+		item := Gallery{
+			Title:      gallery.Title,
+			URL:        galleryURL(user, &gallery),
+			ImageCount: gallery.ImageCount,
+		}
+		cover, err := u.GalleryService.Cover(gallery.ID)
+		if err != nil && !errors.Is(err, models.ErrImageNotFound) {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if cover != nil {
+			item.CoverURL = thumbnailURL(u.GalleryService, cover.GalleryID, cover.Filename)
+		}
+		data.Galleries = append(data.Galleries, item)
+	}
+
+	u.Templates.Profile.Execute(w, r, data)
+}
+
+// Avatar serves the avatar of the user given in the URL
+func (u Users) Avatar(w http.ResponseWriter, r *http.Request) {
+	user, err := u.userByUsername(w, r)
+	if err != nil {
+		return
+	}
+
+	path, err := u.UserService.AvatarPath(user)
+	if err != nil {
+		http.Error(w, "avatar not found", http.StatusNotFound)
+		return
+	}
+
+	http.ServeFile(w, r, path)
+}
+
+// renderCurrentUser renders the account page of the given user with the given
+// errors, if any
+func (u Users) renderCurrentUser(w http.ResponseWriter, r *http.Request, user *models.User, errs ...error) {
+	type Commenter struct {
+		ID   int
+		Name string
+	}
+	var data struct {
+		Email       string
+		Username    string
+		DisplayName string
+		Bio         string
+		HasAvatar   bool
+		// Watermark settings, with the opacity and the scale in percents
+		Watermark struct {
+			Text      string
+			HasLogo   bool
+			Position  string
+			Opacity   int
+			Scale     int
+			Positions []string
+		}
+		// Blocked lists the users who can not comment on the galleries of
+		// the current user
+		Blocked []Commenter
+	}
+	data.Email = user.Email
+	data.Username = user.Username
+	data.DisplayName = user.DisplayName
+	data.Bio = user.Bio
+	data.HasAvatar = user.Avatar != ""
+
+	wm, err := u.WatermarkService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Watermark.Text = wm.Text
+	data.Watermark.HasLogo = wm.Logo != ""
+	data.Watermark.Position = wm.Position
+	data.Watermark.Opacity = int(math.Round(wm.Opacity * 100))
+	data.Watermark.Scale = int(math.Round(wm.Scale * 100))
+	data.Watermark.Positions = models.WatermarkPositions
+
+	blocked, err := u.CommentService.Blocked(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, commenter := range blocked {
+		data.Blocked = append(data.Blocked, Commenter{
+			ID:   commenter.ID,
+			Name: displayName(commenter),
+		})
+	}
+
+	u.Templates.SignOut.Execute(w, r, data, errs...)
+}
+
+// userByUsername is a helper method that gets the user given by the URL
+// parameter `username`. It responds with an error if there is no such user
+func (u Users) userByUsername(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	user, err := u.UserService.ByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidUser) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	return user, nil
+}
+
 // /////////////////////////////////////////////////////////////////////////////
 // MIDDLEWARE
 // /////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,129 @@
+// Package markdown renders the Markdown written by users, such as the
+// descriptions of the galleries, to HTML that is safe to embed in a page
+package markdown
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var (
+	// renderer converts Markdown to HTML. Raw HTML in the source is omitted
+	renderer = goldmark.New(
+		goldmark.WithExtensions(
+			extension.Strikethrough,
+			extension.NewTable(
+				extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute),
+			),
+			extension.Linkify,
+		),
+	)
+
+	// policy is the allowlist of elements and attributes that are kept in the
+	// rendered HTML. Everything else is removed
+	policy = newPolicy()
+
+	// litePolicy is the allowlist applied to short texts such as comments,
+	// which keep their paragraphs, emphasis, code and links only
+	litePolicy = newLitePolicy()
+
+	// stripPolicy removes every element and keeps only the text
+	stripPolicy = bluemonday.StrictPolicy()
+)
+
+// newPolicy returns the sanitizer policy applied to the rendered HTML
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "hr", "blockquote", "pre", "code",
+		"h1", "h2", "h3", "h4", "h5", "h6",
+		"ul", "ol", "li", "em", "strong", "del",
+		"table", "thead", "tbody", "tr", "th", "td")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("align").Matching(bluemonday.CellAlign).OnElements("th", "td")
+
+	allowLinks(p)
+
+	return p
+}
+
+// newLitePolicy returns the sanitizer policy applied to the HTML rendered by
+// RenderLite
+func newLitePolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "em", "strong", "del", "code")
+	allowLinks(p)
+
+	return p
+}
+
+// allowLinks allows the given policy to keep links to web and mail addresses,
+// which are not followed by search engines
+func allowLinks(p *bluemonday.Policy) {
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.AllowRelativeURLs(true)
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+}
+
+// Render converts the given Markdown to sanitized HTML
+func Render(src string) template.HTML {
+	var buf bytes.Buffer
+	err := renderer.Convert([]byte(src), &buf)
+	if err != nil {
+		// The Markdown could not be rendered, so it is shown as plain text
+		return template.HTML(template.HTMLEscapeString(src))
+	}
+
+	return template.HTML(policy.SanitizeBytes(buf.Bytes()))
+}
+
+// RenderLite converts the given Markdown to sanitized HTML that only keeps
+// paragraphs, line breaks, emphasis, inline code and links. Other elements,
+// such as headings, lists and tables, are reduced to their text
+func RenderLite(src string) template.HTML {
+	var buf bytes.Buffer
+	err := renderer.Convert([]byte(src), &buf)
+	if err != nil {
+		return template.HTML(template.HTMLEscapeString(src))
+	}
+
+	return template.HTML(litePolicy.SanitizeBytes(buf.Bytes()))
+}
+
+// PlainText returns the text of the given Markdown without any formatting, on
+// a single line. If the text is longer than limit characters, it is cut at a
+// word boundary and an ellipsis is appended. A limit of zero means no limit
+func PlainText(src string, limit int) string {
+	var buf bytes.Buffer
+	err := renderer.Convert([]byte(src), &buf)
+	if err != nil {
+		buf.Reset()
+		buf.WriteString(template.HTMLEscapeString(src))
+	}
+
+	// Block elements are separated by new lines in the rendered HTML, which
+	// become spaces once the whitespace is collapsed
+	text := html.UnescapeString(stripPolicy.Sanitize(buf.String()))
+	text = strings.Join(strings.Fields(text), " ")
+
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+
+	runes := []rune(text)
+	cut := string(runes[:limit])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+
+	return strings.TrimRight(cut, " ,.;:") + "…"
+}
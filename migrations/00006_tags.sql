@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE tags (
+    id SERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE gallery_tags (
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    tag_id INT NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (gallery_id, tag_id)
+);
+
+CREATE TABLE image_tags (
+    image_id INT NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    tag_id INT NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (image_id, tag_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE image_tags;
+DROP TABLE gallery_tags;
+DROP TABLE tags;
+-- +goose StatementEnd
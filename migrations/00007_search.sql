@@ -0,0 +1,94 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE galleries ADD COLUMN search_vector TSVECTOR;
+ALTER TABLE images ADD COLUMN caption TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN search_vector TSVECTOR;
+
+CREATE INDEX galleries_search_vector_idx ON galleries USING GIN (search_vector);
+CREATE INDEX images_search_vector_idx ON images USING GIN (search_vector);
+
+-- The search vector of a gallery is built from its title, description and tags
+CREATE FUNCTION galleries_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('english', NEW.description), 'B') ||
+        setweight(to_tsvector('english', coalesce((
+            SELECT string_agg(tags.name, ' ')
+            FROM tags
+            JOIN gallery_tags ON gallery_tags.tag_id = tags.id
+            WHERE gallery_tags.gallery_id = NEW.id), '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER galleries_search_vector_trigger
+BEFORE INSERT OR UPDATE ON galleries
+FOR EACH ROW EXECUTE FUNCTION galleries_search_vector_update();
+
+-- The search vector of an image is built from its caption, tags and filename
+CREATE FUNCTION images_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', NEW.caption), 'A') ||
+        setweight(to_tsvector('english', coalesce((
+            SELECT string_agg(tags.name, ' ')
+            FROM tags
+            JOIN image_tags ON image_tags.tag_id = tags.id
+            WHERE image_tags.image_id = NEW.id), '')), 'B') ||
+        setweight(to_tsvector('english', regexp_replace(NEW.filename, '[^[:alnum:]]+', ' ', 'g')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER images_search_vector_trigger
+BEFORE INSERT OR UPDATE ON images
+FOR EACH ROW EXECUTE FUNCTION images_search_vector_update();
+
+-- Adding or removing a tag touches the tagged gallery or image so that its
+-- search vector is rebuilt
+CREATE FUNCTION gallery_tags_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    UPDATE galleries SET search_vector = NULL
+    WHERE id = coalesce(NEW.gallery_id, OLD.gallery_id);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER gallery_tags_search_vector_trigger
+AFTER INSERT OR DELETE ON gallery_tags
+FOR EACH ROW EXECUTE FUNCTION gallery_tags_search_vector_update();
+
+CREATE FUNCTION image_tags_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    UPDATE images SET search_vector = NULL
+    WHERE id = coalesce(NEW.image_id, OLD.image_id);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER image_tags_search_vector_trigger
+AFTER INSERT OR DELETE ON image_tags
+FOR EACH ROW EXECUTE FUNCTION image_tags_search_vector_update();
+
+-- Builds the search vectors of the existing galleries and images
+UPDATE galleries SET search_vector = NULL;
+UPDATE images SET search_vector = NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER image_tags_search_vector_trigger ON image_tags;
+DROP TRIGGER gallery_tags_search_vector_trigger ON gallery_tags;
+DROP TRIGGER images_search_vector_trigger ON images;
+DROP TRIGGER galleries_search_vector_trigger ON galleries;
+DROP FUNCTION image_tags_search_vector_update;
+DROP FUNCTION gallery_tags_search_vector_update;
+DROP FUNCTION images_search_vector_update;
+DROP FUNCTION galleries_search_vector_update;
+ALTER TABLE images DROP COLUMN search_vector;
+ALTER TABLE images DROP COLUMN caption;
+ALTER TABLE galleries DROP COLUMN search_vector;
+ALTER TABLE galleries DROP COLUMN description;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE galleries ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE images ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE images ADD COLUMN position INT NOT NULL DEFAULT 0;
+
+-- Existing images are ordered by filename
+UPDATE images SET position = ordered.position
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY gallery_id ORDER BY filename) AS position
+    FROM images
+) AS ordered
+WHERE images.id = ordered.id;
+
+CREATE INDEX galleries_user_id_idx ON galleries (user_id);
+CREATE INDEX images_gallery_id_position_idx ON images (gallery_id, position, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX images_gallery_id_position_idx;
+DROP INDEX galleries_user_id_idx;
+ALTER TABLE images DROP COLUMN position;
+ALTER TABLE images DROP COLUMN created_at;
+ALTER TABLE galleries DROP COLUMN updated_at;
+ALTER TABLE galleries DROP COLUMN created_at;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE collections (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    parent_id INT REFERENCES collections (id) ON DELETE SET NULL,
+    title TEXT NOT NULL,
+    -- visibility is the visibility chosen by the owner (inherit, published or
+    -- unpublished) and publication_status the resulting status
+    visibility TEXT NOT NULL DEFAULT 'inherit',
+    publication_status TEXT NOT NULL DEFAULT 'unpublished',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX collections_parent_id_idx ON collections (parent_id);
+
+ALTER TABLE galleries ADD COLUMN collection_id INT REFERENCES collections (id) ON DELETE SET NULL;
+ALTER TABLE galleries ADD COLUMN inherit_visibility BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN inherit_visibility;
+ALTER TABLE galleries DROP COLUMN collection_id;
+DROP TABLE collections;
+-- +goose StatementEnd
@@ -0,0 +1,54 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN username TEXT;
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX users_username_idx ON users (username);
+
+ALTER TABLE galleries ADD COLUMN slug TEXT NOT NULL DEFAULT '';
+
+-- Existing galleries get a slug derived from their title
+UPDATE galleries SET slug = slugged.slug
+FROM (
+    SELECT id, coalesce(nullif(trim(BOTH '-' FROM
+        regexp_replace(lower(coalesce(title, '')), '[^a-z0-9]+', '-', 'g')), ''), 'gallery') AS slug
+    FROM galleries
+) AS slugged
+WHERE galleries.id = slugged.id;
+
+-- Galleries of the same user with the same slug, and those with a reserved
+-- slug, are told apart by their ID. A suffixed slug might be the slug of
+-- another gallery, so suffixes are added until every slug is unique
+DO $$
+BEGIN
+    UPDATE galleries SET slug = slug || '-' || id
+    WHERE slug IN ('avatar', 'feed');
+
+    LOOP
+        UPDATE galleries SET slug = slug || '-' || id
+        WHERE id IN (
+            SELECT id
+            FROM (
+                SELECT id, ROW_NUMBER() OVER (PARTITION BY user_id, slug ORDER BY id) AS n
+                FROM galleries
+            ) AS numbered
+            WHERE n > 1
+        );
+        EXIT WHEN NOT FOUND;
+    END LOOP;
+END $$;
+
+CREATE UNIQUE INDEX galleries_user_id_slug_idx ON galleries (user_id, slug);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX galleries_user_id_slug_idx;
+ALTER TABLE galleries DROP COLUMN slug;
+DROP INDEX users_username_idx;
+ALTER TABLE users DROP COLUMN avatar;
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN display_name;
+ALTER TABLE users DROP COLUMN username;
+-- +goose StatementEnd
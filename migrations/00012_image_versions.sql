@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE image_versions (
+    id SERIAL PRIMARY KEY,
+    image_id INT NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    number INT NOT NULL,
+    kind TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (image_id, number)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE image_versions;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images ADD COLUMN width INT;
+ALTER TABLE images ADD COLUMN height INT;
+ALTER TABLE images ADD COLUMN blurhash TEXT;
+ALTER TABLE images ADD COLUMN dominant_color TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images DROP COLUMN dominant_color;
+ALTER TABLE images DROP COLUMN blurhash;
+ALTER TABLE images DROP COLUMN height;
+ALTER TABLE images DROP COLUMN width;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE watermarks (
+    user_id INT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    text TEXT NOT NULL DEFAULT '',
+    logo TEXT,
+    position TEXT NOT NULL DEFAULT 'bottom-right',
+    opacity DOUBLE PRECISION NOT NULL DEFAULT 0.5,
+    scale DOUBLE PRECISION NOT NULL DEFAULT 0.2,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE galleries ADD COLUMN watermark BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN watermark;
+DROP TABLE watermarks;
+-- +goose StatementEnd
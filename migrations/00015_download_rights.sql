@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN allow_download BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE galleries ADD COLUMN max_resolution INT NOT NULL DEFAULT 0;
+ALTER TABLE galleries ADD COLUMN license TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN license;
+ALTER TABLE galleries DROP COLUMN max_resolution;
+ALTER TABLE galleries DROP COLUMN allow_download;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images ADD COLUMN latitude DOUBLE PRECISION;
+ALTER TABLE images ADD COLUMN longitude DOUBLE PRECISION;
+ALTER TABLE images ADD COLUMN geotag_checked BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE galleries ADD COLUMN public_location BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN public_location;
+ALTER TABLE images DROP COLUMN geotag_checked;
+ALTER TABLE images DROP COLUMN longitude;
+ALTER TABLE images DROP COLUMN latitude;
+-- +goose StatementEnd
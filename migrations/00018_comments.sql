@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE comments (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    -- image_id is NULL for the comments on the gallery itself
+    image_id INT REFERENCES images (id) ON DELETE CASCADE,
+    parent_id INT REFERENCES comments (id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    body TEXT NOT NULL,
+    -- status is either pending, until the owner of the gallery approves the
+    -- comment, or approved
+    status TEXT NOT NULL DEFAULT 'approved',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX comments_gallery_id_image_id_idx ON comments (gallery_id, image_id);
+CREATE INDEX comments_user_id_created_at_idx ON comments (user_id, created_at);
+
+-- Blocked users can not comment on any gallery of the owner who blocked them
+CREATE TABLE comment_blocks (
+    owner_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (owner_id, user_id)
+);
+
+ALTER TABLE galleries ADD COLUMN comment_moderation BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN comment_moderation;
+DROP TABLE comment_blocks;
+DROP TABLE comments;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE follows (
+    follower_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    followee_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (follower_id, followee_id),
+    CHECK (follower_id <> followee_id)
+);
+CREATE INDEX follows_followee_id_idx ON follows (followee_id);
+
+-- events records what users do, such as publishing a gallery or uploading an
+-- image, so that it can be shown to their followers
+CREATE TABLE events (
+    id SERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    -- image_id is NULL for the events about a gallery as a whole
+    image_id INT REFERENCES images (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX events_user_id_created_at_idx ON events (user_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE events;
+DROP TABLE follows;
+-- +goose StatementEnd
@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+-- proofing_limit is the maximum number of images a proof can select, or zero
+-- for no limit. proofing_token is the token of the share link, which is NULL
+-- until the owner creates one
+ALTER TABLE galleries ADD COLUMN proofing BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE galleries ADD COLUMN proofing_limit INT NOT NULL DEFAULT 0;
+ALTER TABLE galleries ADD COLUMN proofing_token TEXT UNIQUE;
+
+-- A proof is the selection of a viewer, who is either a user or a visitor of
+-- the share link identified by the hash of a token kept in a cookie
+CREATE TABLE proofs (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE,
+    name TEXT NOT NULL DEFAULT '',
+    submitted_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (gallery_id, user_id),
+    CHECK ((user_id IS NULL) <> (token_hash IS NULL))
+);
+
+CREATE TABLE proof_selections (
+    proof_id INT NOT NULL REFERENCES proofs (id) ON DELETE CASCADE,
+    image_id INT NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (proof_id, image_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE proof_selections;
+DROP TABLE proofs;
+ALTER TABLE galleries DROP COLUMN proofing_token;
+ALTER TABLE galleries DROP COLUMN proofing_limit;
+ALTER TABLE galleries DROP COLUMN proofing;
+-- +goose StatementEnd
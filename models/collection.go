@@ -0,0 +1,493 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Visibility defines a new type that wraps the native string type. It
+// represents the visibility chosen by the owner of a collection, which is
+// either inherited from the parent collection or overridden
+type Visibility string
+
+// Defines the three visibilities. A root collection that inherits its
+// visibility is unpublished
+var (
+	VisibilityInherit     Visibility = "inherit"
+	VisibilityPublished   Visibility = Visibility(Published)
+	VisibilityUnpublished Visibility = Visibility(Unpublished)
+)
+
+// Collection defines the collection model according to the `collections` SQL
+// table. A collection groups galleries and other collections
+type Collection struct {
+	ID     int
+	UserID int
+	// ParentID is zero for root collections
+	ParentID   int
+	Title      string
+	Visibility Visibility
+	// Status is the resulting publication status of the collection, after its
+	// visibility is resolved
+	Status    PublicationStatus
+	CreatedAt time.Time
+}
+
+// CollectionService defines the connection to the DB
+type CollectionService struct {
+	DB *sql.DB
+}
+
+// Create creates a new collection with the given title, associated with the
+// given user and nested inside the given parent collection. A zero parent ID
+// creates a root collection
+func (cs *CollectionService) Create(title string, userID, parentID int) (*Collection, error) {
+	collection := Collection{
+		UserID:     userID,
+		ParentID:   parentID,
+		Title:      title,
+		Visibility: VisibilityInherit,
+		Status:     Unpublished,
+	}
+
+	if parentID != 0 {
+		parent, err := cs.ByID(parentID)
+		if err != nil {
+			return nil, fmt.Errorf("create collection: %w", err)
+		}
+		if parent.UserID != userID {
+			return nil, fmt.Errorf("create collection: %w", ErrInvalidCollection)
+		}
+	}
+
+	tx, err := cs.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`
+		INSERT INTO collections (user_id, parent_id, title, visibility)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		userID, nullID(parentID), title, collection.Visibility)
+	err = row.Scan(&collection.ID, &collection.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+
+	err = refreshVisibility(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+
+	return cs.ByID(collection.ID)
+}
+
+// ByID query and returns a collection by the given ID
+func (cs *CollectionService) ByID(id int) (*Collection, error) {
+	collection := Collection{
+		ID: id,
+	}
+
+	var parentID sql.NullInt64
+	row := cs.DB.QueryRow(`
+		SELECT user_id, parent_id, title, visibility, publication_status, created_at
+		FROM collections
+		WHERE id = $1`,
+		id)
+	err := row.Scan(&collection.UserID, &parentID, &collection.Title,
+		&collection.Visibility, &collection.Status, &collection.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidCollection
+		}
+		return nil, fmt.Errorf("query collection by id: %w", err)
+	}
+	collection.ParentID = int(parentID.Int64)
+
+	return &collection, nil
+}
+
+// ByUserID returns all collections of the given user ordered by title
+func (cs *CollectionService) ByUserID(userID int) ([]Collection, error) {
+	rows, err := cs.DB.Query(`
+		SELECT id, user_id, parent_id, title, visibility, publication_status, created_at
+		FROM collections
+		WHERE user_id = $1
+		ORDER BY lower(title), id`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("query collections by user id: %w", err)
+	}
+
+	collections, err := scanCollections(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query collections by user id: %w", err)
+	}
+
+	return collections, nil
+}
+
+// Children returns the collections nested directly inside the given
+// collection ordered by title
+func (cs *CollectionService) Children(id int) ([]Collection, error) {
+	rows, err := cs.DB.Query(`
+		SELECT id, user_id, parent_id, title, visibility, publication_status, created_at
+		FROM collections
+		WHERE parent_id = $1
+		ORDER BY lower(title), id`,
+		id)
+	if err != nil {
+		return nil, fmt.Errorf("query collection children: %w", err)
+	}
+
+	collections, err := scanCollections(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query collection children: %w", err)
+	}
+
+	return collections, nil
+}
+
+// Ancestors returns the collections that contain the given collection, from
+// the root down to the given collection itself. It is used to render
+// breadcrumbs
+func (cs *CollectionService) Ancestors(id int) ([]Collection, error) {
+	rows, err := cs.DB.Query(`
+		WITH RECURSIVE ancestors AS (
+			SELECT collections.*, 0 AS depth
+			FROM collections
+			WHERE id = $1
+			UNION ALL
+			SELECT collections.*, ancestors.depth + 1
+			FROM collections
+			JOIN ancestors ON collections.id = ancestors.parent_id
+		)
+		SELECT id, user_id, parent_id, title, visibility, publication_status, created_at
+		FROM ancestors
+		ORDER BY depth DESC`,
+		id)
+	if err != nil {
+		return nil, fmt.Errorf("query collection ancestors: %w", err)
+	}
+
+	collections, err := scanCollections(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query collection ancestors: %w", err)
+	}
+
+	return collections, nil
+}
+
+// Galleries returns the galleries placed directly inside the given collection
+func (cs *CollectionService) Galleries(id int) ([]Gallery, error) {
+	rows, err := cs.DB.Query(`
+		SELECT id, user_id, coalesce(title, ''), publication_status
+		FROM galleries
+		WHERE collection_id = $1 AND deleted_at IS NULL
+		ORDER BY lower(title), id`,
+		id)
+	if err != nil {
+		return nil, fmt.Errorf("query collection galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			CollectionID: id,
+		}
+		err = rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Status)
+		if err != nil {
+			return nil, fmt.Errorf("query collection galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query collection galleries: %w", err)
+	}
+
+	return galleries, nil
+}
+
+// Cover returns the image used as the cover of the given collection, which is
+// the first image of the first gallery found in the collection or in any of
+// its descendants, the closest first. If publishedOnly is set, only published
+// galleries are considered. ErrImageNotFound is returned if there is no such
+// image. The Path of the image is not set
+func (cs *CollectionService) Cover(id int, publishedOnly bool) (*Image, error) {
+	image := Image{}
+	row := cs.DB.QueryRow(`
+		WITH RECURSIVE subtree AS (
+			SELECT id, 0 AS depth
+			FROM collections
+			WHERE id = $1
+			UNION ALL
+			SELECT collections.id, subtree.depth + 1
+			FROM collections
+			JOIN subtree ON collections.parent_id = subtree.id
+		)
+		SELECT images.gallery_id, images.filename
+		FROM subtree
+		JOIN galleries ON galleries.collection_id = subtree.id
+		JOIN images ON images.gallery_id = galleries.id
+		WHERE (NOT $2 OR galleries.publication_status = $3)
+			AND galleries.deleted_at IS NULL AND images.deleted_at IS NULL
+		ORDER BY subtree.depth, galleries.id, images.position, images.id
+		LIMIT 1`,
+		id, publishedOnly, Published)
+	err := row.Scan(&image.GalleryID, &image.Filename)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrImageNotFound
+		}
+		return nil, fmt.Errorf("query collection cover: %w", err)
+	}
+
+	return &image, nil
+}
+
+// Update updates the title, the parent and the visibility of the given
+// collection. ErrCollectionCycle is returned if the new parent is the
+// collection itself or one of its descendants
+func (cs *CollectionService) Update(collection *Collection) error {
+	tx, err := cs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+	defer tx.Rollback()
+
+	if collection.ParentID != 0 {
+		// The new parent must belong to the same user and must not be inside
+		// the subtree of the collection
+		var inSubtree bool
+		row := tx.QueryRow(`
+			WITH RECURSIVE subtree AS (
+				SELECT id
+				FROM collections
+				WHERE id = $1
+				UNION
+				SELECT collections.id
+				FROM collections
+				JOIN subtree ON collections.parent_id = subtree.id
+			)
+			SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`,
+			collection.ID, collection.ParentID)
+		err = row.Scan(&inSubtree)
+		if err != nil {
+			return fmt.Errorf("update collection: %w", err)
+		}
+		if inSubtree {
+			return ErrCollectionCycle
+		}
+
+		var parentUserID int
+		row = tx.QueryRow(`
+			SELECT user_id
+			FROM collections
+			WHERE id = $1`,
+			collection.ParentID)
+		err = row.Scan(&parentUserID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrInvalidCollection
+			}
+			return fmt.Errorf("update collection: %w", err)
+		}
+		if parentUserID != collection.UserID {
+			return ErrInvalidCollection
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collections
+		SET title = $2, parent_id = $3, visibility = $4
+		WHERE id = $1`,
+		collection.ID, collection.Title, nullID(collection.ParentID), collection.Visibility)
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+
+	err = refreshVisibility(tx, collection.UserID)
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+
+	return nil
+}
+
+// Delete deletes a collection by ID. The collections and galleries it contains
+// are moved to the root
+func (cs *CollectionService) Delete(collection *Collection) error {
+	tx, err := cs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM collections
+		WHERE id = $1`,
+		collection.ID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+
+	err = refreshVisibility(tx, collection.UserID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+
+	return nil
+}
+
+// SetGalleryCollection places the given gallery inside the given collection. A
+// zero collection ID moves the gallery to the root. If inherit is set, the
+// publication status of the gallery follows the one of the collection
+func (cs *CollectionService) SetGalleryCollection(gallery *Gallery, collectionID int, inherit bool) error {
+	if collectionID != 0 {
+		collection, err := cs.ByID(collectionID)
+		if err != nil {
+			return fmt.Errorf("set gallery collection: %w", err)
+		}
+		if collection.UserID != gallery.UserID {
+			return fmt.Errorf("set gallery collection: %w", ErrInvalidCollection)
+		}
+	}
+
+	tx, err := cs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("set gallery collection: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE galleries
+		SET collection_id = $2, inherit_visibility = $3, updated_at = now()
+		WHERE id = $1`,
+		gallery.ID, nullID(collectionID), inherit)
+	if err != nil {
+		return fmt.Errorf("set gallery collection: %w", err)
+	}
+
+	err = refreshVisibility(tx, gallery.UserID)
+	if err != nil {
+		return fmt.Errorf("set gallery collection: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("set gallery collection: %w", err)
+	}
+
+	gallery.CollectionID = collectionID
+	gallery.InheritVisibility = inherit
+
+	return nil
+}
+
+// refreshVisibility resolves the publication status of all collections of the
+// given user, from the roots down, and propagates it to the galleries that
+// inherit their visibility. Resolving the status when the visibility changes,
+// instead of when it is read, keeps the publication status of galleries
+// queryable as a plain column. Galleries that become published are recorded as
+// events
+func refreshVisibility(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`
+		WITH RECURSIVE tree AS (
+			SELECT id,
+				CASE WHEN visibility = $2 THEN $3 ELSE visibility END AS status
+			FROM collections
+			WHERE user_id = $1 AND parent_id IS NULL
+			UNION ALL
+			SELECT collections.id,
+				CASE WHEN collections.visibility = $2 THEN tree.status ELSE collections.visibility END
+			FROM collections
+			JOIN tree ON collections.parent_id = tree.id
+		)
+		UPDATE collections
+		SET publication_status = tree.status
+		FROM tree
+		WHERE collections.id = tree.id`,
+		userID, VisibilityInherit, Unpublished)
+	if err != nil {
+		return fmt.Errorf("refresh collections visibility: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		WITH changed AS (
+			UPDATE galleries
+			SET publication_status = collections.publication_status
+			FROM collections
+			WHERE galleries.collection_id = collections.id
+				AND galleries.inherit_visibility
+				AND galleries.user_id = $1
+				AND galleries.publication_status IS DISTINCT FROM collections.publication_status
+			RETURNING galleries.id, galleries.user_id, galleries.publication_status
+		)
+		INSERT INTO events (kind, user_id, gallery_id)
+		SELECT $2, user_id, id
+		FROM changed
+		WHERE publication_status = $3`,
+		userID, EventGalleryPublished, Published)
+	if err != nil {
+		return fmt.Errorf("refresh galleries visibility: %w", err)
+	}
+
+	return nil
+}
+
+// nullID returns nil for a zero ID so that it is stored as NULL in the
+// database
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+
+	return id
+}
+
+// scanCollections scans all rows into a slice of Collection and closes the rows
+func scanCollections(rows *sql.Rows) ([]Collection, error) {
+	defer rows.Close()
+
+	var collections []Collection
+	for rows.Next() {
+		var collection Collection
+		var parentID sql.NullInt64
+		err := rows.Scan(&collection.ID, &collection.UserID, &parentID,
+			&collection.Title, &collection.Visibility, &collection.Status,
+			&collection.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		collection.ParentID = int(parentID.Int64)
+		collections = append(collections, collection)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return collections, nil
+}
@@ -0,0 +1,417 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CommentStatus defines a new type that wraps the native string type. It
+// represents whether a comment is shown to other users
+type CommentStatus string
+
+// Defines the two comment status. Comments are pending until the owner of the
+// gallery approves them, if the gallery is moderated
+var (
+	CommentPending  CommentStatus = "pending"
+	CommentApproved CommentStatus = "approved"
+)
+
+// MaxCommentLength is the maximum length of a comment, in characters
+const MaxCommentLength = 2000
+
+// Variables related to the standards
+var (
+	// stdCommentRateLimit is the number of comments a user can post within
+	// stdCommentRateWindow
+	stdCommentRateLimit  = 5
+	stdCommentRateWindow = 10 * time.Minute
+)
+
+// Comment defines the comment model according to the `comments` SQL table
+type Comment struct {
+	ID        int
+	GalleryID int
+	// ImageID is zero for the comments on the gallery itself
+	ImageID int
+	// ParentID is zero for the comments that do not reply to another one
+	ParentID int
+	// Author is the user who wrote the comment. Only the ID, the username and
+	// the display name are set
+	Author    User
+	Body      string
+	Status    CommentStatus
+	CreatedAt time.Time
+}
+
+// CommentService defines the connection to the DB
+type CommentService struct {
+	DB *sql.DB
+	// RateLimit is the number of comments a user can post within RateWindow.
+	// If not set, the CommentService defaults to using the standard limit
+	// `stdCommentRateLimit` and window `stdCommentRateWindow`
+	RateLimit  int
+	RateWindow time.Duration
+}
+
+// Create creates a new comment by the given user on the given gallery, or on
+// its image with the given filename if it is not empty. A non-zero parent ID
+// makes the comment a reply to a comment on the same gallery or image. The
+// comment is pending if the gallery is moderated and the user is not its
+// owner
+func (service *CommentService) Create(gallery *Gallery, filename string, userID, parentID int, body string) (*Comment, error) {
+	comment := Comment{
+		GalleryID: gallery.ID,
+		ParentID:  parentID,
+		Author:    User{ID: userID},
+		Body:      strings.TrimSpace(body),
+		Status:    CommentApproved,
+	}
+	if comment.Body == "" || utf8.RuneCountInString(comment.Body) > MaxCommentLength {
+		return nil, ErrInvalidComment
+	}
+	if gallery.CommentModeration && userID != gallery.UserID {
+		comment.Status = CommentPending
+	}
+
+	blocked, err := service.isBlocked(gallery.UserID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("create comment: %w", err)
+	}
+	if blocked {
+		return nil, ErrCommenterBlocked
+	}
+
+	err = service.checkRate(userID)
+	if err != nil {
+		return nil, fmt.Errorf("create comment: %w", err)
+	}
+
+	if filename != "" {
+		row := service.DB.QueryRow(`
+			SELECT id
+			FROM images
+			WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL`,
+			gallery.ID, filename)
+		err = row.Scan(&comment.ImageID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, ErrImageNotFound
+			}
+			return nil, fmt.Errorf("create comment: %w", err)
+		}
+	}
+
+	// Replies stay in the thread of their parent
+	if parentID != 0 {
+		parent, err := service.ByID(parentID)
+		if err != nil {
+			return nil, fmt.Errorf("create comment: %w", err)
+		}
+		if parent.GalleryID != comment.GalleryID || parent.ImageID != comment.ImageID {
+			return nil, ErrInvalidComment
+		}
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO comments (gallery_id, image_id, parent_id, user_id, body, status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		comment.GalleryID, nullID(comment.ImageID), nullID(comment.ParentID),
+		userID, comment.Body, comment.Status)
+	err = row.Scan(&comment.ID, &comment.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create comment: %w", err)
+	}
+
+	return &comment, nil
+}
+
+// ByID query and returns a comment by the given ID
+func (service *CommentService) ByID(id int) (*Comment, error) {
+	comment := Comment{
+		ID: id,
+	}
+
+	var imageID, parentID sql.NullInt64
+	row := service.DB.QueryRow(`
+		SELECT comments.gallery_id, comments.image_id, comments.parent_id,
+			comments.user_id, coalesce(users.username, ''), users.display_name,
+			comments.body, comments.status, comments.created_at
+		FROM comments
+		JOIN users ON users.id = comments.user_id
+		WHERE comments.id = $1`,
+		id)
+	err := row.Scan(&comment.GalleryID, &imageID, &parentID,
+		&comment.Author.ID, &comment.Author.Username, &comment.Author.DisplayName,
+		&comment.Body, &comment.Status, &comment.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCommentNotFound
+		}
+		return nil, fmt.Errorf("query comment by id: %w", err)
+	}
+	comment.ImageID = int(imageID.Int64)
+	comment.ParentID = int(parentID.Int64)
+
+	return &comment, nil
+}
+
+// Thread returns the comments on the given gallery, or on its image with the
+// given filename if it is not empty, oldest first. Pending comments are
+// included, so that they can be shown to the owner of the gallery and to
+// their authors
+func (service *CommentService) Thread(galleryID int, filename string) ([]Comment, error) {
+	rows, err := service.DB.Query(`
+		SELECT comments.id, comments.gallery_id, comments.image_id, comments.parent_id,
+			comments.user_id, coalesce(users.username, ''), users.display_name,
+			comments.body, comments.status, comments.created_at
+		FROM comments
+		JOIN users ON users.id = comments.user_id
+		LEFT JOIN images ON images.id = comments.image_id
+		WHERE comments.gallery_id = $1
+			AND (($2 = '' AND comments.image_id IS NULL) OR images.filename = $2)
+		ORDER BY comments.created_at, comments.id`,
+		galleryID, filename)
+	if err != nil {
+		return nil, fmt.Errorf("query comment thread: %w", err)
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var comment Comment
+		var imageID, parentID sql.NullInt64
+		err = rows.Scan(&comment.ID, &comment.GalleryID, &imageID, &parentID,
+			&comment.Author.ID, &comment.Author.Username, &comment.Author.DisplayName,
+			&comment.Body, &comment.Status, &comment.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query comment thread: %w", err)
+		}
+		comment.ImageID = int(imageID.Int64)
+		comment.ParentID = int(parentID.Int64)
+		comments = append(comments, comment)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query comment thread: %w", err)
+	}
+
+	return comments, nil
+}
+
+// ImageCounts returns the number of approved comments on the images of the
+// given gallery, by filename. Images without comments are left out
+func (service *CommentService) ImageCounts(galleryID int) (map[string]int, error) {
+	rows, err := service.DB.Query(`
+		SELECT images.filename, count(*)
+		FROM comments
+		JOIN images ON images.id = comments.image_id
+		WHERE comments.gallery_id = $1 AND comments.status = $2
+		GROUP BY images.filename`,
+		galleryID, CommentApproved)
+	if err != nil {
+		return nil, fmt.Errorf("query comment counts: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var filename string
+		var count int
+		err = rows.Scan(&filename, &count)
+		if err != nil {
+			return nil, fmt.Errorf("query comment counts: %w", err)
+		}
+		counts[filename] = count
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query comment counts: %w", err)
+	}
+
+	return counts, nil
+}
+
+// Approve shows a pending comment to other users
+func (service *CommentService) Approve(id int) error {
+	_, err := service.DB.Exec(`
+		UPDATE comments
+		SET status = $2
+		WHERE id = $1`,
+		id, CommentApproved)
+	if err != nil {
+		return fmt.Errorf("approve comment: %w", err)
+	}
+
+	return nil
+}
+
+// Delete deletes a comment and the replies to it
+func (service *CommentService) Delete(id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM comments
+		WHERE id = $1`,
+		id)
+	if err != nil {
+		return fmt.Errorf("delete comment: %w", err)
+	}
+
+	return nil
+}
+
+// Block prevents the given user from commenting on the galleries of the given
+// owner. The pending comments of the user on those galleries are deleted,
+// since the owner would not approve them anyway
+func (service *CommentService) Block(ownerID, userID int) error {
+	if ownerID == userID {
+		return ErrInvalidComment
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("block commenter: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO comment_blocks (owner_id, user_id)
+		VALUES ($1, $2)
+		ON CONFLICT (owner_id, user_id) DO NOTHING`,
+		ownerID, userID)
+	if err != nil {
+		return fmt.Errorf("block commenter: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM comments
+		USING galleries
+		WHERE galleries.id = comments.gallery_id AND galleries.user_id = $1
+			AND comments.user_id = $2 AND comments.status = $3`,
+		ownerID, userID, CommentPending)
+	if err != nil {
+		return fmt.Errorf("block commenter: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("block commenter: %w", err)
+	}
+
+	return nil
+}
+
+// Unblock allows the given user to comment on the galleries of the given owner
+// again
+func (service *CommentService) Unblock(ownerID, userID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM comment_blocks
+		WHERE owner_id = $1 AND user_id = $2`,
+		ownerID, userID)
+	if err != nil {
+		return fmt.Errorf("unblock commenter: %w", err)
+	}
+
+	return nil
+}
+
+// Blocked returns the users blocked by the given owner, the most recently
+// blocked first. Only the ID, the username and the display name are set
+func (service *CommentService) Blocked(ownerID int) ([]User, error) {
+	rows, err := service.DB.Query(`
+		SELECT users.id, coalesce(users.username, ''), users.display_name
+		FROM comment_blocks
+		JOIN users ON users.id = comment_blocks.user_id
+		WHERE comment_blocks.owner_id = $1
+		ORDER BY comment_blocks.created_at DESC`,
+		ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("query blocked commenters: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.ID, &user.Username, &user.DisplayName)
+		if err != nil {
+			return nil, fmt.Errorf("query blocked commenters: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query blocked commenters: %w", err)
+	}
+
+	return users, nil
+}
+
+// SetCommentModeration defines whether the comments of other users on a
+// gallery are only shown once its owner approves them
+func (service *GalleryService) SetCommentModeration(gallery *Gallery, moderated bool) error {
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET comment_moderation = $2, updated_at = now()
+		WHERE id = $1`,
+		gallery.ID, moderated)
+	if err != nil {
+		return fmt.Errorf("set gallery comment moderation: %w", err)
+	}
+	gallery.CommentModeration = moderated
+
+	return nil
+}
+
+// isBlocked returns true if the given owner blocked the given user
+func (service *CommentService) isBlocked(ownerID, userID int) (bool, error) {
+	var blocked bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM comment_blocks
+			WHERE owner_id = $1 AND user_id = $2
+		)`,
+		ownerID, userID)
+	err := row.Scan(&blocked)
+	if err != nil {
+		return false, err
+	}
+
+	return blocked, nil
+}
+
+// checkRate returns ErrCommentRateLimited if the given user already posted as
+// many comments as allowed within the rate window
+func (service *CommentService) checkRate(userID int) error {
+	limit := service.RateLimit
+	if limit <= 0 {
+		limit = stdCommentRateLimit
+	}
+	window := service.RateWindow
+	if window <= 0 {
+		window = stdCommentRateWindow
+	}
+
+	var count int
+	row := service.DB.QueryRow(`
+		SELECT count(*)
+		FROM comments
+		WHERE user_id = $1 AND created_at > $2`,
+		userID, time.Now().Add(-window))
+	err := row.Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= limit {
+		return ErrCommentRateLimited
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"html"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -97,6 +98,32 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	return nil
 }
 
+// CommentNotification tells the owner of a gallery that the given author
+// commented on it. If the comment awaits approval, the owner is asked to
+// review it
+func (es *EmailService) CommentNotification(to, author, title, body, commentURL string, pending bool) error {
+	action := "To read it, please visit the following link:"
+	if pending {
+		action = "The comment awaits your approval. To review it, please visit the following link:"
+	}
+
+	email := Email{
+		To:        to,
+		Subject:   fmt.Sprintf("New comment on %s", title),
+		PlainText: fmt.Sprintf("%s commented on %s:\n\n%s\n\n%s %s", author, title, body, action, commentURL),
+		HTML: fmt.Sprintf(`<p>%s commented on %s:</p><blockquote>%s</blockquote><p>%s <a href="%s">%s</a></p>`,
+			html.EscapeString(author), html.EscapeString(title), html.EscapeString(body),
+			action, html.EscapeString(commentURL), html.EscapeString(commentURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("comment notification email: %w", err)
+	}
+
+	return nil
+}
+
 // setFrom sets the `from` field in an email.
 func (es *EmailService) setFrom(msg *mail.Message, email Email) {
 	var from string
@@ -17,11 +17,54 @@ var (
 	ErrInvalidUser = errors.New("models: failed to retrieve user from the database")
 	ErrInvalidPW   = errors.New("models: failed to match the password with the stored password-hash")
 
+	// PROFILE
+	ErrUsernameTaken    = errors.New("models: username is already in use")
+	ErrUsernameReserved = errors.New("models: username is reserved")
+	ErrInvalidUsername  = errors.New("models: username is not valid")
+	ErrAvatarNotFound   = errors.New("models: user has no avatar")
+
 	// GALLERY
-	ErrInvalidGallery = errors.New("models: failed to retrieve gallery from the databse")
+	ErrInvalidGallery    = errors.New("models: failed to retrieve gallery from the databse")
+	ErrInvalidLicense    = errors.New("models: unsupported license")
+	ErrInvalidResolution = errors.New("models: invalid maximum resolution")
+
+	// COLLECTION
+	ErrInvalidCollection = errors.New("models: failed to retrieve collection from the database")
+	ErrCollectionCycle   = errors.New("models: a collection can not be nested inside itself")
 
 	// IMAGE
 	ErrImageNotFound = errors.New("models: failed to query for image")
+	ErrInvalidEdit   = errors.New("models: unsupported image edit")
+	ErrInvalidSize   = errors.New("models: unsupported image size")
+	ErrSizeMissing   = errors.New("models: image size not generated")
+	ErrInvalidFormat = errors.New("models: unsupported image format")
+
+	// TRANSFORM
+	ErrInvalidTransform = errors.New("models: invalid image transformation")
+
+	// VERSION
+	ErrVersionNotFound = errors.New("models: failed to query for image version")
+
+	// WATERMARK
+	ErrInvalidWatermark = errors.New("models: invalid watermark settings")
+
+	// COMMENT
+	ErrCommentNotFound    = errors.New("models: failed to retrieve comment from the database")
+	ErrInvalidComment     = errors.New("models: invalid comment")
+	ErrCommenterBlocked   = errors.New("models: user is blocked from commenting")
+	ErrCommentRateLimited = errors.New("models: too many comments in a short time")
+
+	// PROOFING
+	ErrProofNotFound     = errors.New("models: failed to retrieve proof from the database")
+	ErrProofSubmitted    = errors.New("models: proof is already submitted")
+	ErrProofEmpty        = errors.New("models: proof has no selected images")
+	ErrProofingLimit     = errors.New("models: proof exceeds the selection limit")
+	ErrInvalidProofLimit = errors.New("models: invalid proofing limit")
+	ErrInvalidProofNote  = errors.New("models: invalid proof note")
+
+	// PAGINATION
+	ErrInvalidCursor = errors.New("models: invalid pagination cursor")
+	ErrInvalidSort   = errors.New("models: unsupported sort order")
 )
 
 // /////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// EventKind defines a new type that wraps the native string type. It
+// represents what a user did
+type EventKind string
+
+// Defines the kinds of events shown to the followers of a user
+var (
+	EventGalleryPublished EventKind = "gallery_published"
+	EventImageUploaded    EventKind = "image_uploaded"
+)
+
+// Event defines the event model according to the `events` SQL table, with the
+// gallery, the image and the user it is about
+type Event struct {
+	ID   int
+	Kind EventKind
+	// User is the user who did what the event is about. Only the ID, the
+	// username and the display name are set
+	User      User
+	GalleryID int
+	// GalleryTitle and GallerySlug are the current ones, not the ones at the
+	// time of the event
+	GalleryTitle string
+	GallerySlug  string
+	// Filename and Caption are empty for the events about a gallery as a whole
+	Filename  string
+	Caption   string
+	CreatedAt time.Time
+}
+
+// recordEvent records an event of the given kind about the given gallery, or
+// about its image with the given ID if it is not zero. The event is attributed
+// to the owner of the gallery
+func recordEvent(db *sql.DB, kind EventKind, galleryID, imageID int) error {
+	_, err := db.Exec(`
+		INSERT INTO events (kind, user_id, gallery_id, image_id)
+		SELECT $1, user_id, id, $3
+		FROM galleries
+		WHERE id = $2`,
+		kind, galleryID, nullID(imageID))
+	if err != nil {
+		return fmt.Errorf("record event: %w", err)
+	}
+
+	return nil
+}
+
+// eventSorts defines the sort orders supported by the event listings
+var eventSorts = map[SortOrder]sortSpec{
+	SortCreated: {column: "created_at", cast: "timestamptz", desc: true},
+}
+
+// Feed returns a page of the events of the users followed by the given user,
+// the most recent first. Only the events about published galleries and about
+// images outside the trash are returned
+func (service *FollowService) Feed(userID int, opts PageOptions) ([]Event, *Page, error) {
+	query := keysetQuery{
+		sorts:       eventSorts,
+		defaultSort: SortCreated,
+		columns: `id, kind, user_id, username, display_name, gallery_id, title, slug,
+			filename, caption, created_at`,
+		from: `
+			SELECT events.id, events.kind, events.user_id,
+				coalesce(users.username, '') AS username, users.display_name,
+				events.gallery_id, coalesce(galleries.title, '') AS title, galleries.slug,
+				coalesce(images.filename, '') AS filename,
+				coalesce(images.caption, '') AS caption, events.created_at
+			FROM events
+			JOIN follows ON follows.followee_id = events.user_id
+			JOIN users ON users.id = events.user_id
+			JOIN galleries ON galleries.id = events.gallery_id
+			LEFT JOIN images ON images.id = events.image_id
+			WHERE follows.follower_id = $1
+				AND galleries.publication_status = $2 AND galleries.deleted_at IS NULL
+				AND images.deleted_at IS NULL`,
+		args: []interface{}{userID, Published},
+	}
+
+	statement, args, current, err := query.build(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query feed: %w", err)
+	}
+
+	rows, err := service.DB.Query(statement, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query feed: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	var ids []int
+	var keys []string
+	for rows.Next() {
+		var event Event
+		var key string
+		err = rows.Scan(&event.ID, &event.Kind, &event.User.ID, &event.User.Username,
+			&event.User.DisplayName, &event.GalleryID, &event.GalleryTitle,
+			&event.GallerySlug, &event.Filename, &event.Caption, &event.CreatedAt, &key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("query feed: %w", err)
+		}
+
+		events = append(events, event)
+		ids = append(ids, event.ID)
+		keys = append(keys, key)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, fmt.Errorf("query feed: %w", err)
+	}
+
+	indices, page := paginate(opts, current, ids, keys)
+	result := make([]Event, 0, len(indices))
+	for _, i := range indices {
+		result = append(result, events[i])
+	}
+
+	return result, page, nil
+}
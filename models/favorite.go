@@ -0,0 +1,201 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Favorites defines how many users favorited a gallery or an image, and
+// whether the current user is one of them
+type Favorites struct {
+	Count     int
+	Favorited bool
+}
+
+// FavoriteService defines the connection to the DB
+type FavoriteService struct {
+	DB *sql.DB
+}
+
+// SetGallery favorites or unfavorites a gallery for the given user. Setting
+// the state it is already in does nothing, so that repeated requests have the
+// same effect as a single one
+func (service *FavoriteService) SetGallery(userID, galleryID int, favorite bool) error {
+	var err error
+	if favorite {
+		_, err = service.DB.Exec(`
+			INSERT INTO gallery_favorites (user_id, gallery_id)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id, gallery_id) DO NOTHING`,
+			userID, galleryID)
+	} else {
+		_, err = service.DB.Exec(`
+			DELETE FROM gallery_favorites
+			WHERE user_id = $1 AND gallery_id = $2`,
+			userID, galleryID)
+	}
+	if err != nil {
+		return fmt.Errorf("set gallery favorite: %w", err)
+	}
+
+	return nil
+}
+
+// SetImage favorites or unfavorites an image for the given user, in the same
+// way as SetGallery. Images in the trash can not be favorited
+func (service *FavoriteService) SetImage(userID, galleryID int, filename string, favorite bool) error {
+	var imageID int
+	row := service.DB.QueryRow(`
+		SELECT id
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL`,
+		galleryID, filename)
+	err := row.Scan(&imageID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrImageNotFound
+		}
+		return fmt.Errorf("set image favorite: %w", err)
+	}
+
+	if favorite {
+		_, err = service.DB.Exec(`
+			INSERT INTO image_favorites (user_id, image_id)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id, image_id) DO NOTHING`,
+			userID, imageID)
+	} else {
+		_, err = service.DB.Exec(`
+			DELETE FROM image_favorites
+			WHERE user_id = $1 AND image_id = $2`,
+			userID, imageID)
+	}
+	if err != nil {
+		return fmt.Errorf("set image favorite: %w", err)
+	}
+
+	return nil
+}
+
+// Gallery returns the favorites of the given gallery. A zero user ID stands
+// for a visitor, who has favorited nothing
+func (service *FavoriteService) Gallery(galleryID, userID int) (Favorites, error) {
+	var favorites Favorites
+	row := service.DB.QueryRow(`
+		SELECT count(*), coalesce(bool_or(user_id = $2), false)
+		FROM gallery_favorites
+		WHERE gallery_id = $1`,
+		galleryID, userID)
+	err := row.Scan(&favorites.Count, &favorites.Favorited)
+	if err != nil {
+		return Favorites{}, fmt.Errorf("query gallery favorites: %w", err)
+	}
+
+	return favorites, nil
+}
+
+// Images returns the favorites of the images of the given gallery, by
+// filename. Images that nobody favorited are left out
+func (service *FavoriteService) Images(galleryID, userID int) (map[string]Favorites, error) {
+	rows, err := service.DB.Query(`
+		SELECT images.filename, count(*), bool_or(image_favorites.user_id = $2)
+		FROM image_favorites
+		JOIN images ON images.id = image_favorites.image_id
+		WHERE images.gallery_id = $1
+		GROUP BY images.filename`,
+		galleryID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query image favorites: %w", err)
+	}
+	defer rows.Close()
+
+	favorites := make(map[string]Favorites)
+	for rows.Next() {
+		var filename string
+		var f Favorites
+		err = rows.Scan(&filename, &f.Count, &f.Favorited)
+		if err != nil {
+			return nil, fmt.Errorf("query image favorites: %w", err)
+		}
+		favorites[filename] = f
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query image favorites: %w", err)
+	}
+
+	return favorites, nil
+}
+
+// FavoriteGalleries returns the galleries favorited by the given user, the
+// most recently favorited first. Galleries that were unpublished or moved to
+// the trash since are left out, unless the user owns them
+func (service *FavoriteService) FavoriteGalleries(userID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT galleries.id, galleries.user_id, coalesce(galleries.title, '')
+		FROM gallery_favorites
+		JOIN galleries ON galleries.id = gallery_favorites.gallery_id
+		WHERE gallery_favorites.user_id = $1 AND galleries.deleted_at IS NULL
+			AND (galleries.publication_status = $2 OR galleries.user_id = $1)
+		ORDER BY gallery_favorites.created_at DESC, galleries.id DESC`,
+		userID, Published)
+	if err != nil {
+		return nil, fmt.Errorf("query favorite galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		var gallery Gallery
+		err = rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title)
+		if err != nil {
+			return nil, fmt.Errorf("query favorite galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query favorite galleries: %w", err)
+	}
+
+	return galleries, nil
+}
+
+// FavoriteImages returns the images favorited by the given user, in the same
+// order and with the same rules as FavoriteGalleries
+func (service *FavoriteService) FavoriteImages(userID int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT images.id, images.gallery_id, images.filename, images.caption
+		FROM image_favorites
+		JOIN images ON images.id = image_favorites.image_id
+		JOIN galleries ON galleries.id = images.gallery_id
+		WHERE image_favorites.user_id = $1
+			AND images.deleted_at IS NULL AND galleries.deleted_at IS NULL
+			AND (galleries.publication_status = $2 OR galleries.user_id = $1)
+		ORDER BY image_favorites.created_at DESC, images.id DESC`,
+		userID, Published)
+	if err != nil {
+		return nil, fmt.Errorf("query favorite images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		var image Image
+		err = rows.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.Caption)
+		if err != nil {
+			return nil, fmt.Errorf("query favorite images: %w", err)
+		}
+		images = append(images, image)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query favorite images: %w", err)
+	}
+
+	return images, nil
+}
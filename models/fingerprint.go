@@ -0,0 +1,139 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxFingerprints bounds the number of memoized fingerprints. The memo is
+// cleared when it is exceeded
+const maxFingerprints = 10000
+
+// fingerprint is a memoized hash of a file, valid while the modification time
+// and the size of the file are unchanged
+type fingerprint struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+var fingerprints = struct {
+	sync.Mutex
+	m map[string]fingerprint
+}{m: make(map[string]fingerprint)}
+
+// Fingerprint returns the hex encoded SHA-256 hash of the contents of the file
+// at the given path. Hashes are memoized until the file changes
+func Fingerprint(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprints.Lock()
+	memo, ok := fingerprints.m[path]
+	fingerprints.Unlock()
+	if ok && memo.modTime.Equal(info.ModTime()) && memo.size == info.Size() {
+		return memo.hash, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	fingerprints.Lock()
+	if len(fingerprints.m) >= maxFingerprints {
+		fingerprints.m = make(map[string]fingerprint)
+	}
+	fingerprints.m[path] = fingerprint{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		hash:    hash,
+	}
+	fingerprints.Unlock()
+
+	return hash, nil
+}
+
+// ImageFingerprint returns the Fingerprint of the current version of the given
+// image. It changes whenever the image is replaced, edited or reverted, and so
+// do its derived sizes and variants
+func (service *GalleryService) ImageFingerprint(galleryID int, filename string) (string, error) {
+	return Fingerprint(filepath.Join(service.galleryDir(galleryID), filepath.Base(filename)))
+}
+
+// licenses memoizes the licenses of the galleries, keyed by gallery ID, since
+// they are part of the versions of their images. The memo is kept up to date
+// whenever a gallery is queried or its rights are updated, and cleared when
+// it exceeds maxFingerprints
+var licenses = struct {
+	sync.Mutex
+	m map[int]string
+}{m: make(map[int]string)}
+
+// rememberLicense memoizes the license of the given gallery
+func rememberLicense(galleryID int, license string) {
+	licenses.Lock()
+	if len(licenses.m) >= maxFingerprints {
+		licenses.m = make(map[int]string)
+	}
+	licenses.m[galleryID] = license
+	licenses.Unlock()
+}
+
+// ImageVersion returns the version of the given image that fingerprints its
+// URLs. It is the ImageFingerprint of the image, combined with the license of
+// its gallery, so that it changes whenever the files served to other users
+// than the owner do: the license is embedded in them
+func (service *GalleryService) ImageVersion(galleryID int, filename string) (string, error) {
+	licenses.Lock()
+	license, ok := licenses.m[galleryID]
+	licenses.Unlock()
+	if !ok {
+		row := service.DB.QueryRow(`
+			SELECT license
+			FROM galleries
+			WHERE id = $1`,
+			galleryID)
+		err := row.Scan(&license)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", ErrInvalidGallery
+			}
+			return "", fmt.Errorf("image version: %w", err)
+		}
+		rememberLicense(galleryID, license)
+	}
+
+	return service.GalleryImageVersion(&Gallery{ID: galleryID, License: license}, filename)
+}
+
+// GalleryImageVersion returns the ImageVersion of the given image of the
+// given gallery, without querying its license
+func (service *GalleryService) GalleryImageVersion(gallery *Gallery, filename string) (string, error) {
+	hash, err := service.ImageFingerprint(gallery.ID, filename)
+	if err != nil || gallery.License == "" {
+		return hash, err
+	}
+
+	sum := sha256.Sum256([]byte(hash + "/" + gallery.License))
+
+	return hex.EncodeToString(sum[:]), nil
+}
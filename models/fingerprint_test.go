@@ -0,0 +1,51 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.png")
+	err := os.WriteFile(path, []byte("first"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := Fingerprint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Fingerprint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != again {
+		t.Errorf("Fingerprint changed from %s to %s for the same file", first, again)
+	}
+
+	// The memo is invalidated when the file changes
+	err = os.WriteFile(path, []byte("second"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Fingerprint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Errorf("Fingerprint = %s did not change with the contents", second)
+	}
+
+	_, err = Fingerprint(filepath.Join(t.TempDir(), "missing.png"))
+	if err == nil {
+		t.Error("Fingerprint of a missing file succeeded")
+	}
+}
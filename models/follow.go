@@ -0,0 +1,70 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Follows defines how many users follow a user and how many users they
+// follow, and whether the current user follows them
+type Follows struct {
+	Followers int
+	Following int
+	Followed  bool
+}
+
+// FollowService defines the connection to the DB
+type FollowService struct {
+	DB *sql.DB
+}
+
+// Follow makes the given follower follow the given followee, so that the
+// events of the followee show in the feed of the follower. Following a user
+// who is already followed does nothing. Users can not follow themselves
+func (service *FollowService) Follow(followerID, followeeID int) error {
+	if followerID == followeeID {
+		return ErrInvalidUser
+	}
+
+	_, err := service.DB.Exec(`
+		INSERT INTO follows (follower_id, followee_id)
+		VALUES ($1, $2)
+		ON CONFLICT (follower_id, followee_id) DO NOTHING`,
+		followerID, followeeID)
+	if err != nil {
+		return fmt.Errorf("follow user: %w", err)
+	}
+
+	return nil
+}
+
+// Unfollow stops the given follower from following the given followee
+func (service *FollowService) Unfollow(followerID, followeeID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM follows
+		WHERE follower_id = $1 AND followee_id = $2`,
+		followerID, followeeID)
+	if err != nil {
+		return fmt.Errorf("unfollow user: %w", err)
+	}
+
+	return nil
+}
+
+// Counts returns the follows of the given user. A zero viewer ID stands for a
+// visitor, who follows nobody
+func (service *FollowService) Counts(userID, viewerID int) (Follows, error) {
+	var follows Follows
+	row := service.DB.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM follows WHERE followee_id = $1),
+			(SELECT count(*) FROM follows WHERE follower_id = $1),
+			EXISTS (SELECT 1 FROM follows WHERE follower_id = $2 AND followee_id = $1)`,
+		userID, viewerID)
+	err := row.Scan(&follows.Followers, &follows.Following, &follows.Followed)
+	if err != nil {
+		return Follows{}, fmt.Errorf("query follows: %w", err)
+	}
+
+	return follows, nil
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ImageFormat defines a modern image format into which images are converted,
+// so that browsers that support it download smaller files
+type ImageFormat struct {
+	Name      string
+	MediaType string
+}
+
+// modernFormats lists the modern formats, most preferred first. Only those
+// with a registered encoder are used
+var modernFormats = []ImageFormat{
+	{Name: "webp", MediaType: "image/webp"},
+}
+
+// formatEncoder encodes an image with the given quality, from 1 to 100
+type formatEncoder func(w io.Writer, img image.Image, quality int) error
+
+// formatEncoders holds the encoders of the modern formats, keyed by the format
+// name. Encoders are registered by the files that provide them, since some
+// depend on build constraints
+var formatEncoders = make(map[string]formatEncoder)
+
+// variantsDir is the directory inside the directory of a gallery that holds
+// the images converted to the modern formats
+const variantsDir = ".formats"
+
+// fullSize is the name used for the current version of an image, as opposed to
+// its derived sizes, in the paths of the variants
+const fullSize = "full"
+
+// ModernFormats returns the modern formats into which images can be converted,
+// most preferred first
+func ModernFormats() []ImageFormat {
+	var formats []ImageFormat
+	for _, format := range modernFormats {
+		if formatEncoders[format.Name] != nil {
+			formats = append(formats, format)
+		}
+	}
+
+	return formats
+}
+
+// VariantPath returns the path of the given image converted to the given
+// modern format. The size is one of the ImageSizes, or empty for the current
+// version. The variant is generated if it does not exist yet or if it is older
+// than the image. GIF images are not converted, so that their animation is
+// kept, and the path of the image itself is returned
+func (service *GalleryService) VariantPath(galleryID int, filename, size, format string) (string, error) {
+	img, err := service.Image(galleryID, filename)
+	if err != nil {
+		return "", err
+	}
+	if formatEncoders[format] == nil {
+		return "", ErrInvalidFormat
+	}
+
+	src := img.Path
+	if size != "" {
+		src, err = service.SizePath(galleryID, filename, size)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !convertible(filename) {
+		return src, nil
+	}
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", fmt.Errorf("variant path: %w", err)
+	}
+	path := service.variantPath(galleryID, filename, size, format)
+	info, err := os.Stat(path)
+	if err == nil && !info.ModTime().Before(srcInfo.ModTime()) {
+		return path, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("variant path: %w", err)
+	}
+
+	err = service.generateVariant(src, path)
+	if err != nil {
+		return "", fmt.Errorf("variant path: %w", err)
+	}
+
+	return path, nil
+}
+
+// generateVariants converts the current version and the derived sizes of the
+// given image to every modern format
+func (service *GalleryService) generateVariants(galleryID int, filename string) error {
+	if !convertible(filename) {
+		return nil
+	}
+
+	sources := map[string]string{
+		"": filepath.Join(service.galleryDir(galleryID), filename),
+	}
+	for _, size := range ImageSizes {
+		sources[size.Name] = service.sizePath(galleryID, filename, size.Name)
+	}
+
+	for size, src := range sources {
+		for _, format := range ModernFormats() {
+			err := service.generateVariant(src, service.variantPath(galleryID, filename, size, format.Name))
+			if err != nil {
+				return fmt.Errorf("generate variants: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// generateVariant converts the image at src to the format given by the
+// extension of dst
+func (service *GalleryService) generateVariant(src, dst string) error {
+	img, err := imaging.Open(src)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	return saveImage(dst, img, 0)
+}
+
+// variantPath returns the path of the given image converted to the given
+// format. The size is one of the ImageSizes, or empty for the current version
+func (service *GalleryService) variantPath(galleryID int, filename, size, format string) string {
+	if size == "" {
+		size = fullSize
+	}
+
+	return filepath.Join(service.galleryDir(galleryID), variantsDir, format, size, filename+"."+format)
+}
+
+// variantPaths returns the paths of the given image converted to every modern
+// format, for the current version and each derived size
+func (service *GalleryService) variantPaths(galleryID int, filename string) []string {
+	var paths []string
+	for _, format := range ModernFormats() {
+		paths = append(paths, service.variantPath(galleryID, filename, "", format.Name))
+		for _, size := range ImageSizes {
+			paths = append(paths, service.variantPath(galleryID, filename, size.Name, format.Name))
+		}
+	}
+
+	return paths
+}
+
+// convertible returns true if the image with the given filename is converted to
+// the modern formats. GIF images are not, since their animation would be lost
+func convertible(filename string) bool {
+	return strings.ToLower(filepath.Ext(filename)) != ".gif"
+}
+
+// encodeModern encodes the given image to w in the given modern format. It
+// returns false if the format is not a modern one
+func encodeModern(w io.Writer, img image.Image, format string, quality int) (bool, error) {
+	encode := formatEncoders[format]
+	if encode == nil {
+		return false, nil
+	}
+
+	return true, encode(w, img, quality)
+}
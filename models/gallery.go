@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // PublicationStatus defines a new type that wraps the native string type. It
@@ -31,17 +32,69 @@ var (
 
 // Gallery defines the gallery model according to the `gallery` SQL table
 type Gallery struct {
-	ID     int
-	UserID int
-	Title  string
-	Status PublicationStatus
+	ID          int
+	UserID      int
+	Title       string
+	Description string
+	Status      PublicationStatus
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// Slug identifies the gallery among the galleries of its user in the URL
+	// of the public profile
+	Slug string
+	// CollectionID is zero for galleries that are not inside a collection
+	CollectionID int
+	// InheritVisibility defines whether the publication status of the gallery
+	// follows the one of its collection
+	InheritVisibility bool
+	// Watermark defines whether the watermark of the owner is applied to the
+	// images shown to other users
+	Watermark bool
+	// AllowDownload defines whether other users can download the originals.
+	// If not, they are served the largest derived size instead
+	AllowDownload bool
+	// MaxResolution is the longest side, in pixels, of the images served to
+	// other users, or zero for no limit
+	MaxResolution int
+	// License is the ID of one of the Licenses, or empty if the gallery
+	// states no license
+	License string
+	// PublicLocation defines whether other users can see where the images
+	// were taken
+	PublicLocation bool
+	// CommentModeration defines whether the comments of other users are only
+	// shown once the owner approves them
+	CommentModeration bool
+	// Proofing defines whether viewers can select images and submit their
+	// selection, of at most ProofingLimit images unless it is zero.
+	// ProofingToken is the token of the share link, which gives access to the
+	// gallery while proofing is on. It is empty until the owner creates one
+	Proofing      bool
+	ProofingLimit int
+	ProofingToken string
+	// ImageCount is only set by the gallery listings
+	ImageCount int
+	// DeletedAt is only set for galleries in the trash
+	DeletedAt time.Time
 }
 
 // Image defines a new type to represent an Image
 type Image struct {
+	ID        int
 	GalleryID int
 	Path      string
 	Filename  string
+	Caption   string
+	Position  int
+	CreatedAt time.Time
+	// DeletedAt is only set for images in the trash
+	DeletedAt time.Time
+	// Dimensions and placeholder of the current version, which are zero
+	// until computed. Color is the dominant color, such as #a0b1c2
+	Width    int
+	Height   int
+	BlurHash string
+	Color    string
 }
 
 // GalleryService defines available services
@@ -60,6 +113,10 @@ type GalleryService struct {
 	// GalleryService defaults to using the standard image content types
 	// `stdImagesCont`
 	ImagesCont []string
+	// TrashRetention defines how long galleries and images stay in the trash
+	// before they are purged. If not set, the GalleryService defaults to using
+	// the standard retention period `stdTrashRetention`
+	TrashRetention time.Duration
 }
 
 // Create creates a new gallery with the given title, publication status and
@@ -71,12 +128,18 @@ func (service *GalleryService) Create(title string, status PublicationStatus, us
 		Status: status,
 	}
 
+	slug, err := uniqueSlug(service.DB, userID, title, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	gallery.Slug = slug
+
 	row := service.DB.QueryRow(`
-		INSERT INTO galleries (title, publication_status, user_id)
-		VALUES ($1, $2, $3) RETURNING id`,
-		title, status, userID)
+		INSERT INTO galleries (title, slug, publication_status, user_id)
+		VALUES ($1, $2, $3, $4) RETURNING id`,
+		title, slug, status, userID)
 
-	err := row.Scan(&gallery.ID)
+	err = row.Scan(&gallery.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
 	}
@@ -84,71 +147,248 @@ func (service *GalleryService) Create(title string, status PublicationStatus, us
 	return &gallery, nil
 }
 
-// ByID query and returns a gallery by the given ID
+// ByID query and returns a gallery by the given ID. Galleries in the trash are
+// not returned
 func (service *GalleryService) ByID(id int) (*Gallery, error) {
+	return service.byID(id, false)
+}
+
+// byID query and returns a gallery by the given ID, either outside or inside
+// the trash
+func (service *GalleryService) byID(id int, trashed bool) (*Gallery, error) {
 	gallery := Gallery{
 		ID: id,
 	}
 
+	var collectionID sql.NullInt64
+	var deletedAt sql.NullTime
 	row := service.DB.QueryRow(`
-		SELECT title, publication_status, user_id
+		SELECT coalesce(title, ''), slug, description, publication_status, user_id,
+			created_at, updated_at, collection_id, inherit_visibility, watermark,
+			allow_download, max_resolution, license, public_location,
+			comment_moderation, proofing, proofing_limit,
+			coalesce(proofing_token, ''), deleted_at
 		FROM galleries
-		WHERE id = $1`,
-		id)
-
-	err := row.Scan(&gallery.Title, &gallery.Status, &gallery.UserID)
+		WHERE id = $1 AND (deleted_at IS NOT NULL) = $2`,
+		id, trashed)
+
+	err := row.Scan(&gallery.Title, &gallery.Slug, &gallery.Description, &gallery.Status,
+		&gallery.UserID, &gallery.CreatedAt, &gallery.UpdatedAt,
+		&collectionID, &gallery.InheritVisibility, &gallery.Watermark,
+		&gallery.AllowDownload, &gallery.MaxResolution, &gallery.License,
+		&gallery.PublicLocation, &gallery.CommentModeration, &gallery.Proofing,
+		&gallery.ProofingLimit, &gallery.ProofingToken, &deletedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrInvalidGallery
 		}
 		return nil, fmt.Errorf("query gallery by id: %w", err)
 	}
+	gallery.CollectionID = int(collectionID.Int64)
+	gallery.DeletedAt = deletedAt.Time
+	rememberLicense(gallery.ID, gallery.License)
 
 	return &gallery, nil
 }
 
-// ByUserID query and returns all galleries associated with a user ID
-func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
-	rows, err := service.DB.Query(`
-		SELECT id, title, publication_status
+// BySlug query and returns the gallery of the given user with the given slug
+func (service *GalleryService) BySlug(userID int, slug string) (*Gallery, error) {
+	var id int
+	row := service.DB.QueryRow(`
+		SELECT id
 		FROM galleries
-		WHERE user_id = $1`,
-		userID)
+		WHERE user_id = $1 AND slug = $2 AND deleted_at IS NULL`,
+		userID, slug)
+	err := row.Scan(&id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrInvalidGallery
 		}
-		return nil, fmt.Errorf("query galleries by user id: %w", err)
+		return nil, fmt.Errorf("query gallery by slug: %w", err)
+	}
+
+	return service.ByID(id)
+}
+
+// gallerySorts defines the sort orders supported by the gallery listings
+var gallerySorts = map[SortOrder]sortSpec{
+	SortCreated:    {column: "created_at", cast: "timestamptz", desc: true},
+	SortUpdated:    {column: "updated_at", cast: "timestamptz", desc: true},
+	SortTitle:      {column: "coalesce(lower(title), '')", cast: "text", desc: false},
+	SortImageCount: {column: "image_count", cast: "int", desc: true},
+}
+
+// ByUserID query and returns a page of the galleries associated with a user ID
+func (service *GalleryService) ByUserID(userID int, opts PageOptions) ([]Gallery, *Page, error) {
+	galleries, page, err := galleriesPage(service.DB, `
+		SELECT galleries.*
+		FROM galleries
+		WHERE user_id = $1 AND deleted_at IS NULL`,
+		[]interface{}{userID}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query galleries by user id: %w", err)
+	}
+
+	return galleries, page, nil
+}
+
+// PublishedByUserID query and returns a page of the published galleries
+// associated with a user ID
+func (service *GalleryService) PublishedByUserID(userID int, opts PageOptions) ([]Gallery, *Page, error) {
+	galleries, page, err := galleriesPage(service.DB, `
+		SELECT galleries.*
+		FROM galleries
+		WHERE user_id = $1 AND publication_status = $2 AND deleted_at IS NULL`,
+		[]interface{}{userID, Published}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query published galleries by user id: %w", err)
+	}
+
+	return galleries, page, nil
+}
+
+// Published query and returns a page of the published galleries of all users
+func (service *GalleryService) Published(opts PageOptions) ([]Gallery, *Page, error) {
+	galleries, page, err := galleriesPage(service.DB, `
+		SELECT galleries.*
+		FROM galleries
+		WHERE publication_status = $1 AND deleted_at IS NULL`,
+		[]interface{}{Published}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query published galleries: %w", err)
+	}
+
+	return galleries, page, nil
+}
+
+// Editable returns all galleries outside the trash that the given user can
+// edit, sorted by title. Only the ID and the title of the galleries are set
+func (service *GalleryService) Editable(userID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, coalesce(title, '')
+		FROM galleries
+		WHERE user_id = $1 AND deleted_at IS NULL
+		ORDER BY lower(title), id`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("query editable galleries: %w", err)
 	}
+	defer rows.Close()
 
 	var galleries []Gallery
 	for rows.Next() {
 		gallery := Gallery{
 			UserID: userID,
 		}
+		err = rows.Scan(&gallery.ID, &gallery.Title)
+		if err != nil {
+			return nil, fmt.Errorf("query editable galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query editable galleries: %w", err)
+	}
+
+	return galleries, nil
+}
+
+// ByUserIDAndTag query and returns a page of the galleries associated with a
+// user ID that are tagged with the given tag
+func (service *GalleryService) ByUserIDAndTag(userID int, tag string, opts PageOptions) ([]Gallery, *Page, error) {
+	galleries, page, err := galleriesPage(service.DB, `
+		SELECT galleries.*
+		FROM galleries
+		JOIN gallery_tags ON gallery_tags.gallery_id = galleries.id
+		JOIN tags ON tags.id = gallery_tags.tag_id
+		WHERE galleries.user_id = $1 AND tags.name = $2
+			AND galleries.deleted_at IS NULL`,
+		[]interface{}{userID, normalizeTag(tag)}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query galleries by user id and tag: %w", err)
+	}
+
+	return galleries, page, nil
+}
 
-		err = rows.Scan(&gallery.ID, &gallery.Title, &gallery.Status)
+// galleriesPage selects a page of the galleries returned by the given query.
+// The query must select whole rows of the `galleries` table
+func galleriesPage(db *sql.DB, from string, args []interface{}, opts PageOptions) ([]Gallery, *Page, error) {
+	query := keysetQuery{
+		sorts:       gallerySorts,
+		defaultSort: SortCreated,
+		columns:     "id, user_id, coalesce(title, ''), slug, description, publication_status, created_at, updated_at, image_count",
+		from: `
+			SELECT filtered.*, (
+				SELECT COUNT(*)
+				FROM images
+				WHERE images.gallery_id = filtered.id
+					AND images.deleted_at IS NULL) AS image_count
+			FROM (` + from + `) AS filtered`,
+		args: args,
+	}
+
+	statement, statementArgs, current, err := query.build(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.Query(statement, statementArgs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	var ids []int
+	var keys []string
+	for rows.Next() {
+		var gallery Gallery
+		var key string
+		err = rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title,
+			&gallery.Slug, &gallery.Description, &gallery.Status, &gallery.CreatedAt,
+			&gallery.UpdatedAt, &gallery.ImageCount, &key)
 		if err != nil {
-			return nil, fmt.Errorf("query galleries by user id: %w", err)
+			return nil, nil, err
 		}
 
 		galleries = append(galleries, gallery)
+		ids = append(ids, gallery.ID)
+		keys = append(keys, key)
 	}
 
-	if rows.Err() != nil {
-		return nil, fmt.Errorf("query galleries by user id: %w", err)
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return galleries, nil
+	indices, page := paginate(opts, current, ids, keys)
+	result := make([]Gallery, 0, len(indices))
+	for _, i := range indices {
+		result = append(result, galleries[i])
+	}
+
+	return result, page, nil
 }
 
-// Update updates the provided gallery
+// Update updates the provided gallery. The slug follows the title, unless the
+// current slug was already derived from it
 func (service *GalleryService) Update(gallery *Gallery) error {
+	if !slugMatches(gallery.Slug, gallery.Title) {
+		slug, err := uniqueSlug(service.DB, gallery.UserID, gallery.Title, gallery.ID)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		gallery.Slug = slug
+	}
+
 	_, err := service.DB.Exec(`
 		UPDATE galleries
-		SET title = $2
+		SET title = $2, slug = $3, description = $4, updated_at = now()
 		WHERE id = $1`,
-		gallery.ID, gallery.Title)
+		gallery.ID, gallery.Title, gallery.Slug, gallery.Description)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
@@ -157,30 +397,39 @@ func (service *GalleryService) Update(gallery *Gallery) error {
 }
 
 // Publish changes the publication status of a gallery from unpublished to
-// publish
+// publish. This overrides the visibility inherited from a collection, if any.
+// Publishing an unpublished gallery is recorded as an event
 func (service *GalleryService) Publish(gallery *Gallery) error {
 	newStatus := "published"
 
 	_, err := service.DB.Exec(`
 		UPDATE galleries
-		SET publication_status = $2
+		SET publication_status = $2, inherit_visibility = false, updated_at = now()
 		WHERE id = $1`,
 		gallery.ID, newStatus)
 	if err != nil {
 		return fmt.Errorf("publish gallery: %w", err)
 	}
 
+	if gallery.Status != Published {
+		err = recordEvent(service.DB, EventGalleryPublished, gallery.ID, 0)
+		if err != nil {
+			return fmt.Errorf("publish gallery: %w", err)
+		}
+	}
+	gallery.Status = Published
+
 	return nil
 }
 
 // Unpublish changes the publication status of a gallery from published to
-// unpublish
+// unpublish. This overrides the visibility inherited from a collection, if any
 func (service *GalleryService) Unpublish(gallery *Gallery) error {
 	newStatus := "unpublished"
 
 	_, err := service.DB.Exec(`
 		UPDATE galleries
-		SET publication_status = $2
+		SET publication_status = $2, inherit_visibility = false, updated_at = now()
 		WHERE id = $1`,
 		gallery.ID, newStatus)
 	if err != nil {
@@ -190,21 +439,61 @@ func (service *GalleryService) Unpublish(gallery *Gallery) error {
 	return nil
 }
 
-// Delete deletes a gallery by ID
-func (service *GalleryService) Delete(id int) error {
+// SetWatermark enables or disables the watermark on the images of a gallery
+func (service *GalleryService) SetWatermark(gallery *Gallery, enabled bool) error {
 	_, err := service.DB.Exec(`
-		DELETE FROM galleries
+		UPDATE galleries
+		SET watermark = $2, updated_at = now()
 		WHERE id = $1`,
-		id)
+		gallery.ID, enabled)
 	if err != nil {
-		return fmt.Errorf("delete gallery: %w", err)
+		return fmt.Errorf("set gallery watermark: %w", err)
+	}
+	gallery.Watermark = enabled
+
+	return nil
+}
+
+// MinResolution is the smallest maximum resolution of a gallery, so that its
+// images remain recognizable
+const MinResolution = 200
+
+// UpdateRights updates whether the originals of the given gallery can be
+// downloaded by other users, the maximum resolution of the images served to
+// them, and the license of the gallery. It returns ErrInvalidResolution or
+// ErrInvalidLicense if they are not valid
+func (service *GalleryService) UpdateRights(gallery *Gallery) error {
+	if gallery.MaxResolution != 0 &&
+		(gallery.MaxResolution < MinResolution || gallery.MaxResolution > MaxTransformSide) {
+		return ErrInvalidResolution
+	}
+	if _, ok := LicenseByID(gallery.License); gallery.License != "" && !ok {
+		return ErrInvalidLicense
 	}
 
-	// Deletes the folder in which the images are stored
-	dir := service.galleryDir(id)
-	err = os.RemoveAll(dir)
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET allow_download = $2, max_resolution = $3, license = $4, updated_at = now()
+		WHERE id = $1`,
+		gallery.ID, gallery.AllowDownload, gallery.MaxResolution, gallery.License)
 	if err != nil {
-		return fmt.Errorf("delete gallery folder and images: %w", err)
+		return fmt.Errorf("update gallery rights: %w", err)
+	}
+	rememberLicense(gallery.ID, gallery.License)
+
+	return nil
+}
+
+// Delete moves a gallery to the trash by ID. Its images are kept in storage
+// until the gallery is purged
+func (service *GalleryService) Delete(id int) error {
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL`,
+		id)
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
 	}
 
 	return nil
@@ -248,8 +537,149 @@ func (service *GalleryService) contentTypes() []string {
 	return imagesCont
 }
 
-// Images returns a slice of Image in the given gallery.
-func (service *GalleryService) Images(galleryID int) ([]Image, error) {
+// imageSorts defines the sort orders supported by the image listings
+var imageSorts = map[SortOrder]sortSpec{
+	SortPosition: {column: "position", cast: "int", desc: false},
+	SortCreated:  {column: "created_at", cast: "timestamptz", desc: true},
+	SortTitle:    {column: "lower(filename)", cast: "text", desc: false},
+}
+
+// Images returns a page of the images in the given gallery. Images are sorted
+// by position by default
+func (service *GalleryService) Images(galleryID int, opts PageOptions) ([]Image, *Page, error) {
+	if opts.Sort == "" {
+		opts.Sort = SortPosition
+	}
+
+	images, page, err := imagesPage(service.DB, `
+		SELECT *
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL`,
+		[]interface{}{galleryID}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("retrieving images from gallery %d: %w", galleryID, err)
+	}
+
+	galleryDir := service.galleryDir(galleryID)
+	for i := range images {
+		images[i].Path = filepath.Join(galleryDir, images[i].Filename)
+	}
+
+	return images, page, nil
+}
+
+// imageColumns are the columns selected by imagesPage, in the order scanned
+const imageColumns = `id, gallery_id, filename, caption, position, created_at,
+	coalesce(width, 0), coalesce(height, 0), coalesce(blurhash, ''),
+	coalesce(dominant_color, '')`
+
+// imagesPage selects a page of the images returned by the given query. The
+// query must select whole rows of the `images` table. Images are sorted by
+// creation date by default. The Path of the images is not set
+func imagesPage(db *sql.DB, from string, args []interface{}, opts PageOptions) ([]Image, *Page, error) {
+	query := keysetQuery{
+		sorts:       imageSorts,
+		defaultSort: SortCreated,
+		columns:     imageColumns,
+		from:        from,
+		args:        args,
+	}
+
+	statement, statementArgs, current, err := query.build(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.Query(statement, statementArgs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var images []Image
+	var ids []int
+	var keys []string
+	for rows.Next() {
+		var image Image
+		var key string
+		err = rows.Scan(&image.ID, &image.GalleryID, &image.Filename,
+			&image.Caption, &image.Position, &image.CreatedAt, &image.Width,
+			&image.Height, &image.BlurHash, &image.Color, &key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		images = append(images, image)
+		ids = append(ids, image.ID)
+		keys = append(keys, key)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indices, page := paginate(opts, current, ids, keys)
+	result := make([]Image, 0, len(indices))
+	for _, i := range indices {
+		result = append(result, images[i])
+	}
+
+	return result, page, nil
+}
+
+// OrderedImages returns all images outside the trash in the given gallery,
+// sorted by position, such as for a slideshow. The Path of the images is not
+// set
+func (service *GalleryService) OrderedImages(galleryID int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL
+		ORDER BY position, id`,
+		galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query ordered images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		var image Image
+		err = rows.Scan(&image.ID, &image.GalleryID, &image.Filename,
+			&image.Caption, &image.Position, &image.CreatedAt, &image.Width,
+			&image.Height, &image.BlurHash, &image.Color)
+		if err != nil {
+			return nil, fmt.Errorf("query ordered images: %w", err)
+		}
+		images = append(images, image)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query ordered images: %w", err)
+	}
+
+	return images, nil
+}
+
+// Cover returns the image used as the cover of the given gallery, which is its
+// first image. ErrImageNotFound is returned if the gallery has no images
+func (service *GalleryService) Cover(galleryID int) (*Image, error) {
+	images, _, err := service.Images(galleryID, PageOptions{Limit: 1})
+	if err != nil {
+		return nil, fmt.Errorf("query gallery cover: %w", err)
+	}
+	if len(images) == 0 {
+		return nil, ErrImageNotFound
+	}
+
+	return &images[0], nil
+}
+
+// imageFiles returns the filenames of the image files stored in the directory
+// of the given gallery
+func (service *GalleryService) imageFiles(galleryID int) ([]string, error) {
 	// Firstly, the directory of the given gallery is retrieved. Secondly, a
 	// glob pattern is constructed so that all files inside the directory are
 	// returned. Thirdly, the extension of each file is checked to confirm if
@@ -259,23 +689,19 @@ func (service *GalleryService) Images(galleryID int) ([]Image, error) {
 	globPattern := filepath.Join(galleryDir, "*")
 	allFiles, err := filepath.Glob(globPattern)
 	if err != nil {
-		return nil, fmt.Errorf("retrieving images from gallery %d: %w", galleryID, err)
+		return nil, fmt.Errorf("retrieving image files from gallery %d: %w", galleryID, err)
 	}
 
-	var images []Image
+	var filenames []string
 	supportedExt := service.extensions()
 	for _, file := range allFiles {
 		fileIsImage := hasExtension(file, supportedExt)
 		if fileIsImage {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+			filenames = append(filenames, filepath.Base(file))
 		}
 	}
 
-	return images, nil
+	return filenames, nil
 }
 
 // Image returns the image defined by the given filename and given gallery. An
@@ -297,6 +723,23 @@ func (service *GalleryService) Image(galleryID int, filename string) (Image, err
 		GalleryID: galleryID,
 		Path:      imagePath,
 	}
+
+	row := service.DB.QueryRow(`
+		SELECT id, caption, position, created_at, coalesce(width, 0),
+			coalesce(height, 0), coalesce(blurhash, ''), coalesce(dominant_color, '')
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL
+			AND gallery_id IN (SELECT id FROM galleries WHERE deleted_at IS NULL)`,
+		galleryID, filename)
+	err = row.Scan(&image.ID, &image.Caption, &image.Position, &image.CreatedAt,
+		&image.Width, &image.Height, &image.BlurHash, &image.Color)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrImageNotFound
+		}
+		return Image{}, fmt.Errorf("querying for image: %w", err)
+	}
+
 	return image, nil
 }
 
@@ -322,35 +765,230 @@ func (service *GalleryService) CreateImage(galleryID int, filename string, conte
 		return fmt.Errorf("creating gallery-%d image directory: %w", galleryID, err)
 	}
 
+	// An image in the trash keeps its files until it is purged, so an upload
+	// with its filename is stored under another one
+	stored, err := service.uploadFilename(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	filename = stored
+
+	// Keeps the current file of an image with the same filename as a version
+	// before it is overwritten
+	err = service.ensureVersion(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
 	// Creates the image file
 	imagePath := filepath.Join(galleryDir, filename)
 	dst, err := os.Create(imagePath)
 	if err != nil {
 		return fmt.Errorf("creating image file: %w", err)
 	}
-	defer dst.Close()
-
 	_, err = io.Copy(dst, contents)
 	if err != nil {
+		dst.Close()
 		return fmt.Errorf("copying contents to image: %w", err)
 	}
+	err = dst.Close()
+	if err != nil {
+		return fmt.Errorf("creating image file: %w", err)
+	}
+
+	// Keeps the upload as the original, fixes the orientation of the image
+	// and generates its derived sizes
+	err = service.processUpload(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("processing image %v: %w", filename, err)
+	}
+
+	// Keeps track of the image in the database so that metadata, such as
+	// tags, can be associated with it. Uploading an image with the same
+	// filename replaces the file, but keeps its metadata
+	created, err := service.insertImage(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	image, err := service.Image(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = service.recordVersion(image, VersionUpload)
+	if err != nil {
+		return fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	// Replacing an image is not news to the followers of the user
+	if created {
+		err = recordEvent(service.DB, EventImageUploaded, galleryID, image.ID)
+		if err != nil {
+			return fmt.Errorf("creating image %v: %w", filename, err)
+		}
+	}
+
+	err = service.updatePlaceholder(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	err = service.updateLocation(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("creating image %v: %w", filename, err)
+	}
 
 	return nil
 }
 
-// DeleteImage deletes the image defined by the given gallery ID and filename.
-// It returnns nil if the image is successfully deleted, or an error otherwise
+// uploadFilename returns the filename under which an upload with the given
+// filename is stored. An upload replaces the image with the same filename,
+// unless that image is in the trash: a numeric suffix is then added instead
+func (service *GalleryService) uploadFilename(galleryID int, filename string) (string, error) {
+	var trashed bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM images
+			WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NOT NULL)`,
+		galleryID, filename)
+	err := row.Scan(&trashed)
+	if err != nil {
+		return "", fmt.Errorf("upload filename: %w", err)
+	}
+	if !trashed {
+		return filename, nil
+	}
+
+	filename, err = availableFilename(service.DB, galleryID, service.galleryDir(galleryID), filename)
+	if err != nil {
+		return "", fmt.Errorf("upload filename: %w", err)
+	}
+
+	return filename, nil
+}
+
+// insertImage records the given image in the database, after the last image of
+// its gallery, and touches the gallery. It does nothing if the image is
+// already recorded, and returns true only if it was not
+func (service *GalleryService) insertImage(galleryID int, filename string) (bool, error) {
+	result, err := service.DB.Exec(`
+		INSERT INTO images (gallery_id, filename, position)
+		SELECT $1, $2, coalesce(MAX(position), 0) + 1
+		FROM images
+		WHERE gallery_id = $1
+		ON CONFLICT DO NOTHING`,
+		galleryID, filename)
+	if err != nil {
+		return false, fmt.Errorf("insert image: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("insert image: %w", err)
+	}
+	if inserted == 0 {
+		return false, nil
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE galleries
+		SET updated_at = now()
+		WHERE id = $1`,
+		galleryID)
+	if err != nil {
+		return false, fmt.Errorf("insert image: %w", err)
+	}
+
+	return true, nil
+}
+
+// UpdateImage updates the caption of the given image
+func (service *GalleryService) UpdateImage(image *Image) error {
+	_, err := service.DB.Exec(`
+		UPDATE images
+		SET caption = $2
+		WHERE id = $1`,
+		image.ID, image.Caption)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteImage moves the image defined by the given gallery ID and filename to
+// the trash. Its file is kept in storage until the image is purged. It returnns
+// nil if the image is successfully deleted, or an error otherwise
 func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
 	image, err := service.Image(galleryID, filename)
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
 
-	err = os.Remove(image.Path)
+	_, err = service.DB.Exec(`
+		UPDATE images
+		SET deleted_at = now()
+		WHERE id = $1`,
+		image.ID)
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
 
+	_, err = service.DB.Exec(`
+		UPDATE galleries
+		SET updated_at = now()
+		WHERE id = $1`,
+		galleryID)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+
+	return nil
+}
+
+// SyncImages records in the database every image stored in the images
+// directory that is not tracked yet. This is necessary for images that were
+// uploaded before images were tracked in the database. Directories of
+// galleries that no longer exist are ignored
+func (service *GalleryService) SyncImages() error {
+	imagesDir := service.ImagesDir
+	if imagesDir == "" {
+		imagesDir = stdImagesDir
+	}
+
+	galleryDirs, err := filepath.Glob(filepath.Join(imagesDir, "gallery-*"))
+	if err != nil {
+		return fmt.Errorf("sync images: %w", err)
+	}
+
+	for _, dir := range galleryDirs {
+		var galleryID int
+		_, err = fmt.Sscanf(filepath.Base(dir), "gallery-%d", &galleryID)
+		if err != nil {
+			continue
+		}
+
+		_, err = service.ByID(galleryID)
+		if err != nil {
+			if errors.Is(err, ErrInvalidGallery) {
+				continue
+			}
+			return fmt.Errorf("sync images: %w", err)
+		}
+
+		filenames, err := service.imageFiles(galleryID)
+		if err != nil {
+			return fmt.Errorf("sync images: %w", err)
+		}
+
+		for _, filename := range filenames {
+			_, err = service.insertImage(galleryID, filename)
+			if err != nil {
+				return fmt.Errorf("sync images: %w", err)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,298 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ImageLocation defines where an image was taken, as given by the GPS
+// coordinates in its EXIF metadata
+type ImageLocation struct {
+	GalleryID int
+	Filename  string
+	Caption   string
+	Latitude  float64
+	Longitude float64
+}
+
+// Locations returns the locations of the geotagged images outside the trash
+// in the given gallery, sorted by position
+func (service *GalleryService) Locations(galleryID int) ([]ImageLocation, error) {
+	rows, err := service.DB.Query(`
+		SELECT gallery_id, filename, caption, latitude, longitude
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL
+			AND latitude IS NOT NULL AND longitude IS NOT NULL
+		ORDER BY position, id`,
+		galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query locations: %w", err)
+	}
+	defer rows.Close()
+
+	var locations []ImageLocation
+	for rows.Next() {
+		var location ImageLocation
+		err = rows.Scan(&location.GalleryID, &location.Filename, &location.Caption,
+			&location.Latitude, &location.Longitude)
+		if err != nil {
+			return nil, fmt.Errorf("query locations: %w", err)
+		}
+		locations = append(locations, location)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query locations: %w", err)
+	}
+
+	return locations, nil
+}
+
+// SetPublicLocation defines whether other users can see where the images of a
+// gallery were taken
+func (service *GalleryService) SetPublicLocation(gallery *Gallery, public bool) error {
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET public_location = $2, updated_at = now()
+		WHERE id = $1`,
+		gallery.ID, public)
+	if err != nil {
+		return fmt.Errorf("set gallery public location: %w", err)
+	}
+	gallery.PublicLocation = public
+
+	return nil
+}
+
+// SyncLocations extracts the locations of the images uploaded before they were
+// extracted on upload, and removes the EXIF metadata from their current
+// versions, as done for new uploads: the current version is kept as the
+// original first, unless there is one already, so that the location is still
+// extracted from it. Rotated images get their derived sizes and placeholders
+// regenerated
+func (service *GalleryService) SyncLocations() error {
+	rows, err := service.DB.Query(`
+		SELECT gallery_id, filename
+		FROM images
+		WHERE NOT geotag_checked AND deleted_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("sync locations: %w", err)
+	}
+	var images []Image
+	for rows.Next() {
+		var image Image
+		err = rows.Scan(&image.GalleryID, &image.Filename)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("sync locations: %w", err)
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("sync locations: %w", err)
+	}
+
+	for _, image := range images {
+		err = service.removeLocation(image.GalleryID, image.Filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("sync locations: %w", err)
+		}
+		err = service.updateLocation(image.GalleryID, image.Filename)
+		if err != nil {
+			return fmt.Errorf("sync locations: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// removeLocation removes the EXIF metadata from the current version of the
+// given image, after keeping it as the original if there is none
+func (service *GalleryService) removeLocation(galleryID int, filename string) error {
+	err := service.keepOriginal(galleryID, filename, false)
+	if err != nil {
+		return err
+	}
+
+	rotated, err := removeMetadata(filepath.Join(service.galleryDir(galleryID), filename))
+	if err != nil {
+		return err
+	}
+	if !rotated {
+		return nil
+	}
+
+	err = service.generateSizes(galleryID, filename)
+	if err != nil {
+		return err
+	}
+
+	return service.updatePlaceholder(galleryID, filename)
+}
+
+// updateLocation extracts and stores the location of the given image from the
+// EXIF metadata of its original, since the metadata is removed from the
+// current version. Images without GPS coordinates have no location
+func (service *GalleryService) updateLocation(galleryID int, filename string) error {
+	path := service.originalPath(galleryID, filename)
+	_, err := os.Stat(path)
+	if err != nil {
+		path = filepath.Join(service.galleryDir(galleryID), filename)
+	}
+
+	var latitude, longitude *float64
+	lat, long, ok := gpsCoordinates(path)
+	if ok {
+		latitude, longitude = &lat, &long
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE images
+		SET latitude = $3, longitude = $4, geotag_checked = true
+		WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL`,
+		galleryID, filename, latitude, longitude)
+	if err != nil {
+		return fmt.Errorf("update location: %w", err)
+	}
+
+	return nil
+}
+
+// gpsCoordinates returns the latitude and the longitude in the EXIF metadata
+// of the image at the given path. It returns false if there are none
+func gpsCoordinates(path string) (float64, float64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return 0, 0, false
+	}
+	lat, long, err := x.LatLong()
+	if err != nil {
+		return 0, 0, false
+	}
+	// Cameras without a fix write zeros
+	if (lat == 0 && long == 0) || lat < -90 || lat > 90 || long < -180 || long > 180 {
+		return 0, 0, false
+	}
+
+	return lat, long, true
+}
+
+// StripExif returns the path of a copy of the image at the given path without
+// its EXIF metadata, which holds its GPS coordinates, among others. Only JPEG
+// images are supported, and the path itself is returned for other formats.
+// The result is cached with the transformed images
+func (service *TransformService) StripExif(path string) (string, error) {
+	if !isJPEG(path) {
+		return path, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("strip exif: %w", err)
+	}
+
+	key := fmt.Sprintf("exif/%s/%d/%d", path, info.ModTime().UnixNano(), info.Size())
+	dst, err := service.cached(key, strings.ToLower(filepath.Ext(path)), func(dst string) error {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(dst, stripExif(contents), 0644)
+	})
+	if err != nil {
+		return "", fmt.Errorf("strip exif: %w", err)
+	}
+
+	return dst, nil
+}
+
+// removeExif removes the EXIF metadata from the JPEG image at the given path,
+// if any. Other formats are left as they are
+func removeExif(path string) error {
+	if !isJPEG(path) {
+		return nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	stripped := stripExif(contents)
+	if len(stripped) == len(contents) {
+		return nil
+	}
+
+	// The temporary file has no image extension, so that it is never taken
+	// for an image
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".edit-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(stripped)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// exifHeader starts the APP1 segments of JPEG images that hold EXIF metadata
+const exifHeader = "Exif\x00\x00"
+
+// stripExif returns the given JPEG image without the APP1 segments that hold
+// EXIF metadata. Malformed images are returned as they are
+func stripExif(contents []byte) []byte {
+	if len(contents) < 2 || contents[0] != 0xFF || contents[1] != 0xD8 {
+		return contents
+	}
+
+	var b bytes.Buffer
+	b.Write(contents[:2])
+	offset := 2
+	// The metadata segments come before the image data, which starts with
+	// the start of scan marker
+	for offset+4 <= len(contents) && contents[offset] == 0xFF && contents[offset+1] != 0xDA {
+		end := offset + 2 + int(binary.BigEndian.Uint16(contents[offset+2:]))
+		if end > len(contents) {
+			return contents
+		}
+		segment := contents[offset:end]
+		exif := segment[1] == 0xE1 && bytes.HasPrefix(segment[4:], []byte(exifHeader))
+		if !exif {
+			b.Write(segment)
+		}
+		offset = end
+	}
+	b.Write(contents[offset:])
+
+	return b.Bytes()
+}
+
+// isJPEG returns true if the given path has the extension of a JPEG image
+func isJPEG(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".jpg" || ext == ".jpeg"
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// License defines a license under which the images of a gallery are shared
+type License struct {
+	ID   string
+	Name string
+	// URL points to the terms of the license. It is empty for all rights
+	// reserved
+	URL string
+}
+
+// Licenses lists the supported licenses. Galleries without a license state no
+// terms at all
+var Licenses = []License{
+	{ID: "all-rights-reserved", Name: "All rights reserved"},
+	{ID: "cc-by", Name: "CC BY 4.0", URL: "https://creativecommons.org/licenses/by/4.0/"},
+	{ID: "cc-by-sa", Name: "CC BY-SA 4.0", URL: "https://creativecommons.org/licenses/by-sa/4.0/"},
+	{ID: "cc-by-nd", Name: "CC BY-ND 4.0", URL: "https://creativecommons.org/licenses/by-nd/4.0/"},
+	{ID: "cc-by-nc", Name: "CC BY-NC 4.0", URL: "https://creativecommons.org/licenses/by-nc/4.0/"},
+	{ID: "cc-by-nc-sa", Name: "CC BY-NC-SA 4.0", URL: "https://creativecommons.org/licenses/by-nc-sa/4.0/"},
+	{ID: "cc-by-nc-nd", Name: "CC BY-NC-ND 4.0", URL: "https://creativecommons.org/licenses/by-nc-nd/4.0/"},
+	{ID: "cc0", Name: "CC0 1.0", URL: "https://creativecommons.org/publicdomain/zero/1.0/"},
+}
+
+// LicenseByID returns the license with the given ID. It returns false if there
+// is no such license
+func LicenseByID(id string) (License, bool) {
+	for _, license := range Licenses {
+		if license.ID == id {
+			return license, true
+		}
+	}
+
+	return License{}, false
+}
+
+// EmbedLicense returns the path of a copy of the image at the given path with
+// the given license and copyright holder embedded in its metadata, as XMP.
+// Only JPEG and PNG images are supported, and the path itself is returned for
+// other formats. The result is cached with the transformed images
+func (service *TransformService) EmbedLicense(path string, license License, holder string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return path, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("embed license: %w", err)
+	}
+
+	key := fmt.Sprintf("license/%s/%d/%d/%s/%s",
+		path, info.ModTime().UnixNano(), info.Size(), license.ID, holder)
+	dst, err := service.cached(key, ext, func(dst string) error {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		packet := xmpPacket(license, holder)
+		if ext == ".png" {
+			contents, err = embedPNG(contents, packet)
+		} else {
+			contents, err = embedJPEG(contents, packet)
+		}
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(dst, contents, 0644)
+	})
+	if err != nil {
+		return "", fmt.Errorf("embed license: %w", err)
+	}
+
+	return dst, nil
+}
+
+// xmpPacket returns the XMP packet that states the given license and copyright
+// holder
+func xmpPacket(license License, holder string) []byte {
+	rights := license.Name
+	if holder != "" {
+		rights = fmt.Sprintf("© %s. %s", holder, license.Name)
+	}
+	marked := "True"
+	if license.ID == "cc0" {
+		marked = "False"
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>`)
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">`)
+	b.WriteString(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`)
+	b.WriteString(`<rdf:Description rdf:about=""`)
+	b.WriteString(` xmlns:dc="http://purl.org/dc/elements/1.1/"`)
+	b.WriteString(` xmlns:xmpRights="http://ns.adobe.com/xap/1.0/rights/"`)
+	b.WriteString(` xmlns:cc="http://creativecommons.org/ns#"`)
+	fmt.Fprintf(&b, ` xmpRights:Marked="%s"`, marked)
+	if license.URL != "" {
+		fmt.Fprintf(&b, ` xmpRights:WebStatement="%s"`, html.EscapeString(license.URL))
+		fmt.Fprintf(&b, ` cc:license="%s"`, html.EscapeString(license.URL))
+	}
+	b.WriteString(`>`)
+	fmt.Fprintf(&b, `<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">%s</rdf:li></rdf:Alt></dc:rights>`,
+		html.EscapeString(rights))
+	if holder != "" {
+		fmt.Fprintf(&b, `<dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>`,
+			html.EscapeString(holder))
+	}
+	b.WriteString(`</rdf:Description></rdf:RDF></x:xmpmeta>`)
+	b.WriteString(`<?xpacket end="r"?>`)
+
+	return b.Bytes()
+}
+
+// xmpNamespace identifies the XMP segments of JPEG images
+const xmpNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+
+// embedJPEG inserts the given XMP packet into the given JPEG image, in an APP1
+// segment placed after the JFIF and Exif segments, if any
+func embedJPEG(contents, packet []byte) ([]byte, error) {
+	if len(contents) < 2 || contents[0] != 0xFF || contents[1] != 0xD8 {
+		return nil, ErrInvalidFormat
+	}
+
+	length := 2 + len(xmpNamespace) + len(packet)
+	if length > 0xFFFF {
+		return nil, ErrInvalidFormat
+	}
+
+	// Skips the leading APP0 and APP1 segments, which readers expect first
+	offset := 2
+	for offset+4 <= len(contents) && contents[offset] == 0xFF &&
+		(contents[offset+1] == 0xE0 || contents[offset+1] == 0xE1) {
+		offset += 2 + int(binary.BigEndian.Uint16(contents[offset+2:]))
+	}
+	if offset > len(contents) {
+		return nil, ErrInvalidFormat
+	}
+
+	segment := []byte{0xFF, 0xE1, byte(length >> 8), byte(length)}
+	segment = append(segment, xmpNamespace...)
+	segment = append(segment, packet...)
+
+	var b bytes.Buffer
+	b.Write(contents[:offset])
+	b.Write(segment)
+	b.Write(contents[offset:])
+
+	return b.Bytes(), nil
+}
+
+// pngSignature starts every PNG image
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// embedPNG inserts the given XMP packet into the given PNG image, in an iTXt
+// chunk placed after the header chunk
+func embedPNG(contents, packet []byte) ([]byte, error) {
+	// The signature is followed by the header chunk, whose data has 13 bytes
+	headerEnd := len(pngSignature) + 8 + 13 + 4
+	if len(contents) < headerEnd || string(contents[:len(pngSignature)]) != pngSignature {
+		return nil, ErrInvalidFormat
+	}
+
+	// The keyword is followed by the compression flag and method, and by the
+	// empty language tag and translated keyword
+	data := append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), packet...)
+	chunk := make([]byte, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], "iTXt")
+	copy(chunk[8:], data)
+	binary.BigEndian.PutUint32(chunk[8+len(data):], crc32.ChecksumIEEE(chunk[4:8+len(data)]))
+
+	var b bytes.Buffer
+	b.Write(contents[:headerEnd])
+	b.Write(chunk)
+	b.Write(contents[headerEnd:])
+
+	return b.Bytes(), nil
+}
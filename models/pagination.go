@@ -0,0 +1,208 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// SortOrder defines a new type that wraps the native string type. It represents
+// the order in which a listing is sorted
+type SortOrder string
+
+// Defines the available sort orders. Not every listing supports every order
+var (
+	SortCreated    SortOrder = "created"
+	SortUpdated    SortOrder = "updated"
+	SortTitle      SortOrder = "title"
+	SortImageCount SortOrder = "images"
+	SortPosition   SortOrder = "position"
+)
+
+const (
+	// DefaultPageSize is the number of items per page when no limit is given
+	DefaultPageSize = 24
+	// MaxPageSize is the maximum number of items per page
+	MaxPageSize = 100
+)
+
+// PageOptions defines how a listing is paginated and sorted. The zero value
+// returns the first page in the default order of the listing
+type PageOptions struct {
+	Sort SortOrder
+	// Cursor is a token returned in a previous Page. It is opaque to the
+	// callers and only valid for the sort order it was created with
+	Cursor string
+	// Limit is the number of items per page. It defaults to DefaultPageSize
+	// and can not be greater than MaxPageSize
+	Limit int
+}
+
+// Page defines the cursors to the pages before and after the current page. An
+// empty cursor means that there is no such page
+type Page struct {
+	Prev string
+	Next string
+}
+
+// cursor defines the position of an item in a sorted listing. Key is the value
+// of the sort column of the item, and ID is used to break ties
+type cursor struct {
+	Sort     SortOrder `json:"s"`
+	Key      string    `json:"k"`
+	ID       int       `json:"i"`
+	Backward bool      `json:"b,omitempty"`
+}
+
+// sortSpec defines how a sort order maps to a SQL column
+type sortSpec struct {
+	// column is the SQL expression used to sort
+	column string
+	// cast is the SQL type to which the key of a cursor is cast
+	cast string
+	// desc defines whether the items are sorted in descending order
+	desc bool
+}
+
+// encode returns the token that represents the cursor
+func (c cursor) encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses the given token. It returns ErrInvalidCursor if the
+// token is malformed or was not created for the given sort order
+func decodeCursor(token string, sort SortOrder) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.Sort != sort {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// limit returns the page size, within the allowed bounds
+func (opts PageOptions) limit() int {
+	switch {
+	case opts.Limit <= 0:
+		return DefaultPageSize
+	case opts.Limit > MaxPageSize:
+		return MaxPageSize
+	default:
+		return opts.Limit
+	}
+}
+
+// keysetQuery defines a paginated query over a sub-query. The sub-query must
+// expose an `id` column and the columns used by the sort orders
+type keysetQuery struct {
+	// sorts defines the sort orders supported by the query, and defaultSort
+	// the order used when none is given
+	sorts       map[SortOrder]sortSpec
+	defaultSort SortOrder
+	// columns is the list of columns selected from the sub-query
+	columns string
+	// from is the sub-query and args its arguments
+	from string
+	args []interface{}
+}
+
+// build returns the SQL statement and arguments that select a page of the
+// query. The statement selects the given columns followed by the sort key of
+// each row as text. One row more than the page size is selected so that
+// paginate can tell whether there are more rows
+func (q keysetQuery) build(opts PageOptions) (string, []interface{}, cursor, error) {
+	if opts.Sort == "" {
+		opts.Sort = q.defaultSort
+	}
+	spec, ok := q.sorts[opts.Sort]
+	if !ok {
+		return "", nil, cursor{}, ErrInvalidSort
+	}
+
+	current := cursor{Sort: opts.Sort}
+	if opts.Cursor != "" {
+		var err error
+		current, err = decodeCursor(opts.Cursor, opts.Sort)
+		if err != nil {
+			return "", nil, cursor{}, err
+		}
+	}
+
+	// Pages before the cursor are selected by reversing the order. Rows are
+	// put back in the right order by paginate
+	desc := spec.desc != current.Backward
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+
+	args := append([]interface{}{}, q.args...)
+	where := ""
+	if opts.Cursor != "" {
+		args = append(args, current.Key, current.ID)
+		where = fmt.Sprintf("WHERE (%s, id) %s ($%d::%s, $%d)",
+			spec.column, op, len(args)-1, spec.cast, len(args))
+	}
+	args = append(args, opts.limit()+1)
+
+	query := fmt.Sprintf(`
+		SELECT %s, (%s)::text
+		FROM (%s) AS page
+		%s
+		ORDER BY %s %s, id %s
+		LIMIT $%d`,
+		q.columns, spec.column, q.from, where, spec.column, dir, dir, len(args))
+
+	return query, args, current, nil
+}
+
+// paginate trims the rows selected by a keysetQuery to the page size and
+// returns the page cursors. The rows are given by their IDs and sort keys,
+// and the returned indices select the rows of the page in the right order
+func paginate(opts PageOptions, current cursor, ids []int, keys []string) ([]int, *Page) {
+	limit := opts.limit()
+	hasMore := len(ids) > limit
+
+	indices := make([]int, 0, len(ids))
+	for i := range ids {
+		if i == limit {
+			break
+		}
+		indices = append(indices, i)
+	}
+
+	// Rows of a backward page were selected in the reverse order
+	if current.Backward {
+		for i, j := 0, len(indices)-1; i < j; i, j = i+1, j-1 {
+			indices[i], indices[j] = indices[j], indices[i]
+		}
+	}
+
+	var page Page
+	if len(indices) == 0 {
+		return indices, &page
+	}
+
+	first, last := indices[0], indices[len(indices)-1]
+	hasPrev := opts.Cursor != "" && (!current.Backward || hasMore)
+	hasNext := hasMore || (opts.Cursor != "" && current.Backward)
+	if hasPrev {
+		page.Prev = cursor{Sort: current.Sort, Key: keys[first], ID: ids[first], Backward: true}.encode()
+	}
+	if hasNext {
+		page.Next = cursor{Sort: current.Sort, Key: keys[last], ID: ids[last]}.encode()
+	}
+
+	return indices, &page
+}
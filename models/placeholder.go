@@ -0,0 +1,182 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+// Number of components of the blurhashes, horizontally and vertically. More
+// components keep more detail but make longer hashes
+const (
+	blurHashX = 4
+	blurHashY = 3
+)
+
+// blurHashSide is the side of the square to which images are scaled down
+// before their blurhash is computed, since detail is lost anyway
+const blurHashSide = 32
+
+// maxPlaceholders bounds the number of memoized placeholders. The memo is
+// cleared when it is exceeded
+const maxPlaceholders = 10000
+
+var placeholders = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// Placeholder returns the placeholder shown while the given image loads: its
+// blurhash decoded to a tiny PNG, as a data URI. It returns an empty string if
+// the image has no blurhash yet. Placeholders are memoized, since they only
+// depend on the blurhash and the dimensions of the image
+func Placeholder(img Image) (string, error) {
+	if img.BlurHash == "" {
+		return "", nil
+	}
+
+	key := fmt.Sprintf("%s:%dx%d", img.BlurHash, img.Width, img.Height)
+	placeholders.Lock()
+	uri, ok := placeholders.m[key]
+	placeholders.Unlock()
+	if ok {
+		return uri, nil
+	}
+
+	// The placeholder keeps the aspect ratio of the image, so that it is not
+	// distorted when stretched over it
+	width, height := blurHashSide, blurHashSide
+	if img.Width > 0 && img.Height > 0 {
+		height = blurHashSide * img.Height / img.Width
+		if height < 1 {
+			height = 1
+		}
+	}
+
+	decoded, err := blurhash.Decode(img.BlurHash, width, height, 1)
+	if err != nil {
+		return "", fmt.Errorf("placeholder: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, decoded)
+	if err != nil {
+		return "", fmt.Errorf("placeholder: %w", err)
+	}
+
+	uri = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	placeholders.Lock()
+	if len(placeholders.m) >= maxPlaceholders {
+		placeholders.m = make(map[string]string)
+	}
+	placeholders.m[key] = uri
+	placeholders.Unlock()
+
+	return uri, nil
+}
+
+// SyncPlaceholders computes the placeholders of the images that have none,
+// such as those uploaded before placeholders were computed. Images whose
+// placeholder can not be computed, e.g. because they can not be decoded, are
+// logged and skipped
+func (service *GalleryService) SyncPlaceholders() error {
+	rows, err := service.DB.Query(`
+		SELECT gallery_id, filename
+		FROM images
+		WHERE blurhash IS NULL AND deleted_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("sync placeholders: %w", err)
+	}
+	var images []Image
+	for rows.Next() {
+		var image Image
+		err = rows.Scan(&image.GalleryID, &image.Filename)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("sync placeholders: %w", err)
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("sync placeholders: %w", err)
+	}
+
+	for _, image := range images {
+		err = service.updatePlaceholder(image.GalleryID, image.Filename)
+		if err != nil {
+			fmt.Printf("sync placeholder of %s in gallery %d: %v\n", image.Filename, image.GalleryID, err)
+		}
+	}
+
+	return nil
+}
+
+// updatePlaceholder computes and stores the dimensions, the blurhash and the
+// dominant color of the current version of the given image. It must be called
+// whenever the image changes
+func (service *GalleryService) updatePlaceholder(galleryID int, filename string) error {
+	path := filepath.Join(service.galleryDir(galleryID), filename)
+	config, err := decodeConfig(path)
+	if err != nil {
+		return fmt.Errorf("update placeholder: %w", err)
+	}
+
+	// The thumbnail is enough to compute the placeholder, and much faster to
+	// decode
+	src := service.sizePath(galleryID, filename, ImageSizes[0].Name)
+	_, err = os.Stat(src)
+	if err != nil {
+		src = path
+	}
+	img, err := imaging.Open(src)
+	if err != nil {
+		return fmt.Errorf("update placeholder: %w", err)
+	}
+	small := imaging.Fit(img, blurHashSide, blurHashSide, imaging.Box)
+
+	hash, err := blurhash.Encode(blurHashX, blurHashY, small)
+	if err != nil {
+		return fmt.Errorf("update placeholder: %w", err)
+	}
+
+	// The dominant color is approximated by the average color
+	average := imaging.Resize(small, 1, 1, imaging.Box)
+	r, g, b, _ := average.At(0, 0).RGBA()
+	color := fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+
+	_, err = service.DB.Exec(`
+		UPDATE images
+		SET width = $3, height = $4, blurhash = $5, dominant_color = $6
+		WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL`,
+		galleryID, filename, config.Width, config.Height, hash, color)
+	if err != nil {
+		return fmt.Errorf("update placeholder: %w", err)
+	}
+
+	return nil
+}
+
+// decodeConfig returns the dimensions and the color model of the image at the
+// given path without decoding the whole image
+func decodeConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+
+	return config, err
+}
@@ -0,0 +1,378 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ImageSize defines a size derived from every image, such as a thumbnail. The
+// derived image fits in a square of MaxSide pixels
+type ImageSize struct {
+	Name    string
+	MaxSide int
+}
+
+// ImageSizes defines the sizes derived from every image
+var ImageSizes = []ImageSize{
+	{Name: "thumb", MaxSide: 400},
+	{Name: "medium", MaxSide: 1600},
+}
+
+// Directories inside the directory of a gallery that hold the files related to
+// its images. They have no extension, so they are never taken for images
+const (
+	originalsDir = ".originals"
+	sizesDir     = ".sizes"
+)
+
+// ImageEdit defines an edit of an image. The crop is applied first, then the
+// rotation and then the flips. Each edit is stored as a new version
+type ImageEdit struct {
+	// Crop is the rectangle that is kept, in pixels of the image before the
+	// edit. An empty rectangle keeps the whole image
+	Crop image.Rectangle
+	// Rotate is the clockwise rotation in degrees: 0, 90, 180 or 270
+	Rotate         int
+	FlipHorizontal bool
+	FlipVertical   bool
+}
+
+// EditImage applies the given edit to the current version of the given image
+// and regenerates its derived sizes. The original image is kept. It returns
+// ErrInvalidEdit if the rotation is not supported or if the crop is not inside
+// the image
+func (service *GalleryService) EditImage(galleryID int, filename string, edit ImageEdit) error {
+	img, err := service.Image(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	err = service.ensureVersion(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	// Images uploaded before the originals were kept use their current
+	// version as the original
+	err = service.keepOriginal(galleryID, filename, false)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	src, err := imaging.Open(img.Path)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	if !edit.Crop.Empty() {
+		if !edit.Crop.In(src.Bounds()) {
+			return ErrInvalidEdit
+		}
+		src = imaging.Crop(src, edit.Crop)
+	}
+
+	// The rotations of the imaging package are counter-clockwise
+	switch edit.Rotate {
+	case 0:
+	case 90:
+		src = imaging.Rotate270(src)
+	case 180:
+		src = imaging.Rotate180(src)
+	case 270:
+		src = imaging.Rotate90(src)
+	default:
+		return ErrInvalidEdit
+	}
+
+	if edit.FlipHorizontal {
+		src = imaging.FlipH(src)
+	}
+	if edit.FlipVertical {
+		src = imaging.FlipV(src)
+	}
+
+	err = saveImage(img.Path, src, 0)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	err = service.generateSizes(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	err = service.updatePlaceholder(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	err = service.recordVersion(img, VersionEdit)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE galleries
+		SET updated_at = now()
+		WHERE id = $1`,
+		galleryID)
+	if err != nil {
+		return fmt.Errorf("edit image: %w", err)
+	}
+
+	return nil
+}
+
+// OriginalPath returns the path of the original of the given image, as it was
+// uploaded. Images uploaded before the originals were kept are their own
+// original
+func (service *GalleryService) OriginalPath(galleryID int, filename string) (string, error) {
+	img, err := service.Image(galleryID, filename)
+	if err != nil {
+		return "", err
+	}
+
+	path := service.originalPath(galleryID, filename)
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return img.Path, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("original path: %w", err)
+	}
+
+	return path, nil
+}
+
+// SizePath returns the path of the given derived size of the given image. It
+// returns ErrInvalidSize if there is no such size, and ErrSizeMissing if the
+// size was not generated yet
+func (service *GalleryService) SizePath(galleryID int, filename string, size string) (string, error) {
+	_, err := service.Image(galleryID, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if !validSize(size) {
+		return "", ErrInvalidSize
+	}
+
+	path := service.sizePath(galleryID, filename, size)
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrSizeMissing
+	}
+	if err != nil {
+		return "", fmt.Errorf("size path: %w", err)
+	}
+
+	return path, nil
+}
+
+// processUpload is run after an image file is written. It keeps the uploaded
+// file as the original, rotates the current version according to its EXIF
+// orientation, removes its EXIF metadata, and generates the derived sizes
+func (service *GalleryService) processUpload(galleryID int, filename string) error {
+	err := service.keepOriginal(galleryID, filename, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = removeMetadata(filepath.Join(service.galleryDir(galleryID), filename))
+	if err != nil {
+		return err
+	}
+
+	return service.generateSizes(galleryID, filename)
+}
+
+// removeMetadata removes the EXIF metadata, which might hold the GPS
+// coordinates, from the image at the given path. Images with an EXIF
+// orientation are rotated accordingly and re-encoded, which removes the
+// metadata as well, and true is returned
+func removeMetadata(path string) (bool, error) {
+	if orientation(path) > 1 {
+		img, err := imaging.Open(path, imaging.AutoOrientation(true))
+		if err != nil {
+			return false, err
+		}
+		return true, saveImage(path, img, 0)
+	}
+
+	return false, removeExif(path)
+}
+
+// keepOriginal copies the current version of the given image to its original.
+// An existing original is only replaced if replace is set
+func (service *GalleryService) keepOriginal(galleryID int, filename string, replace bool) error {
+	path := service.originalPath(galleryID, filename)
+	_, err := os.Stat(path)
+	if err == nil && !replace {
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return copyFile(filepath.Join(service.galleryDir(galleryID), filename), path)
+}
+
+// generateSizes generates every derived size of the given image from its
+// current version, and converts them to the modern formats. Images smaller
+// than a size are not enlarged
+func (service *GalleryService) generateSizes(galleryID int, filename string) error {
+	src, err := imaging.Open(filepath.Join(service.galleryDir(galleryID), filename))
+	if err != nil {
+		return fmt.Errorf("generate sizes: %w", err)
+	}
+
+	for _, size := range ImageSizes {
+		dst := src
+		bounds := src.Bounds()
+		if bounds.Dx() > size.MaxSide || bounds.Dy() > size.MaxSide {
+			dst = imaging.Fit(src, size.MaxSide, size.MaxSide, imaging.Lanczos)
+		}
+
+		path := service.sizePath(galleryID, filename, size.Name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("generate sizes: %w", err)
+		}
+		err = saveImage(path, dst, 0)
+		if err != nil {
+			return fmt.Errorf("generate sizes: %w", err)
+		}
+	}
+
+	return service.generateVariants(galleryID, filename)
+}
+
+// originalPath returns the path where the original of the given image is kept
+func (service *GalleryService) originalPath(galleryID int, filename string) string {
+	return filepath.Join(service.galleryDir(galleryID), originalsDir, filename)
+}
+
+// sizePath returns the path where the given derived size of the given image is
+// stored
+func (service *GalleryService) sizePath(galleryID int, filename, size string) string {
+	return filepath.Join(service.galleryDir(galleryID), sizesDir, size, filename)
+}
+
+// imagePaths returns the paths of all files of the given image: the current
+// version, the original, the derived sizes and the variants in the modern
+// formats, always in the same order. Some
+// of the files might not exist
+func (service *GalleryService) imagePaths(galleryID int, filename string) []string {
+	paths := []string{
+		filepath.Join(service.galleryDir(galleryID), filename),
+		service.originalPath(galleryID, filename),
+	}
+	for _, size := range ImageSizes {
+		paths = append(paths, service.sizePath(galleryID, filename, size.Name))
+	}
+	paths = append(paths, service.variantPaths(galleryID, filename)...)
+
+	return paths
+}
+
+// removeImageFiles removes all files of the given image
+func (service *GalleryService) removeImageFiles(galleryID int, filename string) error {
+	for _, path := range service.imagePaths(galleryID, filename) {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validSize returns true if the given name is one of the ImageSizes
+func validSize(name string) bool {
+	for _, size := range ImageSizes {
+		if size.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// orientation returns the EXIF orientation of the image at the given path, or
+// zero if it is unknown
+func orientation(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return 0
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 0
+	}
+	value, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// saveImage encodes the given image to the given path, in the format given by
+// its extension, with the given quality from 1 to 100, or a default one if
+// zero. The image is written to a temporary file first, so that the file at
+// the path is never left half written
+func saveImage(path string, img image.Image, quality int) error {
+	if quality == 0 {
+		quality = 90
+	}
+
+	// The temporary file has no image extension, so that it is never taken
+	// for an image
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".edit-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	modern, err := encodeModern(tmp, img, ext, quality)
+	if !modern {
+		var format imaging.Format
+		format, err = imaging.FormatFromExtension(ext)
+		if err == nil {
+			err = imaging.Encode(tmp, img, format, imaging.JPEGQuality(quality))
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// Variables related to the profiles
+var (
+	stdAvatarsDir string = filepath.Join(stdImagesDir, "avatars")
+
+	// usernamePattern defines the valid usernames: 3 to 30 lower case
+	// letters, digits, hyphens and underscores, starting with a letter or a
+	// digit
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,29}$`)
+
+	// reservedUsernames can not be chosen as usernames because they name
+	// pages of the application or could be mistaken for official accounts
+	reservedUsernames = map[string]bool{
+		"admin": true, "administrator": true, "api": true, "assets": true,
+		"collections": true, "contact": true, "faq": true, "feed": true,
+		"galleries": true, "help": true, "images": true, "lenslocked": true,
+		"me": true, "null": true, "root": true, "search": true,
+		"settings": true, "signin": true, "signout": true, "signup": true,
+		"staff": true, "support": true, "system": true, "tags": true,
+		"u": true, "undefined": true, "user": true, "users": true,
+	}
+)
+
+// NormalizeUsername returns the given username as it is stored: trimmed and
+// in lower case
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// ValidateUsername returns ErrInvalidUsername if the given normalized username
+// does not match the allowed pattern, and ErrUsernameReserved if it is a
+// reserved word
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return ErrInvalidUsername
+	}
+	if reservedUsernames[username] {
+		return ErrUsernameReserved
+	}
+
+	return nil
+}
+
+// ByUsername query and returns the user with the given username
+func (us *UserService) ByUsername(username string) (*User, error) {
+	user := User{
+		Username: NormalizeUsername(username),
+	}
+
+	row := us.DB.QueryRow(`
+		SELECT id, email, display_name, bio, avatar
+		FROM users
+		WHERE username = $1`,
+		user.Username)
+	err := row.Scan(&user.ID, &user.Email, &user.DisplayName, &user.Bio, &user.Avatar)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidUser
+		}
+		return nil, fmt.Errorf("query user by username: %w", err)
+	}
+
+	return &user, nil
+}
+
+// ByID query and returns the user with the given ID
+func (us *UserService) ByID(id int) (*User, error) {
+	user := User{
+		ID: id,
+	}
+
+	row := us.DB.QueryRow(`
+		SELECT email, coalesce(username, ''), display_name, bio, avatar
+		FROM users
+		WHERE id = $1`,
+		id)
+	err := row.Scan(&user.Email, &user.Username, &user.DisplayName, &user.Bio, &user.Avatar)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidUser
+		}
+		return nil, fmt.Errorf("query user by id: %w", err)
+	}
+
+	return &user, nil
+}
+
+// UpdateProfile updates the username, the display name and the bio of the
+// given user. The username is normalized and validated first. An empty
+// username removes the public profile
+func (us *UserService) UpdateProfile(user *User) error {
+	user.Username = NormalizeUsername(user.Username)
+	user.DisplayName = strings.TrimSpace(user.DisplayName)
+	user.Bio = strings.TrimSpace(user.Bio)
+
+	var username sql.NullString
+	if user.Username != "" {
+		err := ValidateUsername(user.Username)
+		if err != nil {
+			return err
+		}
+		username = sql.NullString{String: user.Username, Valid: true}
+	}
+
+	_, err := us.DB.Exec(`
+		UPDATE users
+		SET username = $2, display_name = $3, bio = $4
+		WHERE id = $1`,
+		user.ID, username, user.DisplayName, user.Bio)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("update profile: %w", err)
+	}
+
+	return nil
+}
+
+// SetAvatar stores the provided contents as the avatar of the given user,
+// replacing the previous one, if any
+func (us *UserService) SetAvatar(user *User, filename string, contents io.ReadSeeker) error {
+	err := checkContentType(contents, stdImagesCont[:])
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	err = checkExtension(filename, stdImagesExt[:])
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+
+	err = os.MkdirAll(us.avatarsDir(), 0755)
+	if err != nil {
+		return fmt.Errorf("creating avatar directory: %w", err)
+	}
+
+	// The avatar is named after the user so that uploads never collide
+	avatar := fmt.Sprintf("user-%d%s", user.ID, strings.ToLower(filepath.Ext(filename)))
+	dst, err := os.Create(filepath.Join(us.avatarsDir(), avatar))
+	if err != nil {
+		return fmt.Errorf("creating avatar file: %w", err)
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, contents)
+	if err != nil {
+		return fmt.Errorf("copying contents to avatar: %w", err)
+	}
+
+	_, err = us.DB.Exec(`
+		UPDATE users
+		SET avatar = $2
+		WHERE id = $1`,
+		user.ID, avatar)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+
+	// An avatar with a different extension is left behind otherwise
+	if user.Avatar != "" && user.Avatar != avatar {
+		err = os.Remove(filepath.Join(us.avatarsDir(), filepath.Base(user.Avatar)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing previous avatar: %w", err)
+		}
+	}
+	user.Avatar = avatar
+
+	return nil
+}
+
+// AvatarPath returns the path of the avatar of the given user.
+// ErrAvatarNotFound is returned if the user has no avatar
+func (us *UserService) AvatarPath(user *User) (string, error) {
+	if user.Avatar == "" {
+		return "", ErrAvatarNotFound
+	}
+
+	return filepath.Join(us.avatarsDir(), filepath.Base(user.Avatar)), nil
+}
+
+// avatarsDir returns the directory where the avatars are stored. If no
+// directory is specified, the standard directory stdAvatarsDir is used
+func (us *UserService) avatarsDir() string {
+	if us.AvatarsDir == "" {
+		return stdAvatarsDir
+	}
+
+	return us.AvatarsDir
+}
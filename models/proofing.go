@@ -0,0 +1,376 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wagnojunior/lenslocked/rand"
+)
+
+// MaxProofNoteLength is the maximum length of the note on a selected image, in
+// characters
+const MaxProofNoteLength = 500
+
+// Proof defines the proof model according to the `proofs` SQL table, with the
+// images it selects
+type Proof struct {
+	ID        int
+	GalleryID int
+	// User is the user who made the proof, with ID zero for the visitors of
+	// the share link. Only the ID, the username and the display name are set
+	User User
+	// Token identifies the visitor who made the proof. It is only set when
+	// creating the proof of a visitor
+	Token string
+	// Name is the name given by the viewer when they submit the proof
+	Name string
+	// SubmittedAt is zero until the proof is submitted, after which it can
+	// not change
+	SubmittedAt time.Time
+	CreatedAt   time.Time
+	// Selections are ordered as the images of the gallery
+	Selections []Selection
+}
+
+// Submitted returns true if the proof was submitted
+func (proof *Proof) Submitted() bool {
+	return !proof.SubmittedAt.IsZero()
+}
+
+// Selection defines an image selected by a proof, with the note of the viewer
+type Selection struct {
+	Filename string
+	Note     string
+}
+
+// ProofingService defines the connection to the DB
+type ProofingService struct {
+	DB *sql.DB
+	// BytesPerToken determines how many bytes are used to generate the tokens
+	// of the visitors and of the share links. If `BytesPerToken` is not
+	// provided or is less than `MinBytesPerToken`, then `MinBytesPerToken` is
+	// used instead
+	BytesPerToken int
+}
+
+// SetProofing defines whether viewers can select images of a gallery and
+// submit their selection, of at most the given number of images unless it is
+// zero. Enabling proofing for the first time creates the share link
+func (service *ProofingService) SetProofing(gallery *Gallery, enabled bool, limit int) error {
+	if limit < 0 {
+		return ErrInvalidProofLimit
+	}
+
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET proofing = $2, proofing_limit = $3, updated_at = now()
+		WHERE id = $1`,
+		gallery.ID, enabled, limit)
+	if err != nil {
+		return fmt.Errorf("set gallery proofing: %w", err)
+	}
+	gallery.Proofing = enabled
+	gallery.ProofingLimit = limit
+
+	if enabled && gallery.ProofingToken == "" {
+		return service.ResetLink(gallery)
+	}
+
+	return nil
+}
+
+// ResetLink replaces the token of the share link of a gallery, so that the
+// previous link stops giving access to it
+func (service *ProofingService) ResetLink(gallery *Gallery) error {
+	bytes := service.BytesPerToken
+	if bytes < MinBytesPerToken {
+		bytes = MinBytesPerToken
+	}
+	token, err := rand.String(bytes)
+	if err != nil {
+		return fmt.Errorf("reset proofing link: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE galleries
+		SET proofing_token = $2
+		WHERE id = $1`,
+		gallery.ID, token)
+	if err != nil {
+		return fmt.Errorf("reset proofing link: %w", err)
+	}
+	gallery.ProofingToken = token
+
+	return nil
+}
+
+// GalleryID returns the ID of the gallery whose share link has the given
+// token. Links only work while proofing is on
+func (service *ProofingService) GalleryID(token string) (int, error) {
+	var id int
+	row := service.DB.QueryRow(`
+		SELECT id
+		FROM galleries
+		WHERE proofing_token = $1 AND proofing AND deleted_at IS NULL`,
+		token)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidGallery
+		}
+		return 0, fmt.Errorf("query gallery by proofing token: %w", err)
+	}
+
+	return id, nil
+}
+
+// Create creates an empty proof of the given gallery for the given user, or
+// for a new visitor if the user ID is zero. The token that identifies the
+// visitor is set in the returned proof
+func (service *ProofingService) Create(galleryID, userID int) (*Proof, error) {
+	proof := Proof{
+		GalleryID: galleryID,
+		User:      User{ID: userID},
+	}
+
+	var tokenHash interface{}
+	if userID == 0 {
+		token, hash, err := New(service.BytesPerToken)
+		if err != nil {
+			return nil, fmt.Errorf("create proof: %w", err)
+		}
+		proof.Token = token
+		tokenHash = hash
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO proofs (gallery_id, user_id, token_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`,
+		galleryID, nullID(userID), tokenHash)
+	err := row.Scan(&proof.ID, &proof.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create proof: %w", err)
+	}
+
+	return &proof, nil
+}
+
+// ByUser returns the proof of the given gallery made by the given user
+func (service *ProofingService) ByUser(galleryID, userID int) (*Proof, error) {
+	return service.proof(`proofs.gallery_id = $1 AND proofs.user_id = $2`, galleryID, userID)
+}
+
+// ByToken returns the proof of the given gallery made by the visitor
+// identified by the given token
+func (service *ProofingService) ByToken(galleryID int, token string) (*Proof, error) {
+	return service.proof(`proofs.gallery_id = $1 AND proofs.token_hash = $2`, galleryID, Hash(token))
+}
+
+// ByID returns the proof of the given gallery with the given ID
+func (service *ProofingService) ByID(galleryID, id int) (*Proof, error) {
+	return service.proof(`proofs.gallery_id = $1 AND proofs.id = $2`, galleryID, id)
+}
+
+// Select selects the image of the proof with the given filename, with the
+// given note, or unselects it. Selecting more images than the given limit, if
+// it is not zero, fails with ErrProofingLimit. Submitted proofs can not change
+func (service *ProofingService) Select(proof *Proof, limit int, filename string, selected bool, note string) error {
+	if proof.Submitted() {
+		return ErrProofSubmitted
+	}
+	note = strings.TrimSpace(note)
+	if utf8.RuneCountInString(note) > MaxProofNoteLength {
+		return ErrInvalidProofNote
+	}
+
+	var imageID int
+	row := service.DB.QueryRow(`
+		SELECT id
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL`,
+		proof.GalleryID, filename)
+	err := row.Scan(&imageID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrImageNotFound
+		}
+		return fmt.Errorf("select image: %w", err)
+	}
+
+	if !selected {
+		_, err = service.DB.Exec(`
+			DELETE FROM proof_selections
+			WHERE proof_id = $1 AND image_id = $2`,
+			proof.ID, imageID)
+		if err != nil {
+			return fmt.Errorf("unselect image: %w", err)
+		}
+		return nil
+	}
+
+	// Changing the note of a selected image does not count against the limit
+	var alreadySelected bool
+	for _, selection := range proof.Selections {
+		if selection.Filename == filename {
+			alreadySelected = true
+		}
+	}
+	if limit > 0 && !alreadySelected && len(proof.Selections) >= limit {
+		return ErrProofingLimit
+	}
+
+	_, err = service.DB.Exec(`
+		INSERT INTO proof_selections (proof_id, image_id, note)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (proof_id, image_id) DO
+		UPDATE
+		SET note = $3`,
+		proof.ID, imageID, note)
+	if err != nil {
+		return fmt.Errorf("select image: %w", err)
+	}
+
+	return nil
+}
+
+// Submit submits the proof under the given name, after which it can not
+// change. The proof must select at least one image, and no more than the given
+// limit unless it is zero
+func (service *ProofingService) Submit(proof *Proof, limit int, name string) error {
+	if proof.Submitted() {
+		return ErrProofSubmitted
+	}
+	if len(proof.Selections) == 0 {
+		return ErrProofEmpty
+	}
+	if limit > 0 && len(proof.Selections) > limit {
+		return ErrProofingLimit
+	}
+
+	row := service.DB.QueryRow(`
+		UPDATE proofs
+		SET name = $2, submitted_at = now()
+		WHERE id = $1
+		RETURNING submitted_at`,
+		proof.ID, strings.TrimSpace(name))
+	err := row.Scan(&proof.SubmittedAt)
+	if err != nil {
+		return fmt.Errorf("submit proof: %w", err)
+	}
+	proof.Name = strings.TrimSpace(name)
+
+	return nil
+}
+
+// Submissions returns the submitted proofs of the given gallery, the most
+// recent first
+func (service *ProofingService) Submissions(galleryID int) ([]Proof, error) {
+	rows, err := service.DB.Query(`
+		SELECT proofs.id, coalesce(proofs.user_id, 0), coalesce(users.username, ''),
+			coalesce(users.display_name, ''), proofs.name, proofs.submitted_at,
+			proofs.created_at
+		FROM proofs
+		LEFT JOIN users ON users.id = proofs.user_id
+		WHERE proofs.gallery_id = $1 AND proofs.submitted_at IS NOT NULL
+		ORDER BY proofs.submitted_at DESC`,
+		galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query proof submissions: %w", err)
+	}
+	defer rows.Close()
+
+	var proofs []Proof
+	for rows.Next() {
+		proof := Proof{
+			GalleryID: galleryID,
+		}
+		err = rows.Scan(&proof.ID, &proof.User.ID, &proof.User.Username,
+			&proof.User.DisplayName, &proof.Name, &proof.SubmittedAt, &proof.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query proof submissions: %w", err)
+		}
+		proofs = append(proofs, proof)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query proof submissions: %w", err)
+	}
+
+	for i := range proofs {
+		proofs[i].Selections, err = service.selections(proofs[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("query proof submissions: %w", err)
+		}
+	}
+
+	return proofs, nil
+}
+
+// proof returns the proof matched by the given condition, with its selections
+func (service *ProofingService) proof(condition string, args ...interface{}) (*Proof, error) {
+	var proof Proof
+	var submittedAt sql.NullTime
+	row := service.DB.QueryRow(`
+		SELECT proofs.id, proofs.gallery_id, coalesce(proofs.user_id, 0),
+			coalesce(users.username, ''), coalesce(users.display_name, ''),
+			proofs.name, proofs.submitted_at, proofs.created_at
+		FROM proofs
+		LEFT JOIN users ON users.id = proofs.user_id
+		WHERE `+condition,
+		args...)
+	err := row.Scan(&proof.ID, &proof.GalleryID, &proof.User.ID, &proof.User.Username,
+		&proof.User.DisplayName, &proof.Name, &submittedAt, &proof.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrProofNotFound
+		}
+		return nil, fmt.Errorf("query proof: %w", err)
+	}
+	proof.SubmittedAt = submittedAt.Time
+
+	proof.Selections, err = service.selections(proof.ID)
+	if err != nil {
+		return nil, fmt.Errorf("query proof: %w", err)
+	}
+
+	return &proof, nil
+}
+
+// selections returns the images selected by the given proof, ordered as the
+// images of the gallery. Images in the trash are left out
+func (service *ProofingService) selections(proofID int) ([]Selection, error) {
+	rows, err := service.DB.Query(`
+		SELECT images.filename, proof_selections.note
+		FROM proof_selections
+		JOIN images ON images.id = proof_selections.image_id
+		WHERE proof_selections.proof_id = $1 AND images.deleted_at IS NULL
+		ORDER BY images.position, images.id`,
+		proofID)
+	if err != nil {
+		return nil, fmt.Errorf("query proof selections: %w", err)
+	}
+	defer rows.Close()
+
+	var selections []Selection
+	for rows.Next() {
+		var selection Selection
+		err = rows.Scan(&selection.Filename, &selection.Note)
+		if err != nil {
+			return nil, fmt.Errorf("query proof selections: %w", err)
+		}
+		selections = append(selections, selection)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query proof selections: %w", err)
+	}
+
+	return selections, nil
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SearchScope defines a new type that wraps the native string type. It
+// represents which galleries are searched (i.e.: the galleries of the current
+// user, or all published galleries)
+type SearchScope string
+
+// Defines the two search scopes
+var (
+	ScopeMine   SearchScope = "mine"
+	ScopePublic SearchScope = "public"
+)
+
+const (
+	// HighlightStart and HighlightStop delimit the matched words in the
+	// highlighted fields of search results. Characters of the Unicode private
+	// use area are used so that they do not clash with user content
+	HighlightStart = "\uE000"
+	HighlightStop  = "\uE001"
+
+	// MaxSearchResults is the maximum number of galleries and of images
+	// returned by a search
+	MaxSearchResults = 50
+)
+
+// GalleryResult defines a gallery that matches a search. The highlighted
+// fields contain the matched words delimited by HighlightStart and
+// HighlightStop
+type GalleryResult struct {
+	Gallery
+	TitleHighlight       string
+	DescriptionHighlight string
+	Rank                 float64
+}
+
+// ImageResult defines an image that matches a search. The highlighted field
+// contains the matched words delimited by HighlightStart and HighlightStop
+type ImageResult struct {
+	Image
+	GalleryTitle     string
+	CaptionHighlight string
+	Rank             float64
+}
+
+// SearchResults holds the galleries and images that match a search, ordered by
+// rank
+type SearchResults struct {
+	Galleries []GalleryResult
+	Images    []ImageResult
+}
+
+// SearchService defines the connection to the DB
+type SearchService struct {
+	DB *sql.DB
+}
+
+// Search runs a full-text search over gallery titles, descriptions, image
+// captions and tags. The query supports the web search syntax (i.e.: quoted
+// phrases, `or` and `-` to exclude words). With ScopeMine only the galleries
+// of the given user are searched, published or not. With ScopePublic only
+// published galleries are searched
+func (ss *SearchService) Search(query string, scope SearchScope, userID int) (*SearchResults, error) {
+	var results SearchResults
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return &results, nil
+	}
+
+	// The scope condition is shared by both queries. It is the only part of
+	// the statements that changes, and it does not contain user input
+	var scopeCond string
+	var scopeArg interface{}
+	switch scope {
+	case ScopeMine:
+		scopeCond = "galleries.user_id = $2"
+		scopeArg = userID
+	default:
+		scopeCond = "galleries.publication_status = $2"
+		scopeArg = Published
+	}
+
+	titleOpts := fmt.Sprintf("StartSel=%s, StopSel=%s, HighlightAll=true", HighlightStart, HighlightStop)
+	textOpts := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=35, MinWords=15", HighlightStart, HighlightStop)
+
+	rows, err := ss.DB.Query(`
+		SELECT galleries.id, galleries.user_id, coalesce(galleries.title, ''),
+			galleries.description, galleries.publication_status,
+			ts_headline('english', coalesce(galleries.title, ''), query, $3),
+			ts_headline('english', galleries.description, query, $4),
+			ts_rank(galleries.search_vector, query) AS rank
+		FROM galleries, websearch_to_tsquery('english', $1) query
+		WHERE galleries.search_vector @@ query AND `+scopeCond+`
+			AND galleries.deleted_at IS NULL
+		ORDER BY rank DESC, galleries.id DESC
+		LIMIT $5`,
+		query, scopeArg, titleOpts, textOpts, MaxSearchResults)
+	if err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result GalleryResult
+		err = rows.Scan(&result.ID, &result.UserID, &result.Title,
+			&result.Description, &result.Status,
+			&result.TitleHighlight, &result.DescriptionHighlight, &result.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("search galleries: %w", err)
+		}
+		results.Galleries = append(results.Galleries, result)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+
+	rows, err = ss.DB.Query(`
+		SELECT images.gallery_id, images.filename, images.caption,
+			coalesce(galleries.title, ''),
+			ts_headline('english', images.caption, query, $3),
+			ts_rank(images.search_vector, query) AS rank
+		FROM images
+		JOIN galleries ON galleries.id = images.gallery_id,
+		websearch_to_tsquery('english', $1) query
+		WHERE images.search_vector @@ query AND `+scopeCond+`
+			AND galleries.deleted_at IS NULL AND images.deleted_at IS NULL
+		ORDER BY rank DESC, images.id DESC
+		LIMIT $4`,
+		query, scopeArg, textOpts, MaxSearchResults)
+	if err != nil {
+		return nil, fmt.Errorf("search images: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result ImageResult
+		err = rows.Scan(&result.GalleryID, &result.Filename, &result.Caption,
+			&result.GalleryTitle, &result.CaptionHighlight, &result.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("search images: %w", err)
+		}
+		results.Images = append(results.Images, result)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("search images: %w", err)
+	}
+
+	return &results, nil
+}
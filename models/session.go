@@ -116,11 +116,13 @@ func (ss *SessionService) User(token string) (*User, error) {
 	// Queries the DB for the user that corresponds to a token hash
 	var user User
 	row := ss.DB.QueryRow(`
-		SELECT users.id, users.email, users.password_hash
+		SELECT users.id, users.email, users.password_hash,
+			coalesce(users.username, ''), users.display_name, users.bio, users.avatar
 		FROM users
 		JOIN sessions ON users.id = sessions.user_id
 		WHERE token_hash = $1`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash,
+		&user.Username, &user.DisplayName, &user.Bio, &user.Avatar)
 	if err != nil {
 		return nil, fmt.Errorf("user: %w", err)
 	}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxSlugLength is the maximum length of a slug, without the suffix that
+	// tells apart galleries with the same title
+	MaxSlugLength = 60
+	// defaultSlug is used for titles without any letter or digit
+	defaultSlug = "gallery"
+)
+
+var (
+	// slugSeparators matches the runs of characters that are replaced by a
+	// hyphen in a slug
+	slugSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+	// reservedSlugs can not be used as slugs because they name pages of the
+	// public profiles
+	reservedSlugs = map[string]bool{
+		"avatar": true,
+		"feed":   true,
+	}
+)
+
+// Slugify returns the slug of the given title: the letters and digits of the
+// title in lower case, separated by hyphens
+func Slugify(title string) string {
+	slug := slugSeparators.ReplaceAllString(strings.ToLower(title), "-")
+	slug = strings.Trim(slug, "-")
+	if len(slug) > MaxSlugLength {
+		slug = strings.TrimRight(slug[:MaxSlugLength], "-")
+	}
+	if slug == "" {
+		slug = defaultSlug
+	}
+
+	return slug
+}
+
+// slugMatches returns true if the given slug was derived from the given title,
+// either as is or with a numeric suffix
+func slugMatches(slug, title string) bool {
+	base := Slugify(title)
+	if slug == base {
+		return true
+	}
+
+	var n int
+	suffix := strings.TrimPrefix(slug, base+"-")
+	_, err := fmt.Sscanf(suffix, "%d", &n)
+
+	return suffix != slug && err == nil && fmt.Sprint(n) == suffix
+}
+
+// uniqueSlug returns a slug for the given title that is not used by any other
+// gallery of the given user. The gallery being updated, if any, is given by
+// excludeID. Taken slugs get a numeric suffix: title, title-2, title-3...
+func uniqueSlug(db *sql.DB, userID int, title string, excludeID int) (string, error) {
+	base := Slugify(title)
+
+	rows, err := db.Query(`
+		SELECT slug
+		FROM galleries
+		WHERE user_id = $1 AND id <> $2 AND (slug = $3 OR slug LIKE $3 || '-%')`,
+		userID, excludeID, base)
+	if err != nil {
+		return "", fmt.Errorf("unique slug: %w", err)
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		err = rows.Scan(&slug)
+		if err != nil {
+			return "", fmt.Errorf("unique slug: %w", err)
+		}
+		taken[slug] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return "", fmt.Errorf("unique slug: %w", err)
+	}
+
+	slug := base
+	for n := 2; taken[slug] || reservedSlugs[slug]; n++ {
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	return slug, nil
+}
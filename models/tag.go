@@ -0,0 +1,366 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MaxTagLength is the maximum number of characters of a tag name. Longer
+	// names are truncated
+	MaxTagLength = 32
+	// DefaultAutocompleteLimit is the number of suggestions returned by
+	// Autocomplete when no limit is given
+	DefaultAutocompleteLimit = 10
+)
+
+// Tag defines the tag model according to the `tags` SQL table
+type Tag struct {
+	ID   int
+	Name string
+}
+
+// TagService defines the connection to the DB
+type TagService struct {
+	DB *sql.DB
+}
+
+// ParseTags splits a comma-separated list of tags, as typed by a user, into a
+// slice of normalized and unique tag names. Empty entries are ignored
+func ParseTags(raw string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		name = normalizeTag(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// normalizeTag lower-cases the given name, replaces inner white spaces by
+// dashes and removes any character that is not a letter, a digit, a dash or an
+// underscore
+func normalizeTag(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.Join(strings.Fields(name), "-")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+
+	runes := []rune(name)
+	if len(runes) > MaxTagLength {
+		runes = runes[:MaxTagLength]
+	}
+
+	return string(runes)
+}
+
+// Autocomplete returns up to `limit` tags starting with the given prefix. The
+// most used tags are returned first
+func (ts *TagService) Autocomplete(prefix string, limit int) ([]Tag, error) {
+	prefix = normalizeTag(prefix)
+	if prefix == "" {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = DefaultAutocompleteLimit
+	}
+
+	// The wildcards of the LIKE operator are escaped so that they are matched
+	// literally
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+	rows, err := ts.DB.Query(`
+		SELECT tags.id, tags.name
+		FROM tags
+		WHERE tags.name LIKE $1
+		ORDER BY
+			(SELECT COUNT(*) FROM gallery_tags WHERE gallery_tags.tag_id = tags.id) +
+			(SELECT COUNT(*) FROM image_tags WHERE image_tags.tag_id = tags.id) DESC,
+			tags.name
+		LIMIT $2`,
+		pattern, limit)
+	if err != nil {
+		return nil, fmt.Errorf("autocomplete tags: %w", err)
+	}
+
+	tags, err := scanTags(rows)
+	if err != nil {
+		return nil, fmt.Errorf("autocomplete tags: %w", err)
+	}
+
+	return tags, nil
+}
+
+// ByGalleryID returns the tags of the given gallery ordered by name
+func (ts *TagService) ByGalleryID(galleryID int) ([]Tag, error) {
+	rows, err := ts.DB.Query(`
+		SELECT tags.id, tags.name
+		FROM tags
+		JOIN gallery_tags ON gallery_tags.tag_id = tags.id
+		WHERE gallery_tags.gallery_id = $1
+		ORDER BY tags.name`,
+		galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query tags by gallery id: %w", err)
+	}
+
+	tags, err := scanTags(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query tags by gallery id: %w", err)
+	}
+
+	return tags, nil
+}
+
+// ByUserID returns all tags used in the galleries of the given user. This is
+// used to filter a user's galleries by tag
+func (ts *TagService) ByUserID(userID int) ([]Tag, error) {
+	rows, err := ts.DB.Query(`
+		SELECT DISTINCT tags.id, tags.name
+		FROM tags
+		JOIN gallery_tags ON gallery_tags.tag_id = tags.id
+		JOIN galleries ON galleries.id = gallery_tags.gallery_id
+		WHERE galleries.user_id = $1 AND galleries.deleted_at IS NULL
+		ORDER BY tags.name`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("query tags by user id: %w", err)
+	}
+
+	tags, err := scanTags(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query tags by user id: %w", err)
+	}
+
+	return tags, nil
+}
+
+// ByGalleryImages returns the tags of every image in the given gallery. The
+// returned map is keyed by the image filename
+func (ts *TagService) ByGalleryImages(galleryID int) (map[string][]Tag, error) {
+	rows, err := ts.DB.Query(`
+		SELECT images.filename, tags.id, tags.name
+		FROM tags
+		JOIN image_tags ON image_tags.tag_id = tags.id
+		JOIN images ON images.id = image_tags.image_id
+		WHERE images.gallery_id = $1
+		ORDER BY tags.name`,
+		galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query image tags by gallery id: %w", err)
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]Tag)
+	for rows.Next() {
+		var filename string
+		var tag Tag
+		err = rows.Scan(&filename, &tag.ID, &tag.Name)
+		if err != nil {
+			return nil, fmt.Errorf("query image tags by gallery id: %w", err)
+		}
+		tags[filename] = append(tags[filename], tag)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query image tags by gallery id: %w", err)
+	}
+
+	return tags, nil
+}
+
+// SetForGallery replaces the tags of the given gallery by the given tag names.
+// Tags that do not exist yet are created
+func (ts *TagService) SetForGallery(galleryID int, names []string) error {
+	tx, err := ts.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("set gallery tags: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM gallery_tags
+		WHERE gallery_id = $1`,
+		galleryID)
+	if err != nil {
+		return fmt.Errorf("set gallery tags: %w", err)
+	}
+
+	for _, name := range names {
+		tagID, err := upsertTag(tx, name)
+		if err != nil {
+			return fmt.Errorf("set gallery tags: %w", err)
+		}
+		if tagID == 0 {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO gallery_tags (gallery_id, tag_id)
+			VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			galleryID, tagID)
+		if err != nil {
+			return fmt.Errorf("set gallery tags: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("set gallery tags: %w", err)
+	}
+
+	return nil
+}
+
+// SetForImage replaces the tags of the image defined by the given gallery ID
+// and filename by the given tag names. Tags that do not exist yet are created
+func (ts *TagService) SetForImage(galleryID int, filename string, names []string) error {
+	tx, err := ts.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("set image tags: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The image row might not exist yet if the image was uploaded before
+	// images were tracked in the database
+	var imageID int
+	row := tx.QueryRow(`
+		INSERT INTO images (gallery_id, filename)
+		VALUES ($1, $2) ON CONFLICT (gallery_id, filename) DO
+		UPDATE
+		SET filename = EXCLUDED.filename
+		RETURNING id`,
+		galleryID, filename)
+	err = row.Scan(&imageID)
+	if err != nil {
+		return fmt.Errorf("set image tags: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM image_tags
+		WHERE image_id = $1`,
+		imageID)
+	if err != nil {
+		return fmt.Errorf("set image tags: %w", err)
+	}
+
+	for _, name := range names {
+		tagID, err := upsertTag(tx, name)
+		if err != nil {
+			return fmt.Errorf("set image tags: %w", err)
+		}
+		if tagID == 0 {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO image_tags (image_id, tag_id)
+			VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			imageID, tagID)
+		if err != nil {
+			return fmt.Errorf("set image tags: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("set image tags: %w", err)
+	}
+
+	return nil
+}
+
+// PublishedGalleries returns a page of the published galleries tagged with the
+// given tag
+func (ts *TagService) PublishedGalleries(name string, opts PageOptions) ([]Gallery, *Page, error) {
+	galleries, page, err := galleriesPage(ts.DB, `
+		SELECT galleries.*
+		FROM galleries
+		JOIN gallery_tags ON gallery_tags.gallery_id = galleries.id
+		JOIN tags ON tags.id = gallery_tags.tag_id
+		WHERE tags.name = $1 AND galleries.publication_status = $2
+			AND galleries.deleted_at IS NULL`,
+		[]interface{}{normalizeTag(name), Published}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query published galleries by tag: %w", err)
+	}
+
+	return galleries, page, nil
+}
+
+// PublishedImages returns a page of the images tagged with the given tag that
+// belong to a published gallery. The Path of the images is not set
+func (ts *TagService) PublishedImages(name string, opts PageOptions) ([]Image, *Page, error) {
+	images, page, err := imagesPage(ts.DB, `
+		SELECT images.*
+		FROM images
+		JOIN galleries ON galleries.id = images.gallery_id
+		JOIN image_tags ON image_tags.image_id = images.id
+		JOIN tags ON tags.id = image_tags.tag_id
+		WHERE tags.name = $1 AND galleries.publication_status = $2
+			AND galleries.deleted_at IS NULL AND images.deleted_at IS NULL`,
+		[]interface{}{normalizeTag(name), Published}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query published images by tag: %w", err)
+	}
+
+	return images, page, nil
+}
+
+// upsertTag creates the tag with the given name in case it does not exist yet,
+// and returns its ID. A zero ID is returned if the name is empty after being
+// normalized
+func upsertTag(tx *sql.Tx, name string) (int, error) {
+	name = normalizeTag(name)
+	if name == "" {
+		return 0, nil
+	}
+
+	var tagID int
+	row := tx.QueryRow(`
+		INSERT INTO tags (name)
+		VALUES ($1) ON CONFLICT (name) DO
+		UPDATE
+		SET name = EXCLUDED.name
+		RETURNING id`,
+		name)
+	err := row.Scan(&tagID)
+	if err != nil {
+		return 0, fmt.Errorf("upsert tag %q: %w", name, err)
+	}
+
+	return tagID, nil
+}
+
+// scanTags scans all rows into a slice of Tag and closes the rows
+func scanTags(rows *sql.Rows) ([]Tag, error) {
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		err := rows.Scan(&tag.ID, &tag.Name)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
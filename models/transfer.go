@@ -0,0 +1,449 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MoveImages moves the images with the given filenames from the source gallery
+// to the destination gallery, keeping their captions and tags. Images whose
+// filename is taken in the destination gallery are renamed. It returns the
+// filenames of the images in the destination gallery. Either all images are
+// moved or none is
+func (service *GalleryService) MoveImages(srcID, dstID int, filenames []string) ([]string, error) {
+	if srcID == dstID {
+		return filenames, nil
+	}
+
+	moved, err := service.transferImages(srcID, dstID, filenames, true)
+	if err != nil {
+		return nil, fmt.Errorf("move images: %w", err)
+	}
+
+	return moved, nil
+}
+
+// CopyImages copies the images with the given filenames from the source
+// gallery to the destination gallery, including their captions, locations and
+// tags, but not their versions. Copies whose filename is taken in the destination
+// gallery are renamed. It returns the filenames of the copies. Either all
+// images are copied or none is
+func (service *GalleryService) CopyImages(srcID, dstID int, filenames []string) ([]string, error) {
+	copied, err := service.transferImages(srcID, dstID, filenames, false)
+	if err != nil {
+		return nil, fmt.Errorf("copy images: %w", err)
+	}
+
+	return copied, nil
+}
+
+// transferImages moves or copies images between galleries. The database
+// changes are made in a transaction, and the storage changes are undone if
+// anything fails, so that the database and the storage stay consistent
+func (service *GalleryService) transferImages(srcID, dstID int, filenames []string, move bool) ([]string, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	dstDir := service.galleryDir(dstID)
+	err = os.MkdirAll(dstDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// undo holds the functions that revert the storage changes made so far
+	var undo []func()
+	revert := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	var transferred []string
+	for _, filename := range filenames {
+		filename = filepath.Base(filename)
+
+		var imageID int
+		var caption string
+		row := tx.QueryRow(`
+			SELECT id, caption
+			FROM images
+			WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL`,
+			srcID, filename)
+		err = row.Scan(&imageID, &caption)
+		if err != nil {
+			revert()
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, ErrImageNotFound
+			}
+			return nil, err
+		}
+
+		target, err := availableFilename(tx, dstID, dstDir, filename)
+		if err != nil {
+			revert()
+			return nil, err
+		}
+
+		if move {
+			_, err = tx.Exec(`
+				UPDATE images
+				SET gallery_id = $2, filename = $3, position = (
+					SELECT coalesce(MAX(position), 0) + 1
+					FROM images
+					WHERE gallery_id = $2)
+				WHERE id = $1`,
+				imageID, dstID, target)
+			if err != nil {
+				revert()
+				return nil, err
+			}
+
+			err = service.transferImageFiles(srcID, filename, dstID, target, true, &undo)
+			if err != nil {
+				revert()
+				return nil, err
+			}
+
+			// The versions are stored by image ID, so they keep their names
+			err = moveDir(service.imageVersionsDir(srcID, imageID), service.imageVersionsDir(dstID, imageID), &undo)
+			if err != nil {
+				revert()
+				return nil, err
+			}
+		} else {
+			var copyID int
+			row = tx.QueryRow(`
+				INSERT INTO images (gallery_id, filename, caption, position,
+					latitude, longitude, geotag_checked, width, height, blurhash,
+					dominant_color)
+				SELECT $1, $2, $3, (
+					SELECT coalesce(MAX(position), 0) + 1
+					FROM images
+					WHERE gallery_id = $1), latitude, longitude, geotag_checked,
+					width, height, blurhash, dominant_color
+				FROM images
+				WHERE id = $4
+				RETURNING id`,
+				dstID, target, caption, imageID)
+			err = row.Scan(&copyID)
+			if err != nil {
+				revert()
+				return nil, err
+			}
+
+			_, err = tx.Exec(`
+				INSERT INTO image_tags (image_id, tag_id)
+				SELECT $2, tag_id
+				FROM image_tags
+				WHERE image_id = $1`,
+				imageID, copyID)
+			if err != nil {
+				revert()
+				return nil, err
+			}
+
+			err = service.transferImageFiles(srcID, filename, dstID, target, false, &undo)
+			if err != nil {
+				revert()
+				return nil, err
+			}
+		}
+
+		transferred = append(transferred, target)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE galleries
+		SET updated_at = now()
+		WHERE id = $1 OR (id = $2 AND $3)`,
+		dstID, srcID, move)
+	if err != nil {
+		revert()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		revert()
+		return nil, err
+	}
+
+	return transferred, nil
+}
+
+// transferImageFiles moves or copies all files of an image, including its
+// original and derived sizes, between galleries. A function that reverts each
+// change is appended to undo
+func (service *GalleryService) transferImageFiles(srcID int, srcName string, dstID int, dstName string, move bool, undo *[]func()) error {
+	srcPaths := service.imagePaths(srcID, srcName)
+	dstPaths := service.imagePaths(dstID, dstName)
+
+	for i := range srcPaths {
+		srcPath, dstPath := srcPaths[i], dstPaths[i]
+
+		_, err := os.Stat(srcPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(dstPath), 0755)
+		if err != nil {
+			return err
+		}
+
+		if move {
+			err = os.Rename(srcPath, dstPath)
+			if err != nil {
+				return err
+			}
+			*undo = append(*undo, func() { os.Rename(dstPath, srcPath) })
+		} else {
+			err = copyFile(srcPath, dstPath)
+			if err != nil {
+				os.Remove(dstPath)
+				return err
+			}
+			*undo = append(*undo, func() { os.Remove(dstPath) })
+		}
+	}
+
+	return nil
+}
+
+// moveDir moves the directory at src to dst, if it exists. A function that
+// reverts the move is appended to undo
+func moveDir(src, dst string, undo *[]func()) error {
+	_, err := os.Stat(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(src, dst)
+	if err != nil {
+		return err
+	}
+	*undo = append(*undo, func() { os.Rename(dst, src) })
+
+	return nil
+}
+
+// rowQuerier is implemented by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// availableFilename returns the given filename if no image of the given
+// gallery uses it, neither in the database nor in storage. Otherwise, a
+// numeric suffix is added before the extension: photo-2.jpg, photo-3.jpg...
+func availableFilename(db rowQuerier, galleryID int, galleryDir, filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+
+	candidate := filename
+	for n := 2; ; n++ {
+		var taken bool
+		row := db.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1
+				FROM images
+				WHERE gallery_id = $1 AND filename = $2)`,
+			galleryID, candidate)
+		err := row.Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+
+		if !taken {
+			_, err = os.Stat(filepath.Join(galleryDir, candidate))
+			if errors.Is(err, os.ErrNotExist) {
+				return candidate, nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		candidate = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+// copyFile copies the contents of the file at src to a new file at dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// DuplicateSuffix is appended to the title of duplicated galleries
+const DuplicateSuffix = " (copy)"
+
+// Duplicate creates a new unpublished gallery owned by the given user that
+// copies the title, with DuplicateSuffix, the description, the collection, the
+// watermark, download, location and comment moderation settings, the license
+// and the tags of the given gallery. If withImages is set, the images are
+// copied as well, keeping their order, captions, locations and tags. Comments,
+// proofing settings and proofs are never copied. Image files are copied rather
+// than shared, since storage is not content-addressed and uploading an image
+// with the same filename overwrites its file
+func (service *GalleryService) Duplicate(gallery *Gallery, userID int, withImages bool) (*Gallery, error) {
+	duplicate := Gallery{
+		UserID:            userID,
+		Title:             gallery.Title + DuplicateSuffix,
+		Description:       gallery.Description,
+		Status:            Unpublished,
+		Watermark:         gallery.Watermark,
+		AllowDownload:     gallery.AllowDownload,
+		MaxResolution:     gallery.MaxResolution,
+		License:           gallery.License,
+		PublicLocation:    gallery.PublicLocation,
+		CommentModeration: gallery.CommentModeration,
+	}
+	// The collection only makes sense for galleries of the same user
+	if userID == gallery.UserID {
+		duplicate.CollectionID = gallery.CollectionID
+	}
+
+	slug, err := uniqueSlug(service.DB, userID, duplicate.Title, 0)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+	duplicate.Slug = slug
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`
+		INSERT INTO galleries (title, slug, description, publication_status, user_id,
+			collection_id, watermark, allow_download, max_resolution, license,
+			public_location, comment_moderation)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, created_at, updated_at`,
+		duplicate.Title, duplicate.Slug, duplicate.Description, duplicate.Status,
+		userID, nullID(duplicate.CollectionID), duplicate.Watermark,
+		duplicate.AllowDownload, duplicate.MaxResolution, duplicate.License,
+		duplicate.PublicLocation, duplicate.CommentModeration)
+	err = row.Scan(&duplicate.ID, &duplicate.CreatedAt, &duplicate.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO gallery_tags (gallery_id, tag_id)
+		SELECT $2, tag_id
+		FROM gallery_tags
+		WHERE gallery_id = $1`,
+		gallery.ID, duplicate.ID)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate gallery tags: %w", err)
+	}
+
+	if withImages {
+		err = service.duplicateImages(tx, gallery.ID, duplicate.ID)
+		if err != nil {
+			os.RemoveAll(service.galleryDir(duplicate.ID))
+			return nil, fmt.Errorf("duplicate gallery images: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		os.RemoveAll(service.galleryDir(duplicate.ID))
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+
+	return &duplicate, nil
+}
+
+// duplicateImages copies the images outside the trash of the source gallery,
+// with their captions, positions, placeholders and tags, to the destination
+// gallery
+func (service *GalleryService) duplicateImages(tx *sql.Tx, srcID, dstID int) error {
+	rows, err := tx.Query(`
+		INSERT INTO images (gallery_id, filename, caption, position,
+			latitude, longitude, geotag_checked, width, height, blurhash,
+			dominant_color)
+		SELECT $2, filename, caption, position, latitude, longitude, geotag_checked,
+			width, height, blurhash, dominant_color
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL
+		RETURNING filename`,
+		srcID, dstID)
+	if err != nil {
+		return err
+	}
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		err = rows.Scan(&filename)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		filenames = append(filenames, filename)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO image_tags (image_id, tag_id)
+		SELECT copies.id, image_tags.tag_id
+		FROM images AS originals
+		JOIN images AS copies
+			ON copies.gallery_id = $2 AND copies.filename = originals.filename
+		JOIN image_tags ON image_tags.image_id = originals.id
+		WHERE originals.gallery_id = $1 AND originals.deleted_at IS NULL`,
+		srcID, dstID)
+	if err != nil {
+		return err
+	}
+
+	// The copied files are removed by the caller along with the directory of
+	// the destination gallery if anything fails
+	var undo []func()
+	for _, filename := range filenames {
+		err = service.transferImageFiles(srcID, filename, dstID, filename, false, &undo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
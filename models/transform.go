@@ -0,0 +1,449 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Default values of the TransformService
+const (
+	stdTransformCacheDir  = "images/cache"
+	stdTransformCacheSize = 512 << 20 // 512MB
+)
+
+// Limits of the transformations, so that a single request can not exhaust the
+// server
+const (
+	MaxTransformSide = 4000
+	stdQuality       = 85
+)
+
+// Fit modes of a transformation that sets both the width and the height
+const (
+	// FitContain scales the image down to fit in the box, keeping its aspect
+	// ratio
+	FitContain = "contain"
+	// FitCover scales and crops the image to fill the box, keeping its
+	// aspect ratio
+	FitCover = "cover"
+	// FitFill stretches the image to the box
+	FitFill = "fill"
+)
+
+// TransformOptions defines how an image is transformed. Zero values keep the
+// image as is: a zero width or height follows the aspect ratio, and a zero
+// format keeps the format of the image
+type TransformOptions struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+// ParseTransformOptions parses options written as comma separated key_value
+// pairs, such as `w_800,h_600,fit_cover,f_jpeg,q_80`. It returns
+// ErrInvalidTransform if the options are malformed or out of bounds
+func ParseTransformOptions(s string) (TransformOptions, error) {
+	var opts TransformOptions
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(pair, "_")
+		if !found || seen[key] {
+			return TransformOptions{}, ErrInvalidTransform
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "w":
+			opts.Width, err = strconv.Atoi(value)
+		case "h":
+			opts.Height, err = strconv.Atoi(value)
+		case "q":
+			opts.Quality, err = strconv.Atoi(value)
+		case "fit":
+			opts.Fit = value
+		case "f":
+			opts.Format = value
+		default:
+			return TransformOptions{}, ErrInvalidTransform
+		}
+		if err != nil {
+			return TransformOptions{}, ErrInvalidTransform
+		}
+	}
+
+	err := opts.validate()
+	if err != nil {
+		return TransformOptions{}, err
+	}
+
+	return opts, nil
+}
+
+// String returns the options in the form parsed by ParseTransformOptions, with
+// the keys always in the same order
+func (opts TransformOptions) String() string {
+	var pairs []string
+	if opts.Width != 0 {
+		pairs = append(pairs, fmt.Sprintf("w_%d", opts.Width))
+	}
+	if opts.Height != 0 {
+		pairs = append(pairs, fmt.Sprintf("h_%d", opts.Height))
+	}
+	if opts.Fit != "" {
+		pairs = append(pairs, "fit_"+opts.Fit)
+	}
+	if opts.Format != "" {
+		pairs = append(pairs, "f_"+opts.Format)
+	}
+	if opts.Quality != 0 {
+		pairs = append(pairs, fmt.Sprintf("q_%d", opts.Quality))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// validate returns ErrInvalidTransform if the options are out of bounds
+func (opts TransformOptions) validate() error {
+	if opts.Width < 0 || opts.Width > MaxTransformSide ||
+		opts.Height < 0 || opts.Height > MaxTransformSide ||
+		opts.Quality < 0 || opts.Quality > 100 {
+		return ErrInvalidTransform
+	}
+
+	switch opts.Fit {
+	case "", FitContain, FitCover, FitFill:
+	default:
+		return ErrInvalidTransform
+	}
+	// Covering and stretching need a box
+	if (opts.Fit == FitCover || opts.Fit == FitFill) && (opts.Width == 0 || opts.Height == 0) {
+		return ErrInvalidTransform
+	}
+
+	// The format is either one supported by the imaging package or a modern
+	// one with a registered encoder
+	if opts.Format != "" && formatEncoders[opts.Format] == nil {
+		_, err := imaging.FormatFromExtension(opts.Format)
+		if err != nil {
+			return ErrInvalidTransform
+		}
+	}
+
+	return nil
+}
+
+// TransformService transforms images on demand, such as resizing them or
+// converting their format. URLs of transformed images are signed so that only
+// the transformations issued by this application are performed, and the
+// results are cached on disk
+type TransformService struct {
+	GalleryService *GalleryService
+
+	// SigningKey is the secret used to sign the URLs
+	SigningKey []byte
+
+	// CacheDir is the directory where the transformed images are cached
+	CacheDir string
+
+	// CacheSize is the maximum size of the cache in bytes. The least recently
+	// used images are evicted when it is exceeded
+	CacheSize int64
+
+	// mu guards the size of the cache and serializes the evictions
+	mu sync.Mutex
+	// used is the size of the cache in bytes. It is measured by the first
+	// eviction, and kept up to date by each new entry afterwards
+	used     int64
+	measured bool
+}
+
+// URL returns the signed URL of the given image transformed with the given
+// options
+func (service *TransformService) URL(galleryID int, filename string, opts TransformOptions) string {
+	options := opts.String()
+	signature := service.Sign(options, galleryID, filename)
+
+	return fmt.Sprintf("/img/%s/%s/%d/%s", signature, options, galleryID, url.PathEscape(filename))
+}
+
+// Sign returns the signature of the given options for the given image
+func (service *TransformService) Sign(options string, galleryID int, filename string) string {
+	mac := hmac.New(sha256.New, service.SigningKey)
+	fmt.Fprintf(mac, "%s/%d/%s", options, galleryID, filename)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns true if the given signature is valid for the given options
+// and image
+func (service *TransformService) Verify(signature, options string, galleryID int, filename string) bool {
+	expected := service.Sign(options, galleryID, filename)
+
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// Transform returns the path of the given image transformed with the given
+// options. The transformation is cached, and the cache entry is discarded when
+// the image changes
+func (service *TransformService) Transform(galleryID int, filename string, opts TransformOptions) (string, error) {
+	err := opts.validate()
+	if err != nil {
+		return "", err
+	}
+
+	img, err := service.GalleryService.Image(galleryID, filename)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(img.Path)
+	if err != nil {
+		return "", fmt.Errorf("transform image: %w", err)
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+
+	// The modification time and the size of the image are part of the key, so
+	// that edits of the image are never served from the cache
+	key := fmt.Sprintf("%d/%s/%s/%d/%d",
+		galleryID, filename, opts, info.ModTime().UnixNano(), info.Size())
+	path, err := service.cached(key, "."+format, func(dst string) error {
+		src, err := imaging.Open(img.Path)
+		if err != nil {
+			return err
+		}
+		quality := opts.Quality
+		if quality == 0 {
+			quality = stdQuality
+		}
+		return saveImage(dst, transform(src, opts), quality)
+	})
+	if err != nil {
+		return "", fmt.Errorf("transform image: %w", err)
+	}
+
+	return path, nil
+}
+
+// Limit returns the path of the image at the given path scaled down to fit in
+// a square of the given side, or the path itself if the image already fits.
+// The result is cached with the transformed images
+func (service *TransformService) Limit(path string, maxSide int) (string, error) {
+	config, err := decodeConfig(path)
+	if err != nil {
+		return "", fmt.Errorf("limit image: %w", err)
+	}
+	if maxSide <= 0 || (config.Width <= maxSide && config.Height <= maxSide) {
+		return path, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("limit image: %w", err)
+	}
+
+	key := fmt.Sprintf("limit/%s/%d/%d/%d", path, maxSide, info.ModTime().UnixNano(), info.Size())
+	dst, err := service.cached(key, strings.ToLower(filepath.Ext(path)), func(dst string) error {
+		src, err := imaging.Open(path)
+		if err != nil {
+			return err
+		}
+		return saveImage(dst, imaging.Fit(src, maxSide, maxSide, imaging.Lanczos), stdQuality)
+	})
+	if err != nil {
+		return "", fmt.Errorf("limit image: %w", err)
+	}
+
+	return dst, nil
+}
+
+// SizePath returns the path of the given derived size of the given image, no
+// larger than the given maximum resolution unless it is zero. If the size was
+// not generated yet, the current version is scaled down to it instead, so that
+// the full image is never served in its place
+func (service *TransformService) SizePath(galleryID int, filename, size string, maxResolution int) (string, error) {
+	path, err := service.GalleryService.SizePath(galleryID, filename, size)
+	if !errors.Is(err, ErrSizeMissing) {
+		return path, err
+	}
+
+	img, err := service.GalleryService.Image(galleryID, filename)
+	if err != nil {
+		return "", err
+	}
+	var maxSide int
+	for _, s := range ImageSizes {
+		if s.Name == size {
+			maxSide = s.MaxSide
+		}
+	}
+	if maxResolution > 0 && maxResolution < maxSide {
+		maxSide = maxResolution
+	}
+
+	return service.Limit(img.Path, maxSide)
+}
+
+// cached returns the path of the cache entry with the given key and extension.
+// The entry is created with the given function, which writes it to the path it
+// receives, if it does not exist yet. The key must change whenever the entry
+// would, such as when the image it is derived from is edited
+func (service *TransformService) cached(key, ext string, create func(dst string) error) (string, error) {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	path := filepath.Join(service.cacheDir(), name[:2], name+ext)
+
+	// The modification time of the cached images tracks their last use
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if err == nil {
+		return path, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = create(path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	err = service.grow(info.Size())
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// grow adds the given number of bytes to the size of the cache, and evicts
+// images if it no longer fits. The cache is only walked when it is measured
+// for the first time or when it is full
+func (service *TransformService) grow(size int64) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.measured {
+		service.used += size
+		if service.used <= service.cacheSize() {
+			return nil
+		}
+	}
+
+	return service.evict()
+}
+
+// evict removes the least recently used images from the cache until it fits
+// its size, and measures the size of the cache. It must be called with mu held
+func (service *TransformService) evict() error {
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.WalkDir(service.cacheDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, e := range entries {
+		if total <= service.cacheSize() {
+			break
+		}
+		err = os.Remove(e.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= e.size
+	}
+	service.used = total
+	service.measured = true
+
+	return nil
+}
+
+// cacheDir returns the cache directory, or the default one if not set
+func (service *TransformService) cacheDir() string {
+	if service.CacheDir == "" {
+		return stdTransformCacheDir
+	}
+
+	return service.CacheDir
+}
+
+// cacheSize returns the size of the cache, or the default one if not set
+func (service *TransformService) cacheSize() int64 {
+	if service.CacheSize <= 0 {
+		return stdTransformCacheSize
+	}
+
+	return service.CacheSize
+}
+
+// transform resizes the given image according to the given options. Images are
+// never enlarged, except when stretched to fill a box
+func transform(src image.Image, opts TransformOptions) image.Image {
+	bounds := src.Bounds()
+	width, height := opts.Width, opts.Height
+
+	switch {
+	case width == 0 && height == 0:
+		return src
+	case opts.Fit == FitFill:
+		return imaging.Resize(src, width, height, imaging.Lanczos)
+	case opts.Fit == FitCover:
+		return imaging.Fill(src, width, height, imaging.Center, imaging.Lanczos)
+	case width == 0:
+		width = bounds.Dx()
+	case height == 0:
+		height = bounds.Dy()
+	}
+
+	if bounds.Dx() <= width && bounds.Dy() <= height {
+		return src
+	}
+
+	return imaging.Fit(src, width, height, imaging.Lanczos)
+}
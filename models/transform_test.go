@@ -0,0 +1,49 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransformCacheEviction(t *testing.T) {
+	service := &TransformService{
+		CacheDir:  t.TempDir(),
+		CacheSize: 250,
+	}
+	create := func(dst string) error {
+		return os.WriteFile(dst, bytes.Repeat([]byte{'x'}, 100), 0644)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := service.cached(fmt.Sprintf("entry/%d", i), ".png", create)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total int64
+		err = filepath.WalkDir(service.CacheDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total > service.CacheSize {
+			t.Errorf("after %d entries, cache size = %d, want at most %d", i+1, total, service.CacheSize)
+		}
+		if service.used != total {
+			t.Errorf("after %d entries, tracked cache size = %d, want %d", i+1, service.used, total)
+		}
+	}
+}
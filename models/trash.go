@@ -0,0 +1,293 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stdTrashRetention is the standard period during which galleries and images
+// stay in the trash
+var stdTrashRetention = 30 * 24 * time.Hour
+
+// Retention returns how long galleries and images stay in the trash before
+// they are purged
+func (service *GalleryService) Retention() time.Duration {
+	if service.TrashRetention <= 0 {
+		return stdTrashRetention
+	}
+
+	return service.TrashRetention
+}
+
+// TrashedByID query and returns a gallery in the trash by the given ID
+func (service *GalleryService) TrashedByID(id int) (*Gallery, error) {
+	return service.byID(id, true)
+}
+
+// TrashedGalleries returns the galleries of the given user that are in the
+// trash, the most recently deleted first
+func (service *GalleryService) TrashedGalleries(userID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, coalesce(title, ''), publication_status, deleted_at
+		FROM galleries
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id DESC`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("query trashed galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			UserID: userID,
+		}
+		err = rows.Scan(&gallery.ID, &gallery.Title, &gallery.Status, &gallery.DeletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query trashed galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query trashed galleries: %w", err)
+	}
+
+	return galleries, nil
+}
+
+// TrashedImages returns the images in the trash that belong to galleries of
+// the given user. Images of galleries in the trash are restored and purged
+// with their gallery, so they are not returned. The Path of the images is not
+// set
+func (service *GalleryService) TrashedImages(userID int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT images.id, images.gallery_id, images.filename, images.caption,
+			images.deleted_at
+		FROM images
+		JOIN galleries ON galleries.id = images.gallery_id
+		WHERE galleries.user_id = $1 AND galleries.deleted_at IS NULL
+			AND images.deleted_at IS NOT NULL
+		ORDER BY images.deleted_at DESC, images.id DESC`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("query trashed images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		var image Image
+		err = rows.Scan(&image.ID, &image.GalleryID, &image.Filename,
+			&image.Caption, &image.DeletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query trashed images: %w", err)
+		}
+		images = append(images, image)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query trashed images: %w", err)
+	}
+
+	return images, nil
+}
+
+// Restore moves a gallery out of the trash by ID
+func (service *GalleryService) Restore(id int) error {
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET deleted_at = NULL, updated_at = now()
+		WHERE id = $1`,
+		id)
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+
+	return nil
+}
+
+// Purge permanently deletes a gallery by ID, together with the folder in which
+// its images are stored
+func (service *GalleryService) Purge(id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM galleries
+		WHERE id = $1`,
+		id)
+	if err != nil {
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+
+	// Deletes the folder in which the images are stored
+	dir := service.galleryDir(id)
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return fmt.Errorf("purge gallery folder and images: %w", err)
+	}
+
+	return nil
+}
+
+// TrashedImage returns the image in the trash defined by the given filename and
+// given gallery. ErrImageNotFound is returned if there is no such image
+func (service *GalleryService) TrashedImage(galleryID int, filename string) (Image, error) {
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+		Path:      filepath.Join(service.galleryDir(galleryID), filename),
+	}
+
+	row := service.DB.QueryRow(`
+		SELECT id, caption, position, created_at, deleted_at
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NOT NULL`,
+		galleryID, filename)
+	err := row.Scan(&image.ID, &image.Caption, &image.Position,
+		&image.CreatedAt, &image.DeletedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrImageNotFound
+		}
+		return Image{}, fmt.Errorf("querying for trashed image: %w", err)
+	}
+
+	return image, nil
+}
+
+// RestoreImage moves the image defined by the given gallery ID and filename out
+// of the trash
+func (service *GalleryService) RestoreImage(galleryID int, filename string) error {
+	image, err := service.TrashedImage(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("restoring image: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE images
+		SET deleted_at = NULL
+		WHERE id = $1`,
+		image.ID)
+	if err != nil {
+		return fmt.Errorf("restoring image: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE galleries
+		SET updated_at = now()
+		WHERE id = $1`,
+		galleryID)
+	if err != nil {
+		return fmt.Errorf("restoring image: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeImage permanently deletes the image in the trash defined by the given
+// gallery ID and filename, together with its file
+func (service *GalleryService) PurgeImage(galleryID int, filename string) error {
+	image, err := service.TrashedImage(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("purging image: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		DELETE FROM images
+		WHERE id = $1`,
+		image.ID)
+	if err != nil {
+		return fmt.Errorf("purging image: %w", err)
+	}
+
+	err = service.removeImageFiles(galleryID, image.Filename)
+	if err != nil {
+		return fmt.Errorf("purging image: %w", err)
+	}
+	err = os.RemoveAll(service.imageVersionsDir(galleryID, image.ID))
+	if err != nil {
+		return fmt.Errorf("purging image: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeTrash permanently deletes the galleries and images that have been in
+// the trash for longer than the retention period, together with their files
+func (service *GalleryService) PurgeTrash() error {
+	seconds := int(service.Retention().Seconds())
+
+	rows, err := service.DB.Query(`
+		DELETE FROM galleries
+		WHERE deleted_at < now() - $1 * interval '1 second'
+		RETURNING id`,
+		seconds)
+	if err != nil {
+		return fmt.Errorf("purge trash: %w", err)
+	}
+	var galleryIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("purge trash: %w", err)
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("purge trash: %w", err)
+	}
+
+	for _, id := range galleryIDs {
+		err = os.RemoveAll(service.galleryDir(id))
+		if err != nil {
+			return fmt.Errorf("purge trash: %w", err)
+		}
+	}
+
+	rows, err = service.DB.Query(`
+		DELETE FROM images
+		WHERE deleted_at < now() - $1 * interval '1 second'
+		RETURNING id, gallery_id, filename`,
+		seconds)
+	if err != nil {
+		return fmt.Errorf("purge trash: %w", err)
+	}
+	var images []Image
+	for rows.Next() {
+		var image Image
+		err = rows.Scan(&image.ID, &image.GalleryID, &image.Filename)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("purge trash: %w", err)
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("purge trash: %w", err)
+	}
+
+	for _, image := range images {
+		err = service.removeImageFiles(image.GalleryID, image.Filename)
+		if err != nil {
+			return fmt.Errorf("purge trash: %w", err)
+		}
+		err = os.RemoveAll(service.imageVersionsDir(image.GalleryID, image.ID))
+		if err != nil {
+			return fmt.Errorf("purge trash: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -16,11 +16,23 @@ type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// Username is empty until the user chooses one. Only users with a
+	// username have a public profile
+	Username    string
+	DisplayName string
+	Bio         string
+	// Avatar is the filename of the avatar image, or empty if the user has not
+	// uploaded one
+	Avatar string
 }
 
 // UserService defines the connection to the users DB
 type UserService struct {
 	DB *sql.DB
+	// AvatarsDir is used to tell the UserService where to store and locate
+	// avatars. If not set, the UserService defaults to using the standard
+	// avatar directory `stdAvatarsDir`
+	AvatarsDir string
 }
 
 // Create creates a new user
@@ -0,0 +1,305 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Kinds of image versions, given by the change that created them
+const (
+	VersionUpload = "upload"
+	VersionEdit   = "edit"
+	VersionRevert = "revert"
+)
+
+// versionsDir is the directory inside the directory of a gallery that holds
+// the versions of its images, one directory per image ID
+const versionsDir = ".versions"
+
+// ImageVersion defines a version of an image. Each upload, edit or revert of
+// an image stores its resulting file as a new version, numbered from one
+type ImageVersion struct {
+	ID        int
+	ImageID   int
+	Number    int
+	Kind      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// Versions returns the versions of the given image, newest first
+func (service *GalleryService) Versions(galleryID int, filename string) ([]ImageVersion, error) {
+	img, err := service.Image(galleryID, filename)
+	if err != nil {
+		return nil, fmt.Errorf("query versions: %w", err)
+	}
+
+	rows, err := service.DB.Query(`
+		SELECT id, image_id, number, kind, size, created_at
+		FROM image_versions
+		WHERE image_id = $1
+		ORDER BY number DESC`,
+		img.ID)
+	if err != nil {
+		return nil, fmt.Errorf("query versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []ImageVersion
+	for rows.Next() {
+		var version ImageVersion
+		err = rows.Scan(&version.ID, &version.ImageID, &version.Number,
+			&version.Kind, &version.Size, &version.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query versions: %w", err)
+		}
+		versions = append(versions, version)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+// VersionsByGallery returns the versions of every image outside the trash in
+// the given gallery, newest first. The returned map is keyed by the image
+// filename
+func (service *GalleryService) VersionsByGallery(galleryID int) (map[string][]ImageVersion, error) {
+	rows, err := service.DB.Query(`
+		SELECT images.filename, image_versions.id, image_versions.image_id,
+			image_versions.number, image_versions.kind, image_versions.size,
+			image_versions.created_at
+		FROM image_versions
+		JOIN images ON images.id = image_versions.image_id
+		WHERE images.gallery_id = $1 AND images.deleted_at IS NULL
+		ORDER BY image_versions.number DESC`,
+		galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query versions by gallery id: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[string][]ImageVersion)
+	for rows.Next() {
+		var filename string
+		var version ImageVersion
+		err = rows.Scan(&filename, &version.ID, &version.ImageID, &version.Number,
+			&version.Kind, &version.Size, &version.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query versions by gallery id: %w", err)
+		}
+		versions[filename] = append(versions[filename], version)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query versions by gallery id: %w", err)
+	}
+
+	return versions, nil
+}
+
+// VersionPath returns the path of the file of the given version of the given
+// image. It returns ErrVersionNotFound if there is no such version
+func (service *GalleryService) VersionPath(galleryID int, filename string, number int) (string, error) {
+	img, err := service.Image(galleryID, filename)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = service.version(img.ID, number)
+	if err != nil {
+		return "", err
+	}
+
+	return service.versionPath(galleryID, img.ID, filename, number), nil
+}
+
+// RevertImage makes the given version of the given image its current version
+// and regenerates its derived sizes. The revert is stored as a new version,
+// so that it can be reverted as well
+func (service *GalleryService) RevertImage(galleryID int, filename string, number int) error {
+	img, err := service.Image(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("revert image: %w", err)
+	}
+
+	_, err = service.version(img.ID, number)
+	if err != nil {
+		return fmt.Errorf("revert image: %w", err)
+	}
+
+	err = replaceFile(service.versionPath(galleryID, img.ID, filename, number), img.Path)
+	if err != nil {
+		return fmt.Errorf("revert image: %w", err)
+	}
+
+	err = service.generateSizes(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("revert image: %w", err)
+	}
+
+	err = service.updatePlaceholder(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("revert image: %w", err)
+	}
+
+	err = service.recordVersion(img, VersionRevert)
+	if err != nil {
+		return fmt.Errorf("revert image: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE galleries
+		SET updated_at = now()
+		WHERE id = $1`,
+		galleryID)
+	if err != nil {
+		return fmt.Errorf("revert image: %w", err)
+	}
+
+	return nil
+}
+
+// version returns the given version of the given image
+func (service *GalleryService) version(imageID, number int) (*ImageVersion, error) {
+	version := ImageVersion{
+		ImageID: imageID,
+		Number:  number,
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, kind, size, created_at
+		FROM image_versions
+		WHERE image_id = $1 AND number = $2`,
+		imageID, number)
+	err := row.Scan(&version.ID, &version.Kind, &version.Size, &version.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, fmt.Errorf("query version: %w", err)
+	}
+
+	return &version, nil
+}
+
+// recordVersion stores the current file of the given image as its next
+// version
+func (service *GalleryService) recordVersion(img Image, kind string) error {
+	info, err := os.Stat(img.Path)
+	if err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+
+	var number int
+	row := service.DB.QueryRow(`
+		INSERT INTO image_versions (image_id, number, kind, size)
+		SELECT $1, coalesce(MAX(number), 0) + 1, $2, $3
+		FROM image_versions
+		WHERE image_id = $1
+		RETURNING number`,
+		img.ID, kind, info.Size())
+	err = row.Scan(&number)
+	if err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+
+	path := service.versionPath(img.GalleryID, img.ID, img.Filename, number)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		os.Remove(path)
+		err = copyFile(img.Path, path)
+	}
+	if err != nil {
+		service.DB.Exec(`
+			DELETE FROM image_versions
+			WHERE image_id = $1 AND number = $2`,
+			img.ID, number)
+		return fmt.Errorf("record version: %w", err)
+	}
+
+	return nil
+}
+
+// ensureVersion stores the current file of the given image as its first
+// version if it has none yet, which is the case of images uploaded before
+// versions were stored, and of copies. It must be called before the file is
+// changed, so that the change can be reverted. It does nothing if the image
+// does not exist
+func (service *GalleryService) ensureVersion(galleryID int, filename string) error {
+	img, err := service.Image(galleryID, filename)
+	if errors.Is(err, ErrImageNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM image_versions
+			WHERE image_id = $1)`,
+		img.ID)
+	err = row.Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	return service.recordVersion(img, VersionUpload)
+}
+
+// imageVersionsDir returns the directory that holds the versions of the given
+// image
+func (service *GalleryService) imageVersionsDir(galleryID, imageID int) string {
+	return filepath.Join(service.galleryDir(galleryID), versionsDir, strconv.Itoa(imageID))
+}
+
+// versionPath returns the path of the file of the given version. The file
+// keeps the extension of the image, so that its format is known
+func (service *GalleryService) versionPath(galleryID, imageID int, filename string, number int) string {
+	name := strconv.Itoa(number) + filepath.Ext(filename)
+	return filepath.Join(service.imageVersionsDir(galleryID, imageID), name)
+}
+
+// replaceFile replaces the file at dst by a copy of the file at src. The copy
+// is written to a temporary file first, so that the file at dst is never left
+// half written
+func replaceFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".edit-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, in)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
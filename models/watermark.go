@@ -0,0 +1,355 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// stdWatermarksDir is the default directory where the watermark logos are
+// stored
+var stdWatermarksDir string = filepath.Join(stdImagesDir, "watermarks")
+
+// Positions of the watermarks on the images
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkCenter      = "center"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+)
+
+// WatermarkPositions lists the supported positions of the watermarks
+var WatermarkPositions = []string{
+	WatermarkTopLeft,
+	WatermarkTopRight,
+	WatermarkCenter,
+	WatermarkBottomLeft,
+	WatermarkBottomRight,
+}
+
+// Watermark defines the watermark of a user, which is applied to the images of
+// the galleries that have watermarking enabled when they are shown to other
+// users. The watermark is the logo if there is one, and the text otherwise
+type Watermark struct {
+	UserID int
+	Text   string
+	// Logo is the filename of the logo, if any, and LogoPath its path
+	Logo     string
+	LogoPath string
+	Position string
+	// Opacity ranges from 0, transparent, to 1, opaque
+	Opacity float64
+	// Scale is the width of the watermark as a fraction of the image width
+	Scale     float64
+	UpdatedAt time.Time
+}
+
+// Empty returns true if the watermark has neither logo nor text, in which case
+// it is not applied
+func (wm *Watermark) Empty() bool {
+	return wm.Logo == "" && strings.TrimSpace(wm.Text) == ""
+}
+
+// WatermarkService defines available services
+type WatermarkService struct {
+	DB *sql.DB
+
+	// WatermarksDir is the directory where the logos are stored. If not set,
+	// stdWatermarksDir is used
+	WatermarksDir string
+}
+
+// ByUserID returns the watermark of the given user. Users who never set it get
+// an empty watermark with the default settings
+func (service *WatermarkService) ByUserID(userID int) (*Watermark, error) {
+	wm := Watermark{
+		UserID:   userID,
+		Position: WatermarkBottomRight,
+		Opacity:  0.5,
+		Scale:    0.2,
+	}
+
+	var logo sql.NullString
+	row := service.DB.QueryRow(`
+		SELECT text, logo, position, opacity, scale, updated_at
+		FROM watermarks
+		WHERE user_id = $1`,
+		userID)
+	err := row.Scan(&wm.Text, &logo, &wm.Position, &wm.Opacity, &wm.Scale, &wm.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &wm, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query watermark by user id: %w", err)
+	}
+	if logo.Valid {
+		wm.Logo = logo.String
+		wm.LogoPath = filepath.Join(service.watermarksDir(), filepath.Base(logo.String))
+	}
+
+	return &wm, nil
+}
+
+// Update stores the text, position, opacity and scale of the given watermark.
+// It returns ErrInvalidWatermark if any of them is out of range
+func (service *WatermarkService) Update(wm *Watermark) error {
+	valid := false
+	for _, position := range WatermarkPositions {
+		valid = valid || wm.Position == position
+	}
+	if !valid || wm.Opacity < 0 || wm.Opacity > 1 || wm.Scale <= 0 || wm.Scale > 1 {
+		return ErrInvalidWatermark
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO watermarks (user_id, text, position, opacity, scale)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE
+		SET text = $2, position = $3, opacity = $4, scale = $5, updated_at = now()
+		RETURNING updated_at`,
+		wm.UserID, strings.TrimSpace(wm.Text), wm.Position, wm.Opacity, wm.Scale)
+	err := row.Scan(&wm.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("update watermark: %w", err)
+	}
+
+	return nil
+}
+
+// SetLogo stores the given file as the watermark logo of the given user. PNG
+// logos with transparency give the best results
+func (service *WatermarkService) SetLogo(userID int, filename string, contents io.ReadSeeker) error {
+	err := checkContentType(contents, stdImagesCont[:])
+	if err != nil {
+		return fmt.Errorf("set watermark logo: %w", err)
+	}
+	err = checkExtension(filename, stdImagesExt[:])
+	if err != nil {
+		return fmt.Errorf("set watermark logo: %w", err)
+	}
+
+	wm, err := service.ByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("set watermark logo: %w", err)
+	}
+
+	err = os.MkdirAll(service.watermarksDir(), 0755)
+	if err != nil {
+		return fmt.Errorf("creating watermark directory: %w", err)
+	}
+
+	// The logo is named after the user so that uploads never collide
+	logo := fmt.Sprintf("user-%d%s", userID, strings.ToLower(filepath.Ext(filename)))
+	dst, err := os.Create(filepath.Join(service.watermarksDir(), logo))
+	if err != nil {
+		return fmt.Errorf("creating watermark logo file: %w", err)
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, contents)
+	if err != nil {
+		return fmt.Errorf("copying contents to watermark logo: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		INSERT INTO watermarks (user_id, logo)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET logo = $2, updated_at = now()`,
+		userID, logo)
+	if err != nil {
+		return fmt.Errorf("set watermark logo: %w", err)
+	}
+
+	// A logo with a different extension is left behind otherwise
+	if wm.Logo != "" && wm.Logo != logo {
+		err = os.Remove(wm.LogoPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing previous watermark logo: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveLogo removes the watermark logo of the given user, so that the text
+// is used instead
+func (service *WatermarkService) RemoveLogo(userID int) error {
+	wm, err := service.ByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("remove watermark logo: %w", err)
+	}
+	if wm.Logo == "" {
+		return nil
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE watermarks
+		SET logo = NULL, updated_at = now()
+		WHERE user_id = $1`,
+		userID)
+	if err != nil {
+		return fmt.Errorf("remove watermark logo: %w", err)
+	}
+
+	err = os.Remove(wm.LogoPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove watermark logo: %w", err)
+	}
+
+	return nil
+}
+
+// watermarksDir returns the directory where the logos are stored. If no
+// directory is specified, the standard directory stdWatermarksDir is used
+func (service *WatermarkService) watermarksDir() string {
+	if service.WatermarksDir == "" {
+		return stdWatermarksDir
+	}
+
+	return service.WatermarksDir
+}
+
+// Watermark returns the path of the image at the given path with the given
+// watermark applied. The result is cached with the transformed images, and the
+// cache entry is discarded when the image or the watermark changes
+func (service *TransformService) Watermark(path string, wm *Watermark) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("watermark image: %w", err)
+	}
+
+	key := fmt.Sprintf("watermark/%s/%d/%d/%d/%d",
+		path, info.ModTime().UnixNano(), info.Size(), wm.UserID, wm.UpdatedAt.UnixNano())
+	dst, err := service.cached(key, strings.ToLower(filepath.Ext(path)), func(dst string) error {
+		src, err := imaging.Open(path)
+		if err != nil {
+			return err
+		}
+		img, err := applyWatermark(src, wm)
+		if err != nil {
+			return err
+		}
+		return saveImage(dst, img, 0)
+	})
+	if err != nil {
+		return "", fmt.Errorf("watermark image: %w", err)
+	}
+
+	return dst, nil
+}
+
+// applyWatermark draws the given watermark over the given image
+func applyWatermark(img image.Image, wm *Watermark) (image.Image, error) {
+	bounds := img.Bounds()
+	width := int(float64(bounds.Dx()) * wm.Scale)
+	if width < 1 {
+		width = 1
+	}
+
+	var mark image.Image
+	if wm.Logo != "" {
+		logo, err := imaging.Open(wm.LogoPath)
+		if err != nil {
+			return nil, err
+		}
+		mark = imaging.Resize(logo, width, 0, imaging.Lanczos)
+	} else {
+		text, err := textMark(strings.TrimSpace(wm.Text))
+		if err != nil {
+			return nil, err
+		}
+		mark = imaging.Resize(text, width, 0, imaging.Lanczos)
+	}
+
+	// The watermark keeps a margin from the edges of the image
+	margin := bounds.Dx() / 50
+	if bounds.Dy() < bounds.Dx() {
+		margin = bounds.Dy() / 50
+	}
+	left := margin
+	right := bounds.Dx() - mark.Bounds().Dx() - margin
+	top := margin
+	bottom := bounds.Dy() - mark.Bounds().Dy() - margin
+
+	var pos image.Point
+	switch wm.Position {
+	case WatermarkTopLeft:
+		pos = image.Pt(left, top)
+	case WatermarkTopRight:
+		pos = image.Pt(right, top)
+	case WatermarkCenter:
+		pos = image.Pt((left+right)/2, (top+bottom)/2)
+	case WatermarkBottomLeft:
+		pos = image.Pt(left, bottom)
+	default:
+		pos = image.Pt(right, bottom)
+	}
+
+	return imaging.Overlay(img, mark, pos, wm.Opacity), nil
+}
+
+// watermarkFont is the font of the text watermarks, parsed once
+var watermarkFont = struct {
+	once sync.Once
+	font *opentype.Font
+	err  error
+}{}
+
+// textMarkSize is the font size at which the text watermarks are drawn. They
+// are then scaled to the width of the watermark
+const textMarkSize = 96
+
+// textMark draws the given text in white over a transparent background
+func textMark(text string) (image.Image, error) {
+	watermarkFont.once.Do(func() {
+		watermarkFont.font, watermarkFont.err = opentype.Parse(gobold.TTF)
+	})
+	if watermarkFont.err != nil {
+		return nil, watermarkFont.err
+	}
+
+	face, err := opentype.NewFace(watermarkFont.font, &opentype.FaceOptions{
+		Size:    textMarkSize,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	// A shadow keeps the text readable over light images
+	drawer := font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(color.NRGBA{0, 0, 0, 128}),
+		Face: face,
+		Dot:  fixed.Point26_6{X: fixed.I(2), Y: metrics.Ascent + fixed.I(2)},
+	}
+	drawer.DrawString(text)
+	drawer.Src = image.White
+	drawer.Dot = fixed.Point26_6{Y: metrics.Ascent}
+	drawer.DrawString(text)
+
+	return dst, nil
+}
@@ -0,0 +1,18 @@
+//go:build cgo
+
+package models
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// The WebP encoder bundles libwebp, so it is only available when cgo is
+// enabled
+func init() {
+	formatEncoders["webp"] = func(w io.Writer, img image.Image, quality int) error {
+		return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	}
+}
@@ -0,0 +1,109 @@
+package views
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/wagnojunior/lenslocked/models"
+)
+
+// paginationTpl defines reusable controls to navigate between the pages of a
+// listing and to change its sort order. They are parsed with every template,
+// so any page can use them:
+//
+//	{{template "pagination" (pager "cursor" .Page)}}
+//	{{template "sort_options" (sorter .Sort "created" "Newest" "title" "Title")}}
+const paginationTpl = `
+{{define "pagination"}}
+{{if .Page}}{{if or .Page.Prev .Page.Next}}
+<div class="join grid grid-cols-2 py-4">
+    {{if .Page.Prev}}
+    <a href="{{withQuery .Param .Page.Prev}}" class="join-item btn btn-outline">Previous</a>
+    {{else}}
+    <button class="join-item btn btn-outline" disabled>Previous</button>
+    {{end}}
+    {{if .Page.Next}}
+    <a href="{{withQuery .Param .Page.Next}}" class="join-item btn btn-outline">Next</a>
+    {{else}}
+    <button class="join-item btn btn-outline" disabled>Next</button>
+    {{end}}
+</div>
+{{end}}{{end}}
+{{end}}
+
+{{define "sort_options"}}
+<div class="flex flex-wrap items-center gap-2 pb-4 fluidtext-sm">
+    <span>Sort by:</span>
+    {{$current := .Current}}
+    {{range .Options}}
+    <a href="{{withQuery "sort" .Value "cursor" ""}}"
+        class="badge {{if eq .Value $current}}badge-primary{{else}}badge-outline{{end}}">{{.Label}}</a>
+    {{end}}
+</div>
+{{end}}
+`
+
+// pager binds a page of a listing to the query parameter that carries its
+// cursor. This allows a single page to show several paginated listings
+type pager struct {
+	Param string
+	Page  *models.Page
+}
+
+// newPager returns a pager for the given query parameter and page
+func newPager(param string, page *models.Page) pager {
+	return pager{
+		Param: param,
+		Page:  page,
+	}
+}
+
+// sortOption defines one of the sort orders offered by the sort control
+type sortOption struct {
+	Value string
+	Label string
+}
+
+// sorter defines the sort orders offered by the sort control and the current
+// one
+type sorter struct {
+	Current string
+	Options []sortOption
+}
+
+// newSorter returns a sorter with the current sort order and the given options,
+// which are given as pairs of value and label
+func newSorter(current string, pairs ...string) sorter {
+	s := sorter{
+		Current: current,
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s.Options = append(s.Options, sortOption{
+			Value: pairs[i],
+			Label: pairs[i+1],
+		})
+	}
+
+	return s
+}
+
+// withQuery returns the URL of the given request with the given query
+// parameters, given as pairs of key and value, replaced. Parameters with an
+// empty value are removed
+func withQuery(r *http.Request, pairs ...string) string {
+	query := r.URL.Query()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			query.Del(pairs[i])
+			continue
+		}
+		query.Set(pairs[i], pairs[i+1])
+	}
+
+	u := url.URL{
+		Path:     r.URL.Path,
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
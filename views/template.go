@@ -55,10 +55,22 @@ func ParseFS(fs fs.FS, patterns ...string) (Template, error) {
 			"errors": func() []string {
 				return nil
 			},
+			"withQuery": func(pairs ...string) (string, error) {
+				return "", fmt.Errorf("withQuery not implemented")
+			},
+			"pager":  newPager,
+			"sorter": newSorter,
 		},
 	)
 
-	tpl, err := tpl.ParseFS(fs, patterns...)
+	// The reusable controls are parsed before the given patterns so that the
+	// patterns can override them
+	_, err := tpl.New("controls").Parse(paginationTpl)
+	if err != nil {
+		return Template{}, fmt.Errorf("parsing template: %w", err)
+	}
+
+	tpl, err = tpl.ParseFS(fs, patterns...)
 	if err != nil {
 		return Template{}, fmt.Errorf("parsing template: %w", err)
 	}
@@ -95,6 +107,9 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 			"errors": func() []string {
 				return errMessages
 			},
+			"withQuery": func(pairs ...string) string {
+				return withQuery(r, pairs...)
+			},
 		},
 	)
 